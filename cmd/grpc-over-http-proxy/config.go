@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v2"
+
+	"mfycheng.dev/grpc-over-http/gateway"
+)
+
+// Config is the configuration of the proxy.
+type Config struct {
+	Backend BackendConfig `yaml:"backend"`
+	Listen  ListenConfig  `yaml:"listen"`
+
+	Prefixes PrefixConfig `yaml:"prefixes"`
+
+	// ForwardedHeaders are the HTTP headers forwarded as metadata.
+	ForwardedHeaders []string `yaml:"forwarded_headers"`
+
+	// HealthCheck is the service checked by the readiness route, if set.
+	HealthCheck *string `yaml:"health_check"`
+
+	Limits LimitsConfig `yaml:"limits"`
+	Expose ExposeConfig `yaml:"expose"`
+}
+
+// BackendConfig configures the connection to the gRPC server.
+type BackendConfig struct {
+	Address string `yaml:"address"`
+
+	// DescriptorSet is the path of a FileDescriptorSet containing the services
+	// to expose. If empty, the services are discovered using reflection.
+	DescriptorSet string `yaml:"descriptor_set"`
+
+	// DiscoveryTimeout bounds the time spent discovering services. If zero,
+	// discovery isn't bounded.
+	DiscoveryTimeout time.Duration `yaml:"discovery_timeout"`
+
+	TLS *BackendTLSConfig `yaml:"tls"`
+}
+
+// BackendTLSConfig configures TLS for the connection to the gRPC server.
+type BackendTLSConfig struct {
+	// CAFile is the CA bundle used to verify the server. If empty,
+	// the system roots are used.
+	CAFile string `yaml:"ca_file"`
+
+	// CertFile and KeyFile are the client certificate, if the
+	// server requires one.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// ListenConfig configures the HTTP listener.
+type ListenConfig struct {
+	Address string `yaml:"address"`
+
+	TLS *ListenTLSConfig `yaml:"tls"`
+}
+
+// ListenTLSConfig configures TLS termination (see gateway.TLSConfig).
+type ListenTLSConfig struct {
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+	ClientCAFile      string `yaml:"client_ca_file"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+// PrefixConfig configures the path prefixes of the gateway's routes. Empty
+// prefixes disable the corresponding routes (except for the API).
+type PrefixConfig struct {
+	API      string `yaml:"api"`
+	Admin    string `yaml:"admin"`
+	Describe string `yaml:"describe"`
+	OpenAPI  string `yaml:"openapi"`
+}
+
+// LimitsConfig configures per-client rate limits.
+type LimitsConfig struct {
+	// ClientKey identifies clients: `ip` (default), `subject`,
+	// or `header:<name>`.
+	ClientKey string `yaml:"client_key"`
+
+	Default *RateLimitConfig           `yaml:"default"`
+	Methods map[string]RateLimitConfig `yaml:"methods"`
+}
+
+// RateLimitConfig is a gateway.RateLimit.
+type RateLimitConfig struct {
+	Rate       float64 `yaml:"rate"`
+	Burst      int     `yaml:"burst"`
+	MaxStreams int     `yaml:"max_streams"`
+}
+
+// ExposeConfig controls which methods are exposed. Patterns are matched
+// against `<service>/<method>` using path.Match (i.e. `echo.v1.Echo/*`).
+type ExposeConfig struct {
+	// Include is the set of methods to expose. If empty, all methods
+	// are exposed.
+	Include []string `yaml:"include"`
+
+	// Exclude is the set of methods to not expose, which takes precedence
+	// over Include. By default, the reflection service is excluded.
+	Exclude []string `yaml:"exclude"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Backend: BackendConfig{
+			Address:          "localhost:8080",
+			DiscoveryTimeout: 10 * time.Second,
+		},
+		Listen: ListenConfig{
+			Address: ":8085",
+		},
+		Prefixes: PrefixConfig{
+			API: "/api",
+		},
+		ForwardedHeaders: []string{"Authorization"},
+		Expose: ExposeConfig{
+			Exclude: []string{
+				"grpc.reflection.v1.ServerReflection/*",
+				"grpc.reflection.v1alpha.ServerReflection/*",
+			},
+		},
+	}
+}
+
+// loadConfig reads the YAML configuration file, with any unspecified
+// fields set to their defaults.
+func loadConfig(file string) (Config, error) {
+	config := defaultConfig()
+	if file == "" {
+		return config, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, errors.Wrap(err, "failed to read config")
+	}
+	if err := yaml.UnmarshalStrict(b, &config); err != nil {
+		return config, errors.Wrap(err, "invalid config")
+	}
+	if config.Backend.DiscoveryTimeout < 0 {
+		return config, errors.Errorf("invalid config: negative discovery_timeout %s", config.Backend.DiscoveryTimeout)
+	}
+
+	return config, nil
+}
+
+// exposed filters the services to those that are exposed.
+func (c ExposeConfig) exposed(services gateway.Services) (gateway.Services, error) {
+	for _, p := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %s", p)
+		}
+	}
+
+	exposed := make(gateway.Services)
+	for service, info := range services {
+		var methods []grpc.MethodInfo
+		for _, m := range info.Methods {
+			if c.matches(service + "/" + m.Name) {
+				methods = append(methods, m)
+			}
+		}
+
+		if len(methods) > 0 {
+			info.Methods = methods
+			exposed[service] = info
+		}
+	}
+
+	return exposed, nil
+}
+
+func (c ExposeConfig) matches(fullMethod string) bool {
+	for _, p := range c.Exclude {
+		if ok, _ := path.Match(p, fullMethod); ok {
+			return false
+		}
+	}
+
+	if len(c.Include) == 0 {
+		return true
+	}
+	for _, p := range c.Include {
+		if ok, _ := path.Match(p, fullMethod); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c LimitsConfig) options() ([]gateway.MuxOption, error) {
+	var opts []gateway.MuxOption
+
+	switch {
+	case c.ClientKey == "" || c.ClientKey == "ip":
+	case c.ClientKey == "subject":
+		opts = append(opts, gateway.WithClientKey(gateway.ClientSubject))
+	case strings.HasPrefix(c.ClientKey, "header:"):
+		opts = append(opts, gateway.WithClientKey(gateway.ClientHeader(strings.TrimPrefix(c.ClientKey, "header:"))))
+	default:
+		return nil, errors.Errorf("invalid client key: %s", c.ClientKey)
+	}
+
+	if c.Default != nil {
+		opts = append(opts, gateway.WithRateLimit(c.Default.limit()))
+	}
+	for method, limit := range c.Methods {
+		opts = append(opts, gateway.WithMethodRateLimit(method, limit.limit()))
+	}
+
+	return opts, nil
+}
+
+func (c RateLimitConfig) limit() gateway.RateLimit {
+	return gateway.RateLimit{
+		Rate:       c.Rate,
+		Burst:      c.Burst,
+		MaxStreams: c.MaxStreams,
+	}
+}
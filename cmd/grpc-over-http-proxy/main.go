@@ -0,0 +1,200 @@
+// Command grpc-over-http-proxy runs the gateway as a standalone proxy in
+// front of a gRPC server, which can be implemented in any language.
+//
+// Services are discovered using the server's reflection service, or from
+// a FileDescriptorSet (i.e. generated with `protoc --include_imports
+// --descriptor_set_out`). See Config for the YAML configuration format.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"mfycheng.dev/grpc-over-http/gateway"
+)
+
+var (
+	configFile    = flag.String("config", "", "YAML configuration file")
+	backend       = flag.String("backend", "", "Address of the gRPC server (overrides the config)")
+	listen        = flag.String("listen", "", "Address to serve HTTP on (overrides the config)")
+	descriptorSet = flag.String("descriptor-set", "", "FileDescriptorSet of the services to expose (overrides the config)")
+)
+
+func dial(c BackendConfig) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if c.TLS != nil {
+		tlsConfig := &tls.Config{
+			ServerName:         c.TLS.ServerName,
+			InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+		}
+		if c.TLS.CAFile != "" {
+			pem, err := ioutil.ReadFile(c.TLS.CAFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read backend CA")
+			}
+
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("no backend CAs found")
+			}
+		}
+		if c.TLS.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to load backend client certificate")
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	return grpc.Dial(
+		c.Address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(&gateway.BinaryCodec{})),
+	)
+}
+
+// descriptors loads the configured descriptor set, or discovers the
+// services using reflection.
+func descriptors(ctx context.Context, c BackendConfig, cc *grpc.ClientConn) (*descriptorpb.FileDescriptorSet, error) {
+	if c.DescriptorSet == "" {
+		if c.DiscoveryTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.DiscoveryTimeout)
+			defer cancel()
+		}
+
+		return gateway.ReflectDescriptors(ctx, cc)
+	}
+
+	b, err := ioutil.ReadFile(c.DescriptorSet)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read descriptor set")
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, errors.Wrap(err, "invalid descriptor set")
+	}
+
+	return set, nil
+}
+
+// newMux creates the gateway for the configured backend.
+func newMux(ctx context.Context, config Config) (m *gateway.Mux, err error) {
+	cc, err := dial(config.Backend)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial backend")
+	}
+
+	// The connection is only used by the gateway, so it's closed if the
+	// gateway can't be created (including if gateway.New panics).
+	defer func() {
+		if m == nil {
+			cc.Close()
+		}
+	}()
+
+	set, err := descriptors(ctx, config.Backend, cc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to discover services")
+	}
+
+	services, err := gateway.ServicesFromDescriptors(set)
+	if err != nil {
+		return nil, err
+	}
+	if services, err = config.Expose.exposed(services); err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, errors.New("no services to expose")
+	}
+
+	opts := []gateway.MuxOption{
+		gateway.WithPathPrefix(config.Prefixes.API),
+		gateway.WithDescriptors(set),
+		gateway.WithForwardedHeaders(config.ForwardedHeaders...),
+	}
+	if config.Prefixes.Admin != "" {
+		opts = append(opts, gateway.WithAdminRoutes(config.Prefixes.Admin))
+	}
+	if config.Prefixes.Describe != "" {
+		opts = append(opts, gateway.WithDescriptorRoutes(config.Prefixes.Describe))
+	}
+	if config.Prefixes.OpenAPI != "" {
+		opts = append(opts, gateway.WithOpenAPIRoute(config.Prefixes.OpenAPI, gateway.OpenAPIInfo{
+			Title:   "grpc-over-http",
+			Version: "v1",
+		}))
+	}
+	if config.HealthCheck != nil {
+		opts = append(opts, gateway.WithHealthCheck(*config.HealthCheck))
+	}
+
+	limitOpts, err := config.Limits.options()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, limitOpts...)
+
+	for service, info := range services {
+		log.WithField("service", service).Infof("Exposing %d methods", len(info.Methods))
+	}
+
+	return gateway.New(services, cc, opts...), nil
+}
+
+func run() error {
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if *backend != "" {
+		config.Backend.Address = *backend
+	}
+	if *listen != "" {
+		config.Listen.Address = *listen
+	}
+	if *descriptorSet != "" {
+		config.Backend.DescriptorSet = *descriptorSet
+	}
+
+	m, err := newMux(context.Background(), config)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("addr", config.Listen.Address).Info("Serving")
+	if t := config.Listen.TLS; t != nil {
+		return m.ListenAndServeTLS(config.Listen.Address, gateway.TLSConfig{
+			CertFile:          t.CertFile,
+			KeyFile:           t.KeyFile,
+			ClientCAFile:      t.ClientCAFile,
+			RequireClientCert: t.RequireClientCert,
+		})
+	}
+
+	return m.ListenAndServeHTTP(config.Listen.Address)
+}
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
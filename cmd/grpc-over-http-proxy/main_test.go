@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+	"mfycheng.dev/grpc-over-http/gateway"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultConfig(), config)
+
+	file := writeTemp(t, "config.yaml", []byte(`
+backend:
+  address: backend:9000
+  discovery_timeout: 3s
+  tls:
+    ca_file: ca.pem
+listen:
+  address: :443
+prefixes:
+  admin: /admin
+limits:
+  client_key: header:X-Api-Key
+  default:
+    rate: 10
+    burst: 20
+  methods:
+    echo.v1.Echo/EchoStream:
+      max_streams: 2
+expose:
+  include: ["echo.v1.*/*"]
+`))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	config, err = loadConfig(file)
+	require.NoError(t, err)
+	assert.Equal(t, "backend:9000", config.Backend.Address)
+	assert.Equal(t, 3*time.Second, config.Backend.DiscoveryTimeout)
+	assert.Equal(t, "ca.pem", config.Backend.TLS.CAFile)
+	assert.Equal(t, ":443", config.Listen.Address)
+	assert.Equal(t, "/api", config.Prefixes.API)
+	assert.Equal(t, "/admin", config.Prefixes.Admin)
+	assert.Equal(t, &RateLimitConfig{Rate: 10, Burst: 20}, config.Limits.Default)
+	assert.Equal(t, RateLimitConfig{MaxStreams: 2}, config.Limits.Methods["echo.v1.Echo/EchoStream"])
+	assert.Equal(t, []string{"echo.v1.*/*"}, config.Expose.Include)
+
+	opts, err := config.Limits.options()
+	require.NoError(t, err)
+	assert.Len(t, opts, 3)
+
+	// Unknown fields are rejected.
+	require.NoError(t, ioutil.WriteFile(file, []byte("backend:\n  adress: nope\n"), 0600))
+	_, err = loadConfig(file)
+	assert.Error(t, err)
+
+	// A zero discovery timeout disables the timeout, but negative ones are invalid.
+	require.NoError(t, ioutil.WriteFile(file, []byte("backend:\n  discovery_timeout: 0\n"), 0600))
+	zero, err := loadConfig(file)
+	require.NoError(t, err)
+	assert.Zero(t, zero.Backend.DiscoveryTimeout)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("backend:\n  discovery_timeout: -1s\n"), 0600))
+	_, err = loadConfig(file)
+	assert.Error(t, err)
+
+	config.Limits.ClientKey = "nope"
+	_, err = config.Limits.options()
+	assert.Error(t, err)
+}
+
+func TestExpose(t *testing.T) {
+	services := gateway.Services{
+		"echo.v1.Echo": grpc.ServiceInfo{
+			Methods: []grpc.MethodInfo{{Name: "Echo"}, {Name: "EchoStream", IsServerStream: true}},
+		},
+		"grpc.reflection.v1.ServerReflection": grpc.ServiceInfo{
+			Methods: []grpc.MethodInfo{{Name: "ServerReflectionInfo", IsClientStream: true, IsServerStream: true}},
+		},
+	}
+
+	exposed, err := defaultConfig().Expose.exposed(services)
+	require.NoError(t, err)
+	assert.Len(t, exposed, 1)
+	assert.Len(t, exposed["echo.v1.Echo"].Methods, 2)
+
+	exposed, err = ExposeConfig{Include: []string{"echo.v1.Echo/*"}, Exclude: []string{"*/EchoStream"}}.exposed(services)
+	require.NoError(t, err)
+	assert.Equal(t, []grpc.MethodInfo{{Name: "Echo"}}, exposed["echo.v1.Echo"].Methods)
+
+	exposed, err = ExposeConfig{Include: []string{"nope.*/*"}}.exposed(services)
+	require.NoError(t, err)
+	assert.Empty(t, exposed)
+
+	_, err = ExposeConfig{Include: []string{"["}}.exposed(services)
+	assert.Error(t, err)
+}
+
+func TestProxy_Reflection(t *testing.T) {
+	addr, cleanup := setupBackend(t)
+	defer cleanup()
+
+	config := defaultConfig()
+	config.Backend.Address = addr
+	config.Backend.DiscoveryTimeout = 0 // unbounded
+	config.Prefixes.Describe = "/describe"
+
+	url, cleanup := setupProxy(t, config)
+	defer cleanup()
+
+	assertEcho(t, url+"/api/echo.v1.Echo/Echo")
+
+	// The reflection service is not exposed by default.
+	resp, err := http.Post(url+"/api/grpc.reflection.v1.ServerReflection/ServerReflectionInfo", "application/proto", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(url + "/describe/services")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(b), `"echo.v1.Echo"`)
+	assert.NotContains(t, string(b), "ServerReflection")
+}
+
+func TestProxy_DescriptorSet(t *testing.T) {
+	addr, cleanup := setupBackend(t)
+	defer cleanup()
+
+	// Use the descriptors from a proxy that discovered them with reflection.
+	config := defaultConfig()
+	config.Backend.Address = addr
+	m, err := newMux(context.Background(), config)
+	require.NoError(t, err)
+	set, err := m.Descriptors(context.Background())
+	require.NoError(t, err)
+	b, err := proto.Marshal(set)
+	require.NoError(t, err)
+
+	file := writeTemp(t, "echo.protoset", b)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	config.Backend.DescriptorSet = file
+	config.Prefixes.API = "/v1"
+	config.Prefixes.Admin = "/admin"
+
+	url, cleanup := setupProxy(t, config)
+	defer cleanup()
+
+	assertEcho(t, url+"/v1/echo.v1.Echo/Echo")
+
+	resp, err := http.Get(url + "/admin/routes")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "/v1/echo.v1.Echo/EchoStream")
+
+	config.Expose.Include = []string{"nope.v1.*/*"}
+	_, err = newMux(context.Background(), config)
+	assert.Error(t, err)
+}
+
+func assertEcho(t *testing.T, url string) {
+	b, err := proto.Marshal(&echo.EchoRequest{Message: "hi", Repetitions: 2})
+	require.NoError(t, err)
+
+	resp, err := http.Post(url, "application/proto", bytes.NewReader(b))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	b, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var echoResp echo.EchoResponse
+	require.NoError(t, proto.Unmarshal(b, &echoResp))
+	assert.Equal(t, "hihi", echoResp.Message)
+}
+
+func writeTemp(t *testing.T, name string, b []byte) string {
+	dir, err := ioutil.TempDir("", "grpc-over-http-proxy")
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(file, b, 0600))
+	return file
+}
+
+type serv struct{}
+
+func (s serv) Echo(_ context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return &echo.EchoResponse{
+		Message: strings.Repeat(req.Message, int(req.Repetitions)),
+	}, nil
+}
+
+func (s serv) EchoStream(req *echo.EchoStreamRequest, stream echo.Echo_EchoStreamServer) error {
+	return nil
+}
+
+func setupBackend(t *testing.T) (addr string, cleanup func()) {
+	s := grpc.NewServer()
+	echo.RegisterEchoServer(s, &serv{})
+	reflection.Register(s)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = s.Serve(l)
+	}()
+
+	return l.Addr().String(), s.Stop
+}
+
+func setupProxy(t *testing.T, config Config) (url string, cleanup func()) {
+	m, err := newMux(context.Background(), config)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = m.ServeHTTP(l)
+	}()
+
+	return fmt.Sprintf("http://%s", l.Addr()), func() {
+		l.Close()
+	}
+}
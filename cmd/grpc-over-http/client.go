@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"mfycheng.dev/grpc-over-http/gateway"
+)
+
+type client struct {
+	baseURL string
+	opts    options
+	header  http.Header
+
+	stdin  io.Reader
+	stdout io.Writer
+
+	files *protoregistry.Files
+	types *dynamicpb.Types
+}
+
+func newClient(baseURL string, opts options, stdin io.Reader, stdout io.Writer) (*client, error) {
+	header := http.Header{}
+	for _, h := range opts.headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid header: %s", h)
+		}
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	return &client{
+		baseURL: baseURL,
+		opts:    opts,
+		header:  header,
+		stdin:   stdin,
+		stdout:  stdout,
+	}, nil
+}
+
+func (c *client) local() bool {
+	return len(c.opts.protosets) > 0 || len(c.opts.protos) > 0
+}
+
+// list prints the services (or the methods of the specified service).
+func (c *client) list(service string) error {
+	var services []gateway.ServiceDescription
+	if c.local() {
+		if err := c.loadDescriptors(); err != nil {
+			return err
+		}
+		services = describeFiles(c.files)
+	} else {
+		var desc gateway.Description
+		if err := c.getJSON(c.opts.describePrefix+"/services", &desc); err != nil {
+			return err
+		}
+		services = desc.Services
+	}
+
+	for _, s := range services {
+		if service == "" {
+			fmt.Fprintln(c.stdout, s.Name)
+			continue
+		}
+		if s.Name != service {
+			continue
+		}
+
+		for _, m := range s.Methods {
+			fmt.Fprintf(c.stdout, "%s.%s\n", s.Name, m.Name)
+		}
+		return nil
+	}
+
+	if service != "" {
+		return errors.Errorf("service not found: %s", service)
+	}
+	return nil
+}
+
+// call invokes the specified method (i.e. `echo.v1.Echo/Echo`).
+func (c *client) call(method string) error {
+	if err := c.loadDescriptors(); err != nil {
+		return err
+	}
+
+	md, err := c.method(method)
+	if err != nil {
+		return err
+	}
+
+	fullMethod := fmt.Sprintf("%s/%s", md.Parent().FullName(), md.Name())
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return c.stream(fullMethod, md)
+	}
+
+	return c.unary(fullMethod, md)
+}
+
+func (c *client) unary(fullMethod string, md protoreflect.MethodDescriptor) error {
+	data := c.opts.data
+	if data == "@" {
+		b, err := ioutil.ReadAll(c.stdin)
+		if err != nil {
+			return errors.Wrap(err, "failed to read stdin")
+		}
+		data = string(b)
+	}
+
+	reqBytes, err := c.marshal(md.Input(), data)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+c.opts.apiPrefix+"/"+fullMethod, bytes.NewReader(reqBytes))
+	if err != nil {
+		return err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/proto")
+
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send request")
+	}
+	defer httpResp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response")
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return status.Error(codeFromHTTPStatus(httpResp.StatusCode), strings.TrimSpace(string(respBytes)))
+	}
+
+	return c.print(md.Output(), respBytes)
+}
+
+func (c *client) stream(fullMethod string, md protoreflect.MethodDescriptor) error {
+	url := "ws" + strings.TrimPrefix(c.baseURL, "http") + c.opts.apiPrefix + "/" + fullMethod
+	ws, httpResp, err := websocket.DefaultDialer.Dial(url, c.header)
+	if err != nil {
+		if httpResp != nil && httpResp.StatusCode != http.StatusSwitchingProtocols {
+			return status.Errorf(codeFromHTTPStatus(httpResp.StatusCode), "failed to open stream: %s", httpResp.Status)
+		}
+		return errors.Wrap(err, "failed to open stream")
+	}
+	defer ws.Close()
+
+	input := c.stdin
+	if c.opts.data != "" && c.opts.data != "@" {
+		input = strings.NewReader(c.opts.data)
+	}
+
+	// Since there's no way to half-close the stream, we keep reading
+	// until the gateway closes the stream, even after the input ends.
+	sendErrCh := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(input)
+		scanner.Buffer(nil, 64<<20)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			b, err := c.marshal(md.Input(), line)
+			if err == nil {
+				err = errors.Wrap(ws.WriteMessage(websocket.BinaryMessage, b), "failed to send message")
+			}
+			if err != nil {
+				// Closing the connection unblocks the read loop below.
+				sendErrCh <- err
+				ws.Close()
+				return
+			}
+		}
+		sendErrCh <- scanner.Err()
+	}()
+
+	for {
+		_, b, err := ws.ReadMessage()
+		if err != nil {
+			select {
+			case sendErr := <-sendErrCh:
+				if sendErr != nil {
+					return sendErr
+				}
+			default:
+			}
+
+			return closeStatus(err)
+		}
+
+		if err := c.print(md.Output(), b); err != nil {
+			return err
+		}
+	}
+}
+
+// closeStatus converts a websocket close error into a gRPC status,
+// where the 4000-4999 range of close codes contain the gRPC code.
+func closeStatus(err error) error {
+	ce, ok := err.(*websocket.CloseError)
+	if !ok {
+		return errors.Wrap(err, "failed to read message")
+	}
+
+	switch {
+	case ce.Code == websocket.CloseNormalClosure:
+		return nil
+	case ce.Code >= 4000 && ce.Code < 5000:
+		return status.Error(codes.Code(ce.Code-4000), ce.Text)
+	default:
+		return status.Errorf(codes.Unknown, "stream closed (%d): %s", ce.Code, ce.Text)
+	}
+}
+
+func (c *client) marshal(md protoreflect.MessageDescriptor, data string) ([]byte, error) {
+	if strings.TrimSpace(data) == "" {
+		data = "{}"
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	if err := (protojson.UnmarshalOptions{Resolver: c.types}).Unmarshal([]byte(data), msg); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", md.FullName())
+	}
+
+	return protov2.Marshal(msg)
+}
+
+func (c *client) print(md protoreflect.MessageDescriptor, b []byte) error {
+	msg := dynamicpb.NewMessage(md)
+	if err := protov2.Unmarshal(b, msg); err != nil {
+		return errors.Wrapf(err, "invalid %s", md.FullName())
+	}
+
+	out, err := protojson.MarshalOptions{Multiline: true, Indent: "  ", Resolver: c.types}.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(c.stdout, string(out))
+	return err
+}
+
+func (c *client) method(name string) (protoreflect.MethodDescriptor, error) {
+	// Accept both `pkg.Service/Method` and `pkg.Service.Method`.
+	name = strings.TrimPrefix(name, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[:i] + "." + name[i+1:]
+	}
+
+	d, err := c.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, errors.Errorf("method not found: %s", name)
+	}
+
+	md, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, errors.Errorf("not a method: %s", name)
+	}
+
+	return md, nil
+}
+
+func (c *client) loadDescriptors() error {
+	set := &descriptorpb.FileDescriptorSet{}
+
+	switch {
+	case c.local():
+		for _, f := range c.opts.protosets {
+			if err := readDescriptorSet(f, set); err != nil {
+				return err
+			}
+		}
+		if len(c.opts.protos) > 0 {
+			if err := compileProtos(c.opts.protos, c.opts.importPaths, set); err != nil {
+				return err
+			}
+		}
+	default:
+		b, err := c.get(c.opts.describePrefix+"/descriptors", "application/proto")
+		if err != nil {
+			return err
+		}
+		if err := proto.Unmarshal(b, set); err != nil {
+			return errors.Wrap(err, "invalid descriptors")
+		}
+	}
+
+	files, err := protodesc.FileOptions{AllowUnresolvable: true}.NewFiles(dedupeFiles(set))
+	if err != nil {
+		return errors.Wrap(err, "invalid descriptors")
+	}
+
+	c.files = files
+	c.types = dynamicpb.NewTypes(files)
+	return nil
+}
+
+func (c *client) get(path, accept string) ([]byte, error) {
+	req, err := http.NewRequest("GET", c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", accept)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", path)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to get %s: %s", path, resp.Status)
+	}
+
+	return b, nil
+}
+
+func (c *client) getJSON(path string, v interface{}) error {
+	b, err := c.get(path, "application/json")
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func readDescriptorSet(name string, set *descriptorpb.FileDescriptorSet) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", name)
+	}
+
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, fds); err != nil {
+		return errors.Wrapf(err, "invalid descriptor set %s", name)
+	}
+
+	set.File = append(set.File, fds.File...)
+	return nil
+}
+
+// compileProtos compiles the .proto files into a descriptor set using protoc.
+func compileProtos(protos, importPaths []string, set *descriptorpb.FileDescriptorSet) error {
+	dir, err := ioutil.TempDir("", "grpc-over-http")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "descriptors.pb")
+	args := []string{"--include_imports", "--descriptor_set_out=" + out}
+	for _, p := range importPaths {
+		args = append(args, "--proto_path="+p)
+	}
+	args = append(args, protos...)
+
+	cmd := exec.Command("protoc", args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "failed to compile protos")
+	}
+
+	return readDescriptorSet(out, set)
+}
+
+func dedupeFiles(set *descriptorpb.FileDescriptorSet) *descriptorpb.FileDescriptorSet {
+	seen := make(map[string]bool)
+	deduped := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range set.File {
+		if !seen[fd.GetName()] {
+			seen[fd.GetName()] = true
+			deduped.File = append(deduped.File, fd)
+		}
+	}
+
+	return deduped
+}
+
+func describeFiles(files *protoregistry.Files) []gateway.ServiceDescription {
+	var services []gateway.ServiceDescription
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			sd := fd.Services().Get(i)
+
+			s := gateway.ServiceDescription{Name: string(sd.FullName()), File: fd.Path()}
+			for j := 0; j < sd.Methods().Len(); j++ {
+				s.Methods = append(s.Methods, gateway.MethodDescription{Name: string(sd.Methods().Get(j).Name())})
+			}
+			services = append(services, s)
+		}
+		return true
+	})
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	return services
+}
@@ -0,0 +1,100 @@
+// Command grpc-over-http calls methods through a grpc-over-http gateway.
+//
+// Usage:
+//
+//	grpc-over-http [flags] <url> list [service]
+//	grpc-over-http [flags] <url> <service>/<Method>
+//
+// Requests are read as JSON from -d, or from stdin if -d is '@'. Streaming
+// methods read newline-delimited JSON messages from stdin (unless -d is set),
+// and print each response as it's received.
+//
+// Method descriptors are resolved from the gateway's description routes (see
+// gateway.WithDescriptorRoutes), or from local descriptor sets (-protoset) or
+// .proto files (-proto, which requires protoc).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/status"
+)
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+type options struct {
+	data           string
+	headers        stringsFlag
+	protosets      stringsFlag
+	protos         stringsFlag
+	importPaths    stringsFlag
+	apiPrefix      string
+	describePrefix string
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	var opts options
+
+	fs := flag.NewFlagSet("grpc-over-http", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  %s [flags] <url> list [service]\n  %s [flags] <url> <service>/<Method>\n\nFlags:\n", fs.Name(), fs.Name())
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.data, "d", "", "JSON request body, or '@' to read from stdin")
+	fs.Var(&opts.headers, "H", "Header to send, in the form 'Name: value' (repeatable)")
+	fs.Var(&opts.protosets, "protoset", "FileDescriptorSet file to resolve methods from (repeatable)")
+	fs.Var(&opts.protos, "proto", ".proto file to resolve methods from, compiled with protoc (repeatable)")
+	fs.Var(&opts.importPaths, "import-path", "Import path for -proto files (repeatable)")
+	fs.StringVar(&opts.apiPrefix, "api-prefix", "/api", "Path prefix of the gateway's method routes")
+	fs.StringVar(&opts.describePrefix, "describe-prefix", "/describe", "Path prefix of the gateway's description routes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("missing arguments")
+	}
+
+	c, err := newClient(strings.TrimSuffix(fs.Arg(0), "/"), opts, stdin, stdout)
+	if err != nil {
+		return err
+	}
+
+	if fs.Arg(1) == "list" {
+		return c.list(fs.Arg(2))
+	}
+
+	return c.call(fs.Arg(1))
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	if err == nil {
+		return
+	}
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+
+	if s, ok := status.FromError(err); ok {
+		fmt.Fprintf(os.Stderr, "ERROR:\n  Code: %s\n  Message: %s\n", s.Code(), s.Message())
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+	"mfycheng.dev/grpc-over-http/gateway"
+)
+
+func TestList(t *testing.T) {
+	url, _, cleanup := setup(t)
+	defer cleanup()
+
+	out, err := runCLI(t, "", url, "list")
+	require.NoError(t, err)
+	assert.Equal(t, "echo.v1.Echo\n", out)
+
+	out, err = runCLI(t, "", url, "list", "echo.v1.Echo")
+	require.NoError(t, err)
+	assert.Equal(t, "echo.v1.Echo.Echo\necho.v1.Echo.EchoStream\n", out)
+
+	_, err = runCLI(t, "", url, "list", "echo.v1.Nope")
+	assert.Error(t, err)
+}
+
+func TestUnary(t *testing.T) {
+	url, _, cleanup := setup(t)
+	defer cleanup()
+
+	out, err := runCLI(t, "", "-d", `{"message": "hi", "repetitions": 3}`, url, "echo.v1.Echo/Echo")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"message": "hihihi"}`, out)
+
+	out, err = runCLI(t, `{"message": "yo", "repetitions": 2}`, "-d", "@", url, "echo.v1.Echo.Echo")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"message": "yoyo"}`, out)
+
+	_, err = runCLI(t, "", "-d", `{"statusCode": 5}`, url, "echo.v1.Echo/Echo")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = runCLI(t, "", "-d", `{"nope": 1}`, url, "echo.v1.Echo/Echo")
+	assert.Error(t, err)
+}
+
+func TestStream(t *testing.T) {
+	url, _, cleanup := setup(t)
+	defer cleanup()
+
+	out, err := runCLI(t, `{"message": "hi", "repetitions": 2, "responses": 2, "interval": "0.01s"}`+"\n", url, "echo.v1.Echo/EchoStream")
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(out, `"hihi"`))
+
+	_, err = runCLI(t, "", "-d", `{"message": "hi", "responses": 2, "interval": "0.01s", "statusCode": 7, "failureIndex": 1}`, url, "echo.v1.Echo/EchoStream")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, "induced", status.Convert(err).Message())
+}
+
+func TestProtoset(t *testing.T) {
+	url, m, cleanup := setup(t)
+	defer cleanup()
+
+	set, err := m.Descriptors(context.Background())
+	require.NoError(t, err)
+	b, err := proto.Marshal(set)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "grpc-over-http")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	protoset := filepath.Join(dir, "echo.protoset")
+	require.NoError(t, ioutil.WriteFile(protoset, b, 0600))
+
+	out, err := runCLI(t, "", "-protoset", protoset, url, "list")
+	require.NoError(t, err)
+	assert.Equal(t, "echo.v1.Echo\n", out)
+
+	// The description routes are not needed when using a protoset.
+	out, err = runCLI(t, "", "-protoset", protoset, "-describe-prefix", "/nope", "-d", `{"message": "a", "repetitions": 1}`, url, "echo.v1.Echo/Echo")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"message": "a"}`, out)
+}
+
+func TestCodeFromHTTPStatus(t *testing.T) {
+	for _, c := range []codes.Code{
+		codes.OK,
+		codes.Canceled,
+		codes.InvalidArgument,
+		codes.DeadlineExceeded,
+		codes.NotFound,
+		codes.PermissionDenied,
+		codes.Unauthenticated,
+		codes.ResourceExhausted,
+		codes.Unimplemented,
+		codes.Unavailable,
+		codes.Internal,
+	} {
+		assert.Equal(t, c, codeFromHTTPStatus(runtime.HTTPStatusFromCode(c)))
+	}
+}
+
+func runCLI(t *testing.T, stdin string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	err := run(args, strings.NewReader(stdin), &stdout)
+	return stdout.String(), err
+}
+
+type serv struct{}
+
+func (s serv) Echo(_ context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	if req.StatusCode != 0 {
+		return nil, status.Error(codes.Code(req.StatusCode), "induced")
+	}
+
+	return &echo.EchoResponse{
+		Message: strings.Repeat(req.Message, int(req.Repetitions)),
+	}, nil
+}
+
+func (s serv) EchoStream(req *echo.EchoStreamRequest, stream echo.Echo_EchoStreamServer) error {
+	for i := 0; i < int(req.Responses); i++ {
+		if req.StatusCode != 0 && int(req.FailureIndex) == i {
+			return status.Error(codes.Code(req.StatusCode), "induced")
+		}
+
+		err := stream.Send(&echo.EchoStreamResponse{
+			Message: strings.Repeat(req.Message, int(req.Repetitions)),
+			Index:   uint64(i),
+		})
+		if err == io.EOF {
+			return nil
+		}
+
+		time.Sleep(time.Duration(req.Interval.GetNanos()))
+	}
+
+	return nil
+}
+
+func setup(t *testing.T) (url string, m *gateway.Mux, cleanup func()) {
+	s := grpc.NewServer()
+	echo.RegisterEchoServer(s, &serv{})
+
+	gl, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	cc, err := grpc.Dial(
+		gl.Addr().String(),
+		grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(&gateway.BinaryCodec{})),
+	)
+	require.NoError(t, err)
+
+	m = gateway.New(s, cc, gateway.WithDescriptorRoutes("describe"))
+
+	hl, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = s.Serve(gl)
+	}()
+	go func() {
+		_ = m.ServeHTTP(hl)
+	}()
+
+	return fmt.Sprintf("http://%s", hl.Addr()), m, func() {
+		hl.Close()
+		s.Stop()
+		gl.Close()
+	}
+}
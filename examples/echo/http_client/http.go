@@ -88,8 +88,6 @@ func run() error {
 
 		fmt.Println(resp)
 	}
-
-	return nil
 }
 
 func main() {
@@ -72,7 +72,7 @@ func run() error {
 		grpc.WithDefaultCallOptions(grpc.ForceCodec(&gateway.BinaryCodec{})),
 	)
 
-	m := gateway.New(s, cc)
+	m := gateway.New(s, cc, gateway.WithDescriptorRoutes("describe"))
 
 	go func() {
 		log.Fatal(m.ListenAndServeHTTP(":8085"))
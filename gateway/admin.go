@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	defaultReadyTimeout = time.Second
+)
+
+// Route describes a method exposed by the gateway.
+type Route struct {
+	Path   string `json:"path"`
+	Method string `json:"method"`
+
+	// Streaming routes are served over websockets.
+	Streaming     bool `json:"streaming"`
+	ClientStreams bool `json:"client_streams"`
+	ServerStreams bool `json:"server_streams"`
+}
+
+// ReadyStatus is the body returned by the readiness endpoint.
+type ReadyStatus struct {
+	Ready  bool   `json:"ready"`
+	State  string `json:"state,omitempty"`
+	Health string `json:"health,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Services are the services provided by the backend, which are only
+	// set for each of the Backends.
+	Services []string `json:"services,omitempty"`
+
+	// Backends contains the status of each backend if the gateway has
+	// multiple backends (see WithBackend), in which case the gateway is
+	// only ready if all of its backends are.
+	Backends []ReadyStatus `json:"backends,omitempty"`
+}
+
+// WithAdminRoutes registers the admin routes under the specified prefix
+// (i.e. `/admin`):
+//
+//	<prefix>/healthz:  liveness, which always returns a 200.
+//	<prefix>/readyz:   readiness, which returns a 200 if the connection to the
+//	                   gRPC server is ready (see WithHealthCheck), or 503 otherwise.
+//	<prefix>/routes:   a JSON list of the routes served by the gateway.
+//	<prefix>/cache:    the response cache's metrics, if enabled (see WithCachedMethod).
+//	<prefix>/retries:  the retry metrics, if enabled (see WithRetryPolicy).
+//	<prefix>/breakers: the state of each circuit breaker, if enabled (see WithCircuitBreaker).
+func WithAdminRoutes(prefix string) MuxOption {
+	return func(m *Mux) {
+		m.adminPrefix = path.Join("/", prefix)
+	}
+}
+
+// WithHealthCheck additionally checks the status of the specified service using
+// the standard grpc.health.v1 service when serving readiness requests. An
+// empty service name checks the overall health of the server.
+//
+// If there are multiple backends, the service is checked with the backend that
+// provides it, or with every backend if none do.
+func WithHealthCheck(service string) MuxOption {
+	return func(m *Mux) {
+		m.healthService = &service
+	}
+}
+
+// Routes returns the routes served by the gateway.
+func (m *Mux) Routes() []Route {
+	return m.routes
+}
+
+func (m *Mux) registerAdminRoutes() {
+	if m.adminPrefix == "" {
+		return
+	}
+
+	m.router.HandleFunc(path.Join(m.adminPrefix, "healthz"), func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("ok"))
+	})
+	m.router.HandleFunc(path.Join(m.adminPrefix, "readyz"), func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), defaultReadyTimeout)
+		defer cancel()
+
+		s := m.ready(ctx)
+
+		code := http.StatusOK
+		if !s.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, s)
+	})
+	m.router.HandleFunc(path.Join(m.adminPrefix, "routes"), func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, m.routes)
+	})
+	if m.responseCache != nil {
+		m.router.HandleFunc(path.Join(m.adminPrefix, "cache"), func(w http.ResponseWriter, _ *http.Request) {
+			stats := m.CacheStats()
+			writeJSON(w, http.StatusOK, struct {
+				CacheStats
+				HitRatio float64 `json:"hit_ratio"`
+			}{stats, stats.HitRatio()})
+		})
+	}
+	if m.retriesEnabled() {
+		m.router.HandleFunc(path.Join(m.adminPrefix, "retries"), func(w http.ResponseWriter, _ *http.Request) {
+			writeJSON(w, http.StatusOK, m.RetryStats())
+		})
+	}
+	if len(m.breakers) > 0 {
+		m.router.HandleFunc(path.Join(m.adminPrefix, "breakers"), func(w http.ResponseWriter, _ *http.Request) {
+			writeJSON(w, http.StatusOK, m.CircuitBreakerStats())
+		})
+	}
+}
+
+func (m *Mux) ready(ctx context.Context) ReadyStatus {
+	if len(m.backends) == 1 {
+		return m.backendReady(ctx, m.backends[0])
+	}
+
+	// Backends are checked concurrently, so that an unavailable backend
+	// doesn't consume the timeout of the others.
+	statuses := make([]ReadyStatus, len(m.backends))
+	var wg sync.WaitGroup
+	for i, b := range m.backends {
+		wg.Add(1)
+		go func(i int, b *backend) {
+			defer wg.Done()
+
+			statuses[i] = m.backendReady(ctx, b)
+			for service := range b.serv.GetServiceInfo() {
+				statuses[i].Services = append(statuses[i].Services, service)
+			}
+			sort.Strings(statuses[i].Services)
+		}(i, b)
+	}
+	wg.Wait()
+
+	s := ReadyStatus{Ready: true, Backends: statuses}
+	for _, b := range statuses {
+		s.Ready = s.Ready && b.Ready
+	}
+
+	return s
+}
+
+func (m *Mux) backendReady(ctx context.Context, b *backend) ReadyStatus {
+	s := ReadyStatus{Ready: true}
+
+	// Connections that don't report their state are assumed to be ready.
+	if cc, ok := b.cc.(stateConn); ok {
+		state := cc.GetState()
+
+		// Connections are lazily established, so we trigger one rather than
+		// reporting an idle connection as unavailable forever.
+		if state == connectivity.Idle {
+			cc.Connect()
+		}
+		for state != connectivity.Ready && cc.WaitForStateChange(ctx, state) {
+			state = cc.GetState()
+		}
+
+		s.Ready = state == connectivity.Ready
+		s.State = state.String()
+	}
+	if !s.Ready || m.healthService == nil {
+		return s
+	}
+
+	if provider, ok := m.serviceBackends[*m.healthService]; ok && provider != b {
+		return s
+	}
+
+	health, err := checkHealth(ctx, b.cc, *m.healthService)
+	if err != nil {
+		s.Ready = false
+		s.Error = err.Error()
+		return s
+	}
+
+	s.Health = health.String()
+	s.Ready = health == healthpb.HealthCheckResponse_SERVING
+	return s
+}
+
+func checkHealth(ctx context.Context, cc grpc.ClientConnInterface, service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	// The gateway's connection uses the BinaryCodec, so we have to handle
+	// the (un)marshaling ourselves.
+	b, err := proto.Marshal(&healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+
+	resp := new([]byte)
+	if err := cc.Invoke(ctx, "/grpc.health.v1.Health/Check", b, resp); err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+
+	var health healthpb.HealthCheckResponse
+	if err := proto.Unmarshal(*resp, &health); err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+
+	return health.Status, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
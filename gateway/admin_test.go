@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestAdmin_Liveness(t *testing.T) {
+	addr, cleanup := setup(t, WithAdminRoutes("admin"))
+	defer cleanup()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/admin/healthz", addr))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestAdmin_Readiness(t *testing.T) {
+	hs := health.NewServer()
+	addr, cleanup := setupWithRegister(t, func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, &serv{})
+		healthpb.RegisterHealthServer(s, hs)
+	}, WithAdminRoutes("/admin"), WithHealthCheck("echo.v1.Echo"))
+	defer cleanup()
+
+	hs.SetServingStatus("echo.v1.Echo", healthpb.HealthCheckResponse_SERVING)
+	code, s := getReady(t, addr)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, ReadyStatus{Ready: true, State: "READY", Health: "SERVING"}, s)
+
+	hs.SetServingStatus("echo.v1.Echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	code, s = getReady(t, addr)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, ReadyStatus{Ready: false, State: "READY", Health: "NOT_SERVING"}, s)
+}
+
+func TestAdmin_ReadinessUnavailable(t *testing.T) {
+	m, cleanupMux := setupMux(t, func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, &serv{})
+	}, WithAdminRoutes("admin"))
+
+	// Without a server, the connection can never become ready.
+	cleanupMux()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	s := m.ready(ctx)
+	assert.False(t, s.Ready)
+	assert.NotEqual(t, "READY", s.State)
+}
+
+func TestAdmin_Routes(t *testing.T) {
+	addr, cleanup := setup(t, WithAdminRoutes("admin"))
+	defer cleanup()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/admin/routes", addr))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var routes []Route
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&routes))
+	assert.Equal(t, []Route{
+		{
+			Path:   "/api/echo.v1.Echo/Echo",
+			Method: "echo.v1.Echo/Echo",
+		},
+		{
+			Path:          "/api/echo.v1.Echo/EchoStream",
+			Method:        "echo.v1.Echo/EchoStream",
+			Streaming:     true,
+			ServerStreams: true,
+		},
+	}, routes)
+}
+
+func getReady(t *testing.T, addr string) (int, ReadyStatus) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/admin/readyz", addr))
+	require.NoError(t, err)
+
+	var s ReadyStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+	return resp.StatusCode, s
+}
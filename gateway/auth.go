@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type authSource int
+
+const (
+	// defaultAuthTimeout is the time allowed for the first message, if it
+	// contains the credentials, so unauthenticated connections can't hold
+	// streams open indefinitely.
+	defaultAuthTimeout = 10 * time.Second
+)
+
+const (
+	authSourceQuery authSource = iota
+	authSourceSubprotocol
+	authSourceCookie
+	authSourceFirstMessage
+)
+
+// StreamAuth describes where a streaming client supplies its credentials.
+//
+// Browsers are unable to set an Authorization header on websocket upgrades,
+// so credentials have to be supplied elsewhere in the request. Any credential
+// that is found is forwarded to the gRPC server as `authorization: Bearer <token>`,
+// exactly as if it had been set in the Authorization header.
+type StreamAuth struct {
+	source  authSource
+	name    string
+	timeout time.Duration
+}
+
+// AuthFromQuery reads the token from the specified query parameter.
+func AuthFromQuery(param string) StreamAuth {
+	return StreamAuth{source: authSourceQuery, name: param}
+}
+
+// AuthFromSubprotocol reads the token from a Sec-WebSocket-Protocol entry
+// with the specified prefix (i.e. `bearer.<token>`).
+//
+// Since the server must select one of the offered subprotocols, clients should
+// offer an additional (non-credential) subprotocol. If the upgrader doesn't have
+// any Subprotocols configured, the first non-credential subprotocol is selected.
+func AuthFromSubprotocol(prefix string) StreamAuth {
+	return StreamAuth{source: authSourceSubprotocol, name: prefix}
+}
+
+// AuthFromCookie reads the token from the specified cookie.
+func AuthFromCookie(name string) StreamAuth {
+	return StreamAuth{source: authSourceCookie, name: name}
+}
+
+// AuthFromFirstMessage reads the token from the first websocket message, which
+// is consumed by the gateway rather than being forwarded. Connections that don't
+// send the message within the timeout (by default, 10 seconds) are closed with
+// Unauthenticated.
+//
+// Since the stream can't be opened until the message is received, this strategy
+// is only used if none of the other strategies yield a token.
+func AuthFromFirstMessage(timeout time.Duration) StreamAuth {
+	if timeout <= 0 {
+		timeout = defaultAuthTimeout
+	}
+
+	return StreamAuth{source: authSourceFirstMessage, timeout: timeout}
+}
+
+// WithStreamAuth sets the strategies used to authenticate streaming requests.
+// Strategies are tried in order, and the first token found is used. Requests
+// that already have an Authorization header are left untouched.
+func WithStreamAuth(strategies ...StreamAuth) MuxOption {
+	return func(m *Mux) {
+		m.streamAuth = strategies
+	}
+}
+
+// streamCredentials applies the strategies that can be resolved before the
+// websocket upgrade. It returns the headers to forward, the headers to add
+// to the upgrade response, and whether or not the token has to be read from
+// the first message.
+func (m *Mux) streamCredentials(req *http.Request) (header, respHeader http.Header, firstMessage *StreamAuth) {
+	header = req.Header
+	if len(m.streamAuth) == 0 || header.Get("Authorization") != "" {
+		return header, nil, nil
+	}
+
+	for i, s := range m.streamAuth {
+		var token string
+		switch s.source {
+		case authSourceQuery:
+			token = req.URL.Query().Get(s.name)
+		case authSourceCookie:
+			if c, err := req.Cookie(s.name); err == nil {
+				token = c.Value
+			}
+		case authSourceSubprotocol:
+			var selected string
+			for _, p := range websocket.Subprotocols(req) {
+				if strings.HasPrefix(p, s.name) {
+					if token == "" {
+						token = strings.TrimPrefix(p, s.name)
+					}
+				} else if selected == "" {
+					selected = p
+				}
+			}
+			if token != "" && selected != "" && len(m.upgrader.Subprotocols) == 0 {
+				respHeader = http.Header{}
+				respHeader.Set("Sec-WebSocket-Protocol", selected)
+			}
+		case authSourceFirstMessage:
+			if firstMessage == nil {
+				firstMessage = &m.streamAuth[i]
+			}
+		}
+
+		if token != "" {
+			return withBearer(header, token), respHeader, nil
+		}
+	}
+
+	return header, respHeader, firstMessage
+}
+
+// readAuthMessage reads the token from the first websocket message.
+func readAuthMessage(ws *websocket.Conn, s *StreamAuth) (string, error) {
+	if err := ws.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+		return "", err
+	}
+	defer ws.SetReadDeadline(time.Time{})
+
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func withBearer(header http.Header, token string) http.Header {
+	header = header.Clone()
+	header.Set("Authorization", "Bearer "+token)
+	return header
+}
@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestAuth_UnaryHeader(t *testing.T) {
+	addr, cleanup := setupWithServer(t, &mdServ{})
+	defer cleanup()
+
+	b, err := proto.Marshal(&echo.EchoRequest{})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr), bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set("Content-type", "application/proto")
+	req.Header.Set("Authorization", "Bearer header-token")
+
+	httpResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, httpResp.StatusCode)
+
+	respBytes, err := ioutil.ReadAll(httpResp.Body)
+	require.NoError(t, err)
+
+	resp := &echo.EchoResponse{}
+	require.NoError(t, proto.Unmarshal(respBytes, resp))
+	assert.Equal(t, "Bearer header-token", resp.Message)
+}
+
+func TestAuth_Strategies(t *testing.T) {
+	addr, cleanup := setupWithServer(
+		t,
+		&mdServ{},
+		WithStreamAuth(
+			AuthFromQuery("access_token"),
+			AuthFromCookie("session"),
+			AuthFromSubprotocol("bearer."),
+		),
+	)
+	defer cleanup()
+
+	url := fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr)
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		header http.Header
+		token  string
+	}{
+		{
+			name:  "query",
+			url:   url + "?access_token=query-token",
+			token: "Bearer query-token",
+		},
+		{
+			name:   "cookie",
+			url:    url,
+			header: http.Header{"Cookie": []string{"session=cookie-token"}},
+			token:  "Bearer cookie-token",
+		},
+		{
+			name:   "subprotocol",
+			url:    url,
+			header: http.Header{"Sec-WebSocket-Protocol": []string{"bearer.proto-token, grpc"}},
+			token:  "Bearer proto-token",
+		},
+		{
+			name:   "header precedence",
+			url:    url + "?access_token=query-token",
+			header: http.Header{"Authorization": []string{"Bearer header-token"}},
+			token:  "Bearer header-token",
+		},
+		{
+			name: "none",
+			url:  url,
+		},
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(tc.url, tc.header)
+		require.NoError(t, err, tc.name)
+
+		if tc.name == "subprotocol" {
+			assert.Equal(t, "grpc", resp.Header.Get("Sec-WebSocket-Protocol"))
+		}
+
+		assert.Equal(t, tc.token, readMDMessage(t, conn), tc.name)
+		assert.NoError(t, conn.Close())
+	}
+}
+
+func TestAuth_FirstMessage(t *testing.T) {
+	addr, cleanup := setupWithServer(
+		t,
+		&mdServ{},
+		WithStreamAuth(AuthFromFirstMessage(100*time.Millisecond)),
+	)
+	defer cleanup()
+
+	url := fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("message-token")))
+	assert.Equal(t, "Bearer message-token", readMDMessage(t, conn))
+	assert.NoError(t, conn.Close())
+
+	// Connections that never authenticate should be closed.
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.Unauthenticated)))
+
+	// The first message is always bounded.
+	assert.Equal(t, defaultAuthTimeout, AuthFromFirstMessage(0).timeout)
+}
+
+func readMDMessage(t *testing.T, conn *websocket.Conn) string {
+	b, err := proto.Marshal(&echo.EchoStreamRequest{})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, b))
+
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+
+	resp := &echo.EchoStreamResponse{}
+	require.NoError(t, proto.Unmarshal(data, resp))
+	return resp.Message
+}
+
+// mdServ echos back the metadata it receives for the requested key
+// (EchoRequest.Message), or the authorization metadata if unspecified.
+type mdServ struct{}
+
+func (s mdServ) Echo(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return &echo.EchoResponse{
+		Message: incomingMD(ctx, req.Message),
+	}, nil
+}
+
+func (s mdServ) EchoStream(req *echo.EchoStreamRequest, stream echo.Echo_EchoStreamServer) error {
+	return stream.Send(&echo.EchoStreamResponse{
+		Message: incomingMD(stream.Context(), req.Message),
+	})
+}
+
+func incomingMD(ctx context.Context, key string) string {
+	if key == "" {
+		key = "authorization"
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	return strings.Join(md.Get(key), ",")
+}
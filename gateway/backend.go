@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// backend is a gRPC server that the gateway forwards requests to.
+type backend struct {
+	serv ServiceInfoProvider
+	cc   grpc.ClientConnInterface
+}
+
+// stateConn is implemented by connections that report their connectivity
+// state, such as *grpc.ClientConn.
+type stateConn interface {
+	GetState() connectivity.State
+	Connect()
+	WaitForStateChange(ctx context.Context, sourceState connectivity.State) bool
+}
+
+// WithBackend exposes the services provided by serv, forwarding their requests
+// to cc, in addition to the services provided to New. This allows a single
+// gateway to front services that are served by different processes.
+//
+// As with New, cc must use the BinaryCodec, and must not retain unary requests
+// after Invoke returns. Each service can only be provided
+// by a single backend; New panics if a service is provided by multiple backends.
+func WithBackend(serv ServiceInfoProvider, cc grpc.ClientConnInterface) MuxOption {
+	return func(m *Mux) {
+		m.backends = append(m.backends, &backend{serv: serv, cc: cc})
+	}
+}
+
+// assignServices maps each service to the backend that provides it, returning
+// an error describing any services that are provided by multiple backends.
+func (m *Mux) assignServices() error {
+	m.serviceBackends = make(map[string]*backend)
+
+	providers := make(map[string][]int)
+	for i, b := range m.backends {
+		for service := range b.serv.GetServiceInfo() {
+			providers[service] = append(providers[service], i)
+			m.serviceBackends[service] = b
+		}
+	}
+
+	var conflicts []string
+	for service, backends := range providers {
+		if len(backends) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("%s (backends %v)", service, backends))
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	sort.Strings(conflicts)
+	return errors.Errorf("services provided by multiple backends: %s", strings.Join(conflicts, ", "))
+}
@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestBackends(t *testing.T) {
+	hs := health.NewServer()
+	healthServ, healthCC, cleanupHealth := serveGRPC(t, func(s *grpc.Server) {
+		healthpb.RegisterHealthServer(s, hs)
+	})
+	defer cleanupHealth()
+
+	addr, cleanup := setup(t,
+		WithBackend(healthServ, healthCC),
+		WithAdminRoutes("admin"),
+		WithHealthCheck("grpc.health.v1.Health"),
+	)
+	defer cleanup()
+
+	// Each service's methods are forwarded to the backend that provides it.
+	b, err := proto.Marshal(&echo.EchoRequest{Message: "a", Repetitions: 2})
+	require.NoError(t, err)
+	var echoResp echo.EchoResponse
+	postProto(t, fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr), b, &echoResp)
+	assert.Equal(t, "aa", echoResp.Message)
+
+	b, err = proto.Marshal(&healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	var healthResp healthpb.HealthCheckResponse
+	postProto(t, fmt.Sprintf("http://%s/api/grpc.health.v1.Health/Check", addr), b, &healthResp)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, healthResp.Status)
+
+	// The health check is only made against the backend providing the service.
+	hs.SetServingStatus("grpc.health.v1.Health", healthpb.HealthCheckResponse_SERVING)
+	code, s := getReady(t, addr)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, ReadyStatus{
+		Ready: true,
+		Backends: []ReadyStatus{
+			{Ready: true, State: "READY", Services: []string{"echo.v1.Echo"}},
+			{Ready: true, State: "READY", Health: "SERVING", Services: []string{"grpc.health.v1.Health"}},
+		},
+	}, s)
+
+	hs.SetServingStatus("grpc.health.v1.Health", healthpb.HealthCheckResponse_NOT_SERVING)
+	code, s = getReady(t, addr)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, s.Ready)
+	assert.True(t, s.Backends[0].Ready)
+	assert.False(t, s.Backends[1].Ready)
+}
+
+func TestBackends_NoPrimary(t *testing.T) {
+	s, cc, cleanup := serveGRPC(t, func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, &serv{})
+	})
+	defer cleanup()
+
+	m := New(nil, nil, WithBackend(s, cc))
+	assert.Len(t, m.Routes(), 2)
+}
+
+func TestBackends_Conflict(t *testing.T) {
+	s, cc, cleanup := serveGRPC(t, func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, &serv{})
+	})
+	defer cleanup()
+
+	assert.PanicsWithValue(t, "gateway: services provided by multiple backends: echo.v1.Echo (backends [0 2])", func() {
+		New(s, cc,
+			WithBackend(Services{"other.v1.Other": grpc.ServiceInfo{}}, cc),
+			WithBackend(s, cc),
+		)
+	})
+}
+
+func postProto(t *testing.T, url string, b []byte, resp proto.Message) {
+	httpResp, err := http.Post(url, "application/proto", bytes.NewReader(b))
+	require.NoError(t, err)
+	defer httpResp.Body.Close()
+	require.Equal(t, http.StatusOK, httpResp.StatusCode)
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	require.NoError(t, err)
+	require.NoError(t, proto.Unmarshal(body, resp))
+}
@@ -0,0 +1,338 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultBatchMaxCalls    = 32
+	defaultBatchConcurrency = 8
+)
+
+// BatchConfig configures the batch route.
+type BatchConfig struct {
+	// MaxCalls is the maximum number of calls in a batch. If zero, a
+	// default of 32 is used.
+	MaxCalls int
+
+	// Concurrency is the maximum number of calls of a batch that are
+	// executed concurrently. If zero, a default of 8 is used.
+	Concurrency int
+}
+
+// WithBatchRoute registers a route (i.e. `/batch`) that executes multiple unary
+// calls in a single HTTP request. The calls are executed concurrently, and the
+// response contains the result of each call, in order.
+//
+// Batches are POSTed as either an application/proto BatchRequest (see batch.proto),
+// or as the equivalent JSON:
+//
+//	{"calls": [{"method": "echo.v1.Echo/Echo", "request": "<base64>", "metadata": {"key": "value"}}]}
+//
+// The response uses the same encoding:
+//
+//	{"results": [{"response": "<base64>"}, {"status": {"code": 5, "message": "not found"}}]}
+//
+// Each call is subject to the same rate limits, caching and metadata forwarding
+// as the equivalent unary request.
+func WithBatchRoute(route string, config BatchConfig) MuxOption {
+	return func(m *Mux) {
+		if config.MaxCalls <= 0 {
+			config.MaxCalls = defaultBatchMaxCalls
+		}
+		if config.Concurrency <= 0 {
+			config.Concurrency = defaultBatchConcurrency
+		}
+
+		m.batchRoute = path.Join("/", route)
+		m.batchConfig = config
+	}
+}
+
+type batchCall struct {
+	Method   string            `json:"method"`
+	Request  []byte            `json:"request"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type batchResult struct {
+	Response []byte
+	Status   *status.Status
+}
+
+type jsonStatus struct {
+	Code    codes.Code `json:"code"`
+	Message string     `json:"message,omitempty"`
+}
+
+type batchJSONResult struct {
+	Response []byte      `json:"response,omitempty"`
+	Status   *jsonStatus `json:"status,omitempty"`
+}
+
+func (m *Mux) registerBatchRoute() {
+	if m.batchRoute == "" {
+		return
+	}
+
+	log := m.log.WithField("route", m.batchRoute)
+	m.router.HandleFunc(m.batchRoute, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		requestType, ok := m.requestMediaType(w, req, mediaTypeProto, mediaTypeJSON)
+		if !ok {
+			return
+		}
+
+		// Responses use the same encoding as the request, unless the client
+		// only accepts the other.
+		offered := []string{mediaTypeProto, mediaTypeJSON}
+		if requestType == mediaTypeJSON {
+			offered = []string{mediaTypeJSON, mediaTypeProto}
+		}
+		contentType, responseType, ok := m.responseMediaType(w, req, offered...)
+		if !ok {
+			return
+		}
+
+		body, err := m.requestBody(req)
+		if err == errUnsupportedEncoding {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		buf, err := readBody(body, req.ContentLength)
+		body.Close()
+		if err == errBodyTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			log.WithError(err).Trace("Failed to read request body")
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		defer putBuffer(buf)
+		b := buf.Bytes()
+
+		var calls []batchCall
+		if requestType == mediaTypeJSON {
+			var batch struct {
+				Calls []batchCall `json:"calls"`
+			}
+			err = json.Unmarshal(b, &batch)
+			calls = batch.Calls
+		} else {
+			calls, err = unmarshalBatchRequest(b)
+		}
+		if err != nil {
+			http.Error(w, "invalid batch: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(calls) > m.batchConfig.MaxCalls {
+			http.Error(w, "too many calls", http.StatusBadRequest)
+			return
+		}
+
+		results := m.batch(req, calls)
+
+		var resp []byte
+		if responseType == mediaTypeJSON {
+			jsonResults := make([]batchJSONResult, len(results))
+			for i, r := range results {
+				jsonResults[i].Response = r.Response
+				if r.Status != nil {
+					jsonResults[i].Status = &jsonStatus{Code: r.Status.Code(), Message: r.Status.Message()}
+				}
+			}
+			resp, err = json.Marshal(struct {
+				Results []batchJSONResult `json:"results"`
+			}{jsonResults})
+		} else {
+			resp, err = marshalBatchResponse(results)
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed to marshal batch response")
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		resp, _ = m.compressResponse(w, req, resp)
+		if _, err := w.Write(resp); err != nil {
+			log.WithError(err).Info("Failed to send response")
+		}
+	})
+}
+
+// batch executes the calls concurrently, bounded by the configured concurrency.
+func (m *Mux) batch(req *http.Request, calls []batchCall) []batchResult {
+	clientKey := m.clientKey(req)
+	results := make([]batchResult, len(calls))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, m.batchConfig.Concurrency)
+	for i, call := range calls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, call batchCall) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			resp, err := m.batchCall(req, clientKey, call)
+			if err != nil {
+				results[i].Status = status.Convert(err)
+			} else {
+				results[i].Response = resp
+			}
+		}(i, call)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (m *Mux) batchCall(req *http.Request, clientKey string, call batchCall) ([]byte, error) {
+	fullMethod := strings.TrimPrefix(call.Method, "/")
+	u, ok := m.unaryMethods[fullMethod]
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "unknown unary method %s", call.Method)
+	}
+	if u.limiter != nil {
+		if ok, _ := u.limiter.allow(clientKey, time.Now()); !ok {
+			return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+		}
+	}
+
+	header := req.Header.Clone()
+	for k, v := range call.Metadata {
+		header.Set(k, v)
+	}
+
+	return m.call(m.outgoingContext(req, header), u.cc, fullMethod, call.Request)
+}
+
+// unmarshalBatchRequest decodes a BatchRequest (see batch.proto).
+func unmarshalBatchRequest(b []byte) ([]batchCall, error) {
+	var calls []batchCall
+	err := consumeFields(b, func(num protowire.Number, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+
+		var call batchCall
+		err := consumeFields(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				call.Method = string(v)
+			case 2:
+				call.Request = v
+			case 3:
+				var key, value string
+				err := consumeFields(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case 1:
+						key = string(v)
+					case 2:
+						value = string(v)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+
+				if call.Metadata == nil {
+					call.Metadata = make(map[string]string)
+				}
+				call.Metadata[key] = value
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		calls = append(calls, call)
+		return nil
+	})
+
+	return calls, err
+}
+
+// consumeFields calls f with the value of each length delimited field in b,
+// skipping all other fields. Since all of the fields of a BatchRequest are
+// length delimited, other types are skipped.
+func consumeFields(b []byte, f func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid tag")
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return errors.Wrap(protowire.ParseError(n), "invalid field")
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid field")
+		}
+		b = b[n:]
+
+		if err := f(num, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// marshalBatchResponse encodes a BatchResponse (see batch.proto).
+func marshalBatchResponse(results []batchResult) ([]byte, error) {
+	var b []byte
+	for _, r := range results {
+		var result []byte
+		if r.Response != nil {
+			result = protowire.AppendTag(result, 1, protowire.BytesType)
+			result = protowire.AppendBytes(result, r.Response)
+		}
+		if r.Status != nil {
+			s, err := proto.Marshal(r.Status.Proto())
+			if err != nil {
+				return nil, err
+			}
+			result = protowire.AppendTag(result, 2, protowire.BytesType)
+			result = protowire.AppendBytes(result, s)
+		}
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, result)
+	}
+
+	return b, nil
+}
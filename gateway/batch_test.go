@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestBatch_JSON(t *testing.T) {
+	addr, cleanup := setup(t, WithBatchRoute("batch", BatchConfig{MaxCalls: 4, Concurrency: 2}))
+	defer cleanup()
+
+	ok := encodeEcho(t, &echo.EchoRequest{Message: "a", Repetitions: 2})
+	fail := encodeEcho(t, &echo.EchoRequest{StatusCode: int32(codes.NotFound)})
+
+	code, body := postBatch(t, addr, "application/json", fmt.Sprintf(`{"calls": [
+		{"method": "echo.v1.Echo/Echo", "request": "%s"},
+		{"method": "/echo.v1.Echo/Echo", "request": "%s"},
+		{"method": "echo.v1.Echo/EchoStream"},
+		{"method": "echo.v1.Echo/Nope"}
+	]}`, ok, fail), nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, fmt.Sprintf(`{"results": [
+		{"response": "%s"},
+		{"status": {"code": 5, "message": "induce"}},
+		{"status": {"code": 12, "message": "unknown unary method echo.v1.Echo/EchoStream"}},
+		{"status": {"code": 12, "message": "unknown unary method echo.v1.Echo/Nope"}}
+	]}`, encodeEchoResponse(t, "aa")), body)
+
+	code, _ = postBatch(t, addr, "application/json", `{"calls": [{}, {}, {}, {}, {}]}`, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = postBatch(t, addr, "application/json", `{"calls": `, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = postBatch(t, addr, "text/plain", `{}`, nil)
+	assert.Equal(t, http.StatusUnsupportedMediaType, code)
+}
+
+func TestBatch_Proto(t *testing.T) {
+	addr, cleanup := setupWithServer(t, &mdServ{}, WithBatchRoute("batch", BatchConfig{}))
+	defer cleanup()
+
+	// The envelope is built from the schema in batch.proto, to ensure that
+	// the gateway's encoding matches it.
+	batchRequest, batchResponse := batchDescriptors(t)
+
+	req := dynamicpb.NewMessage(batchRequest)
+	require.NoError(t, protojson.Unmarshal([]byte(fmt.Sprintf(`{"calls": [
+		{"method": "echo.v1.Echo/Echo", "request": "%s"},
+		{"method": "echo.v1.Echo/Echo", "request": "%s", "metadata": {"Authorization": "Bearer call"}},
+		{"method": "echo.v1.Echo/Nope"}
+	]}`, encodeEcho(t, &echo.EchoRequest{}), encodeEcho(t, &echo.EchoRequest{}))), req))
+	b, err := protov2.Marshal(req)
+	require.NoError(t, err)
+
+	code, body := postBatch(t, addr, "application/proto", string(b), http.Header{
+		"Authorization": {"Bearer header"},
+	})
+	require.Equal(t, http.StatusOK, code)
+
+	resp := dynamicpb.NewMessage(batchResponse)
+	require.NoError(t, protov2.Unmarshal([]byte(body), resp))
+	respJSON, err := protojson.Marshal(resp)
+	require.NoError(t, err)
+
+	// Call metadata takes precedence over the request's headers.
+	assert.JSONEq(t, fmt.Sprintf(`{"results": [
+		{"response": "%s"},
+		{"response": "%s"},
+		{"status": {"code": 12, "message": "unknown unary method echo.v1.Echo/Nope"}}
+	]}`, encodeEchoResponse(t, "Bearer header"), encodeEchoResponse(t, "Bearer call")), string(respJSON))
+
+	code, _ = postBatch(t, addr, "application/proto", "\xff", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func postBatch(t *testing.T, addr, contentType, body string, header http.Header) (int, string) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/batch", addr), bytes.NewBufferString(body))
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(b)
+}
+
+func encodeEcho(t *testing.T, req *echo.EchoRequest) string {
+	b, err := proto.Marshal(req)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func encodeEchoResponse(t *testing.T, message string) string {
+	b, err := proto.Marshal(&echo.EchoResponse{Message: message})
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// batchDescriptors returns the BatchRequest and BatchResponse descriptors,
+// as defined in batch.proto.
+func batchDescriptors(t *testing.T) (protoreflect.MessageDescriptor, protoreflect.MessageDescriptor) {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     typ.Enum(),
+			Label:    label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	message := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+	bytesType := descriptorpb.FieldDescriptorProto_TYPE_BYTES
+
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("gateway/batch.proto"),
+		Package:    proto.String("grpcoverhttp.batch.v1"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/rpc/status.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name:  proto.String("BatchRequest"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("calls", 1, message, repeated, ".grpcoverhttp.batch.v1.Call")},
+			},
+			{
+				Name: proto.String("Call"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("method", 1, str, optional, ""),
+					field("request", 2, bytesType, optional, ""),
+					field("metadata", 3, message, repeated, ".grpcoverhttp.batch.v1.Call.MetadataEntry"),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("MetadataEntry"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							field("key", 1, str, optional, ""),
+							field("value", 2, str, optional, ""),
+						},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+			{
+				Name:  proto.String("BatchResponse"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("results", 1, message, repeated, ".grpcoverhttp.batch.v1.Result")},
+			},
+			{
+				Name: proto.String("Result"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("response", 1, bytesType, optional, ""),
+					field("status", 2, message, optional, ".google.rpc.Status"),
+				},
+			},
+		},
+	}, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+
+	return fd.Messages().ByName("BatchRequest"), fd.Messages().ByName("BatchResponse")
+}
@@ -0,0 +1,449 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBreakerWindow         = 10 * time.Second
+	defaultBreakerMinCalls       = 20
+	defaultBreakerErrorRate      = 0.5
+	defaultBreakerSlowCallRate   = 0.5
+	defaultBreakerOpenDuration   = 5 * time.Second
+	defaultBreakerHalfOpenProbes = 1
+
+	// breakerBuckets is the number of buckets the window is divided into, so
+	// that old calls expire gradually rather than all at once.
+	breakerBuckets = 10
+)
+
+// errCircuitOpen is returned for calls that are rejected by an open circuit
+// breaker.
+var errCircuitOpen = status.Error(codes.Unavailable, "circuit breaker open")
+
+// defaultFailureCodes are the codes that indicate a failing server, rather
+// than a bad request.
+var defaultFailureCodes = []codes.Code{
+	codes.Unknown,
+	codes.DeadlineExceeded,
+	codes.Internal,
+	codes.Unavailable,
+	codes.DataLoss,
+}
+
+// CircuitBreaker configures the circuit breaker of a method, which rejects
+// calls while the method is failing (or slow), rather than letting them tie
+// up the gateway and the server.
+type CircuitBreaker struct {
+	// Window is the period over which calls are measured. If zero, a default
+	// of 10s is used.
+	Window time.Duration
+
+	// MinCalls is the number of calls within the window required before the
+	// breaker can open. If zero, a default of 20 is used.
+	MinCalls int
+
+	// ErrorRate is the fraction of failed calls within the window at which the
+	// breaker opens. If zero, a default of 0.5 is used.
+	ErrorRate float64
+
+	// FailureCodes are the codes that count as failures. If empty, Unknown,
+	// DeadlineExceeded, Internal, Unavailable, and DataLoss are failures.
+	FailureCodes []codes.Code
+
+	// SlowCallDuration, if set, counts unary calls that take longer as slow,
+	// and the breaker also opens once SlowCallRate (by default, 0.5) of the
+	// calls within the window are slow.
+	//
+	// Streams may be long-lived, so the outcome of a stream is that of its
+	// first response (or error), and its duration isn't measured. Streams
+	// that are half-open probes succeed once they're established.
+	SlowCallDuration time.Duration
+	SlowCallRate     float64
+
+	// OpenDuration is how long the breaker rejects calls once opened, after
+	// which it's half-open: HalfOpenProbes calls are let through, and the
+	// breaker closes if they all succeed, or opens again if any fail (or are
+	// slow). If zero, defaults of 5s and 1 are used.
+	OpenDuration   time.Duration
+	HalfOpenProbes int
+}
+
+func (c CircuitBreaker) withDefaults() CircuitBreaker {
+	if c.Window <= 0 {
+		c.Window = defaultBreakerWindow
+	}
+	if c.MinCalls <= 0 {
+		c.MinCalls = defaultBreakerMinCalls
+	}
+	if c.ErrorRate <= 0 {
+		c.ErrorRate = defaultBreakerErrorRate
+	}
+	if len(c.FailureCodes) == 0 {
+		c.FailureCodes = defaultFailureCodes
+	}
+	if c.SlowCallRate <= 0 {
+		c.SlowCallRate = defaultBreakerSlowCallRate
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = defaultBreakerOpenDuration
+	}
+	if c.HalfOpenProbes <= 0 {
+		c.HalfOpenProbes = defaultBreakerHalfOpenProbes
+	}
+
+	return c
+}
+
+// CircuitBreakerStats is the state of a method's circuit breaker.
+type CircuitBreakerStats struct {
+	// State is either "closed", "open", or "half-open".
+	State string `json:"state"`
+
+	// Calls, Failures, and Slow are the calls within the current window.
+	Calls    int `json:"calls"`
+	Failures int `json:"failures"`
+	Slow     int `json:"slow"`
+
+	// Opened is the number of times the breaker has opened, and Rejected the
+	// number of calls it has rejected.
+	Opened   uint64 `json:"opened"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// WithCircuitBreaker sets the circuit breaker of each method that doesn't have
+// one set by WithMethodCircuitBreaker. Each method has its own breaker, so a
+// failing method doesn't affect the others.
+//
+// While a breaker is open, unary requests are rejected with a 503, and streams
+// are closed with Unavailable.
+func WithCircuitBreaker(config CircuitBreaker) MuxOption {
+	return func(m *Mux) {
+		m.circuitBreaker = &config
+	}
+}
+
+// WithMethodCircuitBreaker sets the circuit breaker of the specified method
+// (i.e. `echo.v1.Echo/Echo`).
+func WithMethodCircuitBreaker(fullMethod string, config CircuitBreaker) MuxOption {
+	return func(m *Mux) {
+		if m.methodCircuitBreakers == nil {
+			m.methodCircuitBreakers = make(map[string]CircuitBreaker)
+		}
+		m.methodCircuitBreakers[strings.TrimPrefix(fullMethod, "/")] = config
+	}
+}
+
+// CircuitBreakerStats returns the state of each method's circuit breaker.
+func (m *Mux) CircuitBreakerStats() map[string]CircuitBreakerStats {
+	stats := make(map[string]CircuitBreakerStats, len(m.breakers))
+	for fullMethod, b := range m.breakers {
+		stats[fullMethod] = b.stats(time.Now())
+	}
+
+	return stats
+}
+
+// breakerConn returns the connection used to call the method, which is cc
+// wrapped by the method's circuit breaker, if it has one.
+func (m *Mux) breakerConn(fullMethod string, cc grpc.ClientConnInterface) grpc.ClientConnInterface {
+	config, ok := m.methodCircuitBreakers[fullMethod]
+	if !ok {
+		if m.circuitBreaker == nil {
+			return cc
+		}
+		config = *m.circuitBreaker
+	}
+
+	b := newBreaker(config, m.log.WithField("method", fullMethod))
+	if m.breakers == nil {
+		m.breakers = make(map[string]*breaker)
+	}
+	m.breakers[fullMethod] = b
+
+	return &breakerConn{ClientConnInterface: cc, breaker: b}
+}
+
+// breakerConn is a connection whose calls are made through a circuit breaker.
+type breakerConn struct {
+	grpc.ClientConnInterface
+	breaker *breaker
+}
+
+func (c *breakerConn) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	start := time.Now()
+	generation, ok := c.breaker.allow(start)
+	if !ok {
+		return errCircuitOpen
+	}
+
+	err := c.ClientConnInterface.Invoke(ctx, method, args, reply, opts...)
+	end := time.Now()
+	c.breaker.record(generation, err, end.Sub(start), end)
+	return err
+}
+
+func (c *breakerConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	generation, ok := c.breaker.allow(time.Now())
+	if !ok {
+		return nil, errCircuitOpen
+	}
+
+	cs, err := c.ClientConnInterface.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		c.breaker.record(generation, err, 0, time.Now())
+		return nil, err
+	}
+
+	// Probes can't wait for a response, since the stream may not send one
+	// for a long time (if ever), and other calls are rejected until then.
+	if c.breaker.probing(generation) {
+		c.breaker.record(generation, nil, 0, time.Now())
+		return cs, nil
+	}
+
+	return &breakerStream{ClientStream: cs, breaker: c.breaker, generation: generation}, nil
+}
+
+// breakerStream records the outcome of a stream once it receives its first
+// response, or fails.
+type breakerStream struct {
+	grpc.ClientStream
+
+	breaker    *breaker
+	generation uint64
+	once       sync.Once
+}
+
+func (s *breakerStream) RecvMsg(msg interface{}) error {
+	err := s.ClientStream.RecvMsg(msg)
+	s.once.Do(func() {
+		result := err
+		if result == io.EOF {
+			result = nil
+		}
+		s.breaker.record(s.generation, result, 0, time.Now())
+	})
+
+	return err
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is the circuit breaker of a single method.
+type breaker struct {
+	config CircuitBreaker
+	log    *logrus.Entry
+
+	mu       sync.Mutex
+	state    breakerState
+	openedAt time.Time
+	buckets  [breakerBuckets]breakerBucket
+
+	// generation changes with each state change, so that the outcomes of
+	// calls allowed in a previous state are ignored.
+	generation uint64
+	probes     int
+	successes  int
+
+	opened   uint64
+	rejected uint64
+}
+
+// breakerBucket counts the calls within a slice of the window.
+type breakerBucket struct {
+	epoch    int64
+	calls    int
+	failures int
+	slow     int
+}
+
+func newBreaker(config CircuitBreaker, log *logrus.Entry) *breaker {
+	return &breaker{
+		config: config.withDefaults(),
+		log:    log,
+	}
+}
+
+// allow returns whether a call can be made, and the generation to record its
+// outcome with.
+func (b *breaker) allow(now time.Time) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.config.OpenDuration {
+			b.rejected++
+			return 0, false
+		}
+		b.transition(breakerHalfOpen, now)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes >= b.config.HalfOpenProbes {
+			b.rejected++
+			return 0, false
+		}
+		b.probes++
+	}
+
+	return b.generation, true
+}
+
+// probing returns whether the call allowed with the generation is a half-open
+// probe.
+func (b *breaker) probing(generation uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == breakerHalfOpen && b.generation == generation
+}
+
+// record records the outcome of a call, opening or closing the breaker if
+// required.
+func (b *breaker) record(generation uint64, err error, d time.Duration, now time.Time) {
+	failed := err != nil && b.failure(err)
+	slow := b.config.SlowCallDuration > 0 && d > b.config.SlowCallDuration
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed || slow {
+			b.transition(breakerOpen, now)
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.config.HalfOpenProbes {
+			b.transition(breakerClosed, now)
+		}
+	case breakerClosed:
+		bucket := b.bucket(now)
+		bucket.calls++
+		if failed {
+			bucket.failures++
+		}
+		if slow {
+			bucket.slow++
+		}
+
+		calls, failures, slowCalls := b.totals(now)
+		if calls < b.config.MinCalls {
+			return
+		}
+		if float64(failures) >= b.config.ErrorRate*float64(calls) ||
+			(b.config.SlowCallDuration > 0 && float64(slowCalls) >= b.config.SlowCallRate*float64(calls)) {
+			b.transition(breakerOpen, now)
+		}
+	}
+}
+
+func (b *breaker) failure(err error) bool {
+	code := status.Code(err)
+	for _, c := range b.config.FailureCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transition changes the state of the breaker. The caller must hold b.mu.
+func (b *breaker) transition(state breakerState, now time.Time) {
+	if state == breakerOpen {
+		b.log.Warn("Circuit breaker opened")
+		b.openedAt = now
+		b.opened++
+	} else {
+		b.log.Infof("Circuit breaker %s", state)
+	}
+
+	b.state = state
+	b.generation++
+	b.probes, b.successes = 0, 0
+	b.buckets = [breakerBuckets]breakerBucket{}
+}
+
+// epoch returns the index of the bucket containing now, since the Unix epoch.
+func (b *breaker) epoch(now time.Time) int64 {
+	width := int64(b.config.Window / breakerBuckets)
+	if width <= 0 {
+		width = 1
+	}
+
+	return now.UnixNano() / width
+}
+
+// bucket returns the bucket for calls completed at now. The caller must hold
+// b.mu.
+func (b *breaker) bucket(now time.Time) *breakerBucket {
+	epoch := b.epoch(now)
+	bucket := &b.buckets[epoch%breakerBuckets]
+	if bucket.epoch != epoch {
+		*bucket = breakerBucket{epoch: epoch}
+	}
+
+	return bucket
+}
+
+// totals returns the calls within the window. The caller must hold b.mu.
+func (b *breaker) totals(now time.Time) (calls, failures, slow int) {
+	epoch := b.epoch(now)
+	for _, bucket := range b.buckets {
+		if bucket.epoch > epoch-breakerBuckets {
+			calls += bucket.calls
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+
+	return calls, failures, slow
+}
+
+func (b *breaker) stats(now time.Time) CircuitBreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	calls, failures, slow := b.totals(now)
+	return CircuitBreakerStats{
+		State:    b.state.String(),
+		Calls:    calls,
+		Failures: failures,
+		Slow:     slow,
+		Opened:   b.opened,
+		Rejected: b.rejected,
+	}
+}
@@ -0,0 +1,225 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errUnavailable = status.Error(codes.Unavailable, "induced")
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	b := newBreaker(CircuitBreaker{MinCalls: 4, OpenDuration: time.Second}, logrus.NewEntry(logrus.New()))
+	now := time.Now()
+
+	// Client errors aren't failures, and the breaker doesn't open until
+	// there are enough calls.
+	for _, err := range []error{errUnavailable, errUnavailable, status.Error(codes.NotFound, "")} {
+		g, ok := b.allow(now)
+		require.True(t, ok)
+		b.record(g, err, 0, now)
+	}
+	assert.Equal(t, CircuitBreakerStats{State: "closed", Calls: 3, Failures: 2}, b.stats(now))
+
+	g, ok := b.allow(now)
+	require.True(t, ok)
+	b.record(g, nil, 0, now)
+	assert.Equal(t, "open", b.stats(now).State)
+
+	_, ok = b.allow(now.Add(500 * time.Millisecond))
+	assert.False(t, ok)
+
+	// Once half-open, a single probe is allowed, which re-opens the breaker
+	// if it fails.
+	now = now.Add(time.Second)
+	g, ok = b.allow(now)
+	require.True(t, ok)
+	_, ok = b.allow(now)
+	assert.False(t, ok)
+	assert.Equal(t, "half-open", b.stats(now).State)
+
+	b.record(g, errUnavailable, 0, now)
+	assert.Equal(t, CircuitBreakerStats{State: "open", Opened: 2, Rejected: 2}, b.stats(now))
+
+	// Successful probes close the breaker.
+	now = now.Add(time.Second)
+	g, ok = b.allow(now)
+	require.True(t, ok)
+	b.record(g, nil, 0, now)
+	assert.Equal(t, CircuitBreakerStats{State: "closed", Opened: 2, Rejected: 2}, b.stats(now))
+}
+
+func TestBreaker_Latency(t *testing.T) {
+	b := newBreaker(CircuitBreaker{
+		MinCalls:         2,
+		SlowCallDuration: 100 * time.Millisecond,
+		OpenDuration:     time.Second,
+		HalfOpenProbes:   2,
+	}, logrus.NewEntry(logrus.New()))
+	now := time.Now()
+
+	for _, d := range []time.Duration{200 * time.Millisecond, 10 * time.Millisecond} {
+		g, ok := b.allow(now)
+		require.True(t, ok)
+		b.record(g, nil, d, now)
+	}
+	assert.Equal(t, "open", b.stats(now).State)
+
+	// Slow probes also re-open the breaker.
+	now = now.Add(time.Second)
+	g1, ok := b.allow(now)
+	require.True(t, ok)
+	g2, ok := b.allow(now)
+	require.True(t, ok)
+
+	b.record(g1, nil, 10*time.Millisecond, now)
+	assert.Equal(t, "half-open", b.stats(now).State)
+	b.record(g2, nil, 200*time.Millisecond, now)
+	assert.Equal(t, "open", b.stats(now).State)
+}
+
+func TestBreaker_Window(t *testing.T) {
+	b := newBreaker(CircuitBreaker{Window: time.Second, MinCalls: 2}, logrus.NewEntry(logrus.New()))
+	now := time.Now()
+
+	g, _ := b.allow(now)
+	b.record(g, errUnavailable, 0, now)
+
+	// Calls expire once they're outside of the window.
+	now = now.Add(2 * time.Second)
+	g, _ = b.allow(now)
+	b.record(g, errUnavailable, 0, now)
+	assert.Equal(t, CircuitBreakerStats{State: "closed", Calls: 1, Failures: 1}, b.stats(now))
+
+	// Outcomes of calls allowed before the breaker changed state are ignored.
+	stale, _ := b.allow(now)
+	g, _ = b.allow(now)
+	b.record(g, errUnavailable, 0, now)
+	require.Equal(t, "open", b.stats(now).State)
+
+	b.record(stale, errUnavailable, 0, now)
+	assert.Equal(t, CircuitBreakerStats{State: "open", Opened: 1}, b.stats(now))
+}
+
+func TestCircuitBreaker_Unary(t *testing.T) {
+	cc := failingConn(codes.Unavailable, 100)
+	m := New(fakeServices, cc,
+		WithDescriptors(testDescriptors()),
+		WithMethodCircuitBreaker("test.v1.Test/Unary", CircuitBreaker{MinCalls: 2, OpenDuration: time.Minute}),
+		WithRetryPolicy("test.v1.Test/Unary", RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond}),
+		WithAdminRoutes("admin"),
+	)
+	addr, cleanup := serveMux(t, m)
+	defer cleanup()
+
+	// The first call is retried until the breaker opens, after which calls
+	// fail without reaching the server (and aren't retried).
+	for _, attempts := range []string{"3", "1"} {
+		resp, err := http.Post(fmt.Sprintf("http://%s/api/test.v1.Test/Unary", addr), "application/proto", bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "circuit breaker open\n", string(body))
+		assert.Equal(t, attempts, resp.Header.Get(AttemptsHeader))
+	}
+	assert.Len(t, cc.recorded(), 2)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/admin/breakers", addr))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var stats map[string]CircuitBreakerStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, map[string]CircuitBreakerStats{
+		"test.v1.Test/Unary": {State: "open", Opened: 1, Rejected: 2},
+	}, stats)
+}
+
+func TestCircuitBreaker_Stream(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			return errUnavailable
+		},
+	}
+	m := New(fakeServices, cc, WithCircuitBreaker(CircuitBreaker{MinCalls: 1, OpenDuration: time.Minute}))
+	addr, cleanup := serveMux(t, m)
+	defer cleanup()
+
+	for _, message := range []string{"induced", "circuit breaker open"} {
+		conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil)
+		require.NoError(t, err)
+
+		_, _, err = conn.ReadMessage()
+		conn.Close()
+		require.True(t, websocket.IsCloseError(err, 4000+int(codes.Unavailable)), err)
+		assert.Equal(t, message, err.(*websocket.CloseError).Text)
+	}
+	assert.Len(t, cc.recorded(), 1)
+
+	// Each method has its own breaker.
+	stats := m.CircuitBreakerStats()
+	assert.Equal(t, "open", stats["test.v1.Test/Bidi"].State)
+	assert.Equal(t, "closed", stats["test.v1.Test/Unary"].State)
+}
+
+func TestCircuitBreaker_LongLivedProbe(t *testing.T) {
+	var calls int32
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return errUnavailable
+			}
+
+			// Streams after the first don't respond until they're closed.
+			for range reqs {
+			}
+			return nil
+		},
+	}
+	m := New(fakeServices, cc, WithCircuitBreaker(CircuitBreaker{MinCalls: 1, OpenDuration: 10 * time.Millisecond}))
+	addr, cleanup := serveMux(t, m)
+	defer cleanup()
+
+	url := fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	conn.Close()
+	require.True(t, websocket.IsCloseError(err, 4000+int(codes.Unavailable)), err)
+	assert.Equal(t, "open", m.CircuitBreakerStats()["test.v1.Test/Bidi"].State)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The probe succeeds once it's established, rather than holding the
+	// breaker half-open for as long as it's open.
+	probe, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer probe.Close()
+
+	require.Eventually(t, func() bool {
+		return m.CircuitBreakerStats()["test.v1.Test/Bidi"].State == "closed"
+	}, time.Second, time.Millisecond)
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Eventually(t, func() bool {
+		return len(cc.recorded()) == 3
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxPreallocSize bounds the buffer that's preallocated from a request's
+	// Content-Length, so clients can't force large allocations without
+	// actually sending the data.
+	maxPreallocSize = 1 << 20
+
+	// maxPooledSize is the capacity of the largest buffer that's returned to
+	// the pool, so that the occasional large message doesn't pin memory.
+	maxPooledSize = 4 << 20
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledSize {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// readBody reads r into a pooled buffer, preallocated using the expected size
+// (i.e. the Content-Length), if known. The buffer should be released with
+// putBuffer once its contents are no longer referenced.
+//
+// Note: unary requests are read into pooled buffers, which are reused once the
+// call completes. The gateway's connections must not retain requests after a
+// call returns (i.e. in an interceptor).
+func readBody(r io.Reader, size int64) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if size > 0 {
+		if size > maxPreallocSize {
+			size = maxPreallocSize
+		}
+
+		// ReadFrom always requires MinRead bytes of space to detect
+		// the end of the body, so we include it to avoid growing the
+		// buffer after the body has been read.
+		buf.Grow(int(size) + bytes.MinRead)
+	}
+
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// readMessage reads the next websocket data message.
+//
+// Unlike ws.ReadMessage(), which grows a fresh buffer as the message is read,
+// the message is read into a pooled buffer, and only a single, exactly sized
+// copy is allocated. The copy is required since streams may retain messages
+// after SendMsg returns.
+func readMessage(ws *websocket.Conn) (int, []byte, error) {
+	messageType, r, err := ws.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if _, err := buf.ReadFrom(r); err != nil {
+		return messageType, nil, err
+	}
+
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+	return messageType, data, nil
+}
@@ -0,0 +1,203 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var benchmarkSizes = []int{64, 4 << 10, 256 << 10}
+
+func TestReadBody(t *testing.T) {
+	for _, size := range []int64{-1, 0, 5, 100, maxPreallocSize + 1} {
+		body := strings.Repeat("a", 100)
+		buf, err := readBody(strings.NewReader(body), size)
+		require.NoError(t, err)
+		assert.Equal(t, body, buf.String())
+
+		// The buffer is preallocated to fit the expected size, bounded by
+		// maxPreallocSize.
+		if size == 100 {
+			assert.True(t, buf.Cap() >= 100+bytes.MinRead)
+			assert.True(t, buf.Cap() < 2*(100+bytes.MinRead))
+		}
+		if size > maxPreallocSize {
+			assert.True(t, buf.Cap() < 2*maxPreallocSize)
+		}
+		putBuffer(buf)
+	}
+
+	// Large buffers aren't pooled.
+	buf := getBuffer()
+	buf.Grow(maxPooledSize + 1)
+	putBuffer(buf)
+	assert.True(t, getBuffer().Cap() <= maxPooledSize)
+}
+
+func TestReadMessage(t *testing.T) {
+	var received [][]byte
+	done := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer close(done)
+
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+		require.NoError(t, err)
+		defer ws.Close()
+
+		for {
+			_, data, err := readMessage(ws)
+			if err != nil {
+				return
+			}
+			received = append(received, data)
+		}
+	}))
+	defer s.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err)
+
+	sent := [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 64<<10), []byte("c")}
+	for _, msg := range sent {
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, msg))
+	}
+	conn.Close()
+	<-done
+
+	// Messages must not share the pooled buffer they were read into.
+	assert.Equal(t, sent, received)
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		body := bytes.Repeat([]byte("a"), size)
+
+		b.Run(fmt.Sprintf("ReadAll/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ioutil.ReadAll(bytes.NewReader(body)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Pooled/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf, err := readBody(bytes.NewReader(body), int64(size))
+				if err != nil {
+					b.Fatal(err)
+				}
+				putBuffer(buf)
+			}
+		})
+	}
+}
+
+func BenchmarkUnary(b *testing.B) {
+	m := New(fakeServices, echoConn{})
+
+	for _, size := range benchmarkSizes {
+		body := bytes.Repeat([]byte("a"), size)
+
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "/api/test.v1.Test/Unary", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/proto")
+				w := httptest.NewRecorder()
+
+				m.router.ServeHTTP(w, req)
+				if w.Code != http.StatusOK || w.Body.Len() != size {
+					b.Fatalf("unexpected response: %d (%d bytes)", w.Code, w.Body.Len())
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStream(b *testing.B) {
+	addr, cleanup := serveMux(b, New(fakeServices, echoConn{}))
+	defer cleanup()
+
+	for _, size := range benchmarkSizes {
+		msg := bytes.Repeat([]byte("a"), size)
+
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := conn.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// echoConn is a minimal grpc.ClientConnInterface that echoes requests, to
+// benchmark the gateway without the overhead of recording calls.
+type echoConn struct{}
+
+func (echoConn) Invoke(_ context.Context, _ string, args interface{}, reply interface{}, _ ...grpc.CallOption) error {
+	// Like a real connection, the response doesn't alias the request.
+	*reply.(*[]byte) = append([]byte(nil), args.([]byte)...)
+	return nil
+}
+
+func (echoConn) NewStream(ctx context.Context, _ *grpc.StreamDesc, _ string, _ ...grpc.CallOption) (grpc.ClientStream, error) {
+	return &echoStream{ctx: ctx, msgs: make(chan []byte, 1)}, nil
+}
+
+type echoStream struct {
+	grpc.ClientStream
+
+	ctx  context.Context
+	msgs chan []byte
+}
+
+func (s *echoStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *echoStream) SendMsg(m interface{}) error {
+	select {
+	case s.msgs <- m.([]byte):
+		return nil
+	case <-s.ctx.Done():
+		return status.FromContextError(s.ctx.Err()).Err()
+	}
+}
+
+func (s *echoStream) CloseSend() error {
+	return nil
+}
+
+func (s *echoStream) RecvMsg(m interface{}) error {
+	select {
+	case b := <-s.msgs:
+		*m.(*[]byte) = b
+		return nil
+	case <-s.ctx.Done():
+		return status.FromContextError(s.ctx.Err()).Err()
+	}
+}
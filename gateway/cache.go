@@ -0,0 +1,264 @@
+package gateway
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultCacheMaxEntries = 1024
+	defaultCacheMaxBytes   = 32 << 20
+)
+
+// ResponseCacheConfig configures the in-memory response cache (see WithCachedMethod).
+type ResponseCacheConfig struct {
+	// MaxEntries and MaxBytes bound the size of the cache, with the least
+	// recently used responses evicted first. If zero, defaults are used.
+	MaxEntries int
+	MaxBytes   int
+
+	// Metadata are the (lower-cased) metadata keys that are included in the
+	// cache key, in addition to the method and request. Responses that depend
+	// on the caller (i.e. `authorization`) must include the relevant keys.
+	Metadata []string
+}
+
+// CacheStats are the response cache's metrics.
+type CacheStats struct {
+	// Hits are requests served from the cache, and Coalesced are requests
+	// that waited for an identical in-flight request.
+	Hits      uint64 `json:"hits"`
+	Coalesced uint64 `json:"coalesced"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+}
+
+// HitRatio returns the ratio of requests that were not forwarded to the
+// gRPC server, including coalesced requests.
+func (s CacheStats) HitRatio() float64 {
+	total := s.Hits + s.Coalesced + s.Misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.Hits+s.Coalesced) / float64(total)
+}
+
+// WithResponseCache configures the response cache used by WithCachedMethod.
+func WithResponseCache(config ResponseCacheConfig) MuxOption {
+	return func(m *Mux) {
+		m.responseCacheConfig = config
+	}
+}
+
+// WithCachedMethod caches the responses of the specified unary method (i.e.
+// `echo.v1.Echo/Echo`) for ttl. Responses are keyed by the method, request bytes,
+// and any metadata configured with WithResponseCache. Concurrent identical
+// requests are coalesced into a single request to the gRPC server, whose
+// response (or error) is shared by all of them. Errors are not cached, and if
+// the coalesced request is cancelled by its client (or times out), the other
+// requests are retried rather than sharing its error.
+//
+// Only methods that are free of side effects should be cached.
+func WithCachedMethod(fullMethod string, ttl time.Duration) MuxOption {
+	return func(m *Mux) {
+		if m.cachedMethods == nil {
+			m.cachedMethods = make(map[string]time.Duration)
+		}
+		m.cachedMethods[strings.TrimPrefix(fullMethod, "/")] = ttl
+	}
+}
+
+// CacheStats returns the response cache's metrics.
+func (m *Mux) CacheStats() CacheStats {
+	if m.responseCache == nil {
+		return CacheStats{}
+	}
+
+	return m.responseCache.stats()
+}
+
+// call invokes the unary method, using the response cache if it's enabled
+// for the method, and retrying it if it has a retry policy.
+func (m *Mux) call(ctx context.Context, cc grpc.ClientConnInterface, fullMethod string, req []byte) ([]byte, error) {
+	invoke := func() ([]byte, error) {
+		return m.invokeWithRetries(ctx, cc, fullMethod, req)
+	}
+
+	ttl, ok := m.cachedMethods[fullMethod]
+	if !ok || m.responseCache == nil {
+		return invoke()
+	}
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return m.responseCache.get(ctx, m.responseCache.key(fullMethod, md, req), ttl, invoke)
+}
+
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	resp    []byte
+	expires time.Time
+}
+
+// inflight is a request that identical requests wait for.
+type inflight struct {
+	done chan struct{}
+	resp []byte
+	err  error
+
+	// cancelled is whether the call failed due to the context of the request
+	// that made it, in which case its error isn't shared.
+	cancelled bool
+}
+
+// responseCache is an LRU cache of responses, which coalesces concurrent
+// requests for the same key.
+type responseCache struct {
+	config ResponseCacheConfig
+	now    func() time.Time
+
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[[sha256.Size]byte]*list.Element
+	inflight map[[sha256.Size]byte]*inflight
+	counts   CacheStats
+}
+
+func newResponseCache(config ResponseCacheConfig) *responseCache {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultCacheMaxEntries
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultCacheMaxBytes
+	}
+
+	return &responseCache{
+		config:   config,
+		now:      time.Now,
+		lru:      list.New(),
+		entries:  make(map[[sha256.Size]byte]*list.Element),
+		inflight: make(map[[sha256.Size]byte]*inflight),
+	}
+}
+
+// key hashes the components of the key, so that large requests don't
+// consume additional memory.
+func (c *responseCache) key(fullMethod string, md metadata.MD, req []byte) [sha256.Size]byte {
+	h := sha256.New()
+	writeKeyPart(h, []byte(fullMethod))
+	for _, k := range c.config.Metadata {
+		values := md.Get(k)
+		writeKeyPart(h, []byte(k))
+		for _, v := range values {
+			writeKeyPart(h, []byte(v))
+		}
+	}
+	writeKeyPart(h, req)
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// writeKeyPart writes a length prefixed part, so that the boundaries between
+// parts are unambiguous.
+func writeKeyPart(h hash.Hash, b []byte) {
+	var n [binary.MaxVarintLen64]byte
+	_, _ = h.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))])
+	_, _ = h.Write(b)
+}
+
+// get returns the cached response, or the response of invoke, which is called
+// with the context ctx. Concurrent calls with the same key are coalesced.
+func (c *responseCache) get(ctx context.Context, key [sha256.Size]byte, ttl time.Duration, invoke func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if c.now().Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			c.counts.Hits++
+			c.mu.Unlock()
+			return entry.resp, nil
+		}
+
+		c.remove(e)
+	}
+
+	if f, ok := c.inflight[key]; ok {
+		c.counts.Coalesced++
+		c.mu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+
+		// The call was made on behalf of another request, so if that request
+		// went away, we try again with our own.
+		if f.cancelled {
+			return c.get(ctx, key, ttl, invoke)
+		}
+		return f.resp, f.err
+	}
+
+	f := &inflight{done: make(chan struct{})}
+	c.inflight[key] = f
+	c.counts.Misses++
+	c.mu.Unlock()
+
+	f.resp, f.err = invoke()
+	f.cancelled = f.err != nil && ctx.Err() != nil
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if f.err == nil {
+		c.add(key, f.resp, c.now().Add(ttl))
+	}
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.resp, f.err
+}
+
+func (c *responseCache) add(key [sha256.Size]byte, resp []byte, expires time.Time) {
+	if len(resp) > c.config.MaxBytes {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, resp: resp, expires: expires})
+	c.counts.Entries++
+	c.counts.Bytes += len(resp)
+
+	for c.counts.Entries > c.config.MaxEntries || c.counts.Bytes > c.config.MaxBytes {
+		c.remove(c.lru.Back())
+		c.counts.Evictions++
+	}
+}
+
+func (c *responseCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.counts.Entries--
+	c.counts.Bytes -= len(entry.resp)
+}
+
+func (c *responseCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counts
+}
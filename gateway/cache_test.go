@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResponseCache(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			if string(req) == "fail" {
+				return nil, status.Error(codes.Unavailable, "induced")
+			}
+			return append([]byte("resp:"), req...), nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc,
+		WithCachedMethod("test.v1.Test/Unary", time.Minute),
+		WithResponseCache(ResponseCacheConfig{Metadata: []string{"authorization"}}),
+		WithAdminRoutes("admin"),
+	))
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		code, body := postCached(t, addr, "a", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "resp:a", body)
+	}
+	assert.Len(t, cc.recorded(), 1)
+
+	// Both the request and the configured metadata are part of the key.
+	_, body := postCached(t, addr, "b", "")
+	assert.Equal(t, "resp:b", body)
+	_, body = postCached(t, addr, "a", "Bearer other")
+	assert.Equal(t, "resp:a", body)
+	assert.Len(t, cc.recorded(), 3)
+
+	// Errors aren't cached.
+	for i := 0; i < 2; i++ {
+		code, _ := postCached(t, addr, "fail", "")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+	}
+	assert.Len(t, cc.recorded(), 5)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/admin/cache", addr))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var stats struct {
+		CacheStats
+		HitRatio float64 `json:"hit_ratio"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 5, Entries: 3, Bytes: 18}, stats.CacheStats)
+	assert.InDelta(t, 2.0/7.0, stats.HitRatio, 0.001)
+}
+
+func TestResponseCache_Coalesced(t *testing.T) {
+	release := make(chan struct{})
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			<-release
+			return req, nil
+		},
+	}
+	m := New(fakeServices, cc, WithCachedMethod("test.v1.Test/Unary", time.Minute))
+	addr, cleanup := serveMux(t, m)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			code, body := postCached(t, addr, "a", "")
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, "a", body)
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return m.CacheStats().Coalesced == 4
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Len(t, cc.recorded(), 1)
+	assert.Equal(t, CacheStats{Coalesced: 4, Misses: 1, Entries: 1, Bytes: 1}, m.CacheStats())
+	assert.Equal(t, 0.8, m.CacheStats().HitRatio())
+}
+
+func TestResponseCache_CancelledCoalescing(t *testing.T) {
+	c := newResponseCache(ResponseCacheConfig{})
+	key := c.key("svc/Method", nil, []byte("a"))
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := c.get(leaderCtx, key, time.Minute, func() ([]byte, error) {
+			<-leaderCtx.Done()
+			return nil, status.FromContextError(leaderCtx.Err()).Err()
+		})
+		leaderErr <- err
+	}()
+	require.Eventually(t, func() bool {
+		return c.stats().Misses == 1
+	}, time.Second, time.Millisecond)
+
+	waiterResp := make(chan []byte, 1)
+	go func() {
+		resp, err := c.get(context.Background(), key, time.Minute, func() ([]byte, error) {
+			return []byte("b"), nil
+		})
+		assert.NoError(t, err)
+		waiterResp <- resp
+	}()
+	require.Eventually(t, func() bool {
+		return c.stats().Coalesced == 1
+	}, time.Second, time.Millisecond)
+
+	// Waiters stop waiting once their own request is cancelled.
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.get(cancelledCtx, key, time.Minute, func() ([]byte, error) {
+		return nil, status.Error(codes.Internal, "unexpected call")
+	})
+	assert.Equal(t, codes.Canceled, status.Code(err))
+
+	// Once the leader is cancelled, the remaining waiter makes its own call,
+	// rather than sharing the leader's error.
+	cancelLeader()
+	assert.Equal(t, codes.Canceled, status.Code(<-leaderErr))
+	assert.Equal(t, []byte("b"), <-waiterResp)
+	assert.Equal(t, CacheStats{Coalesced: 2, Misses: 2, Entries: 1, Bytes: 1}, c.stats())
+}
+
+func TestResponseCache_Eviction(t *testing.T) {
+	now := time.Now()
+	c := newResponseCache(ResponseCacheConfig{MaxEntries: 2, MaxBytes: 10})
+	c.now = func() time.Time {
+		return now
+	}
+
+	var invocations int
+	get := func(req string, ttl time.Duration) {
+		resp, err := c.get(context.Background(), c.key("svc/Method", nil, []byte(req)), ttl, func() ([]byte, error) {
+			invocations++
+			return []byte(req), nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, req, string(resp))
+	}
+
+	get("a", time.Minute)
+	get("b", time.Minute)
+	get("a", time.Minute)
+	assert.Equal(t, 2, invocations)
+
+	// b is the least recently used.
+	get("c", time.Minute)
+	get("a", time.Minute)
+	assert.Equal(t, 3, invocations)
+	get("b", time.Minute)
+	assert.Equal(t, 4, invocations)
+
+	// Entries are also bounded by size, and responses that would exceed the
+	// bound are never cached.
+	get("0123456789", time.Minute)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 5, Evictions: 4, Entries: 1, Bytes: 10}, c.stats())
+	get("0123456789a", time.Minute)
+	get("0123456789a", time.Minute)
+	assert.Equal(t, 7, invocations)
+
+	// Expired entries are replaced.
+	get("d", time.Second)
+	now = now.Add(time.Second)
+	get("d", time.Second)
+	assert.Equal(t, 9, invocations)
+}
+
+func postCached(t *testing.T, addr, body, authorization string) (int, string) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/test.v1.Test/Unary", addr), bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/proto")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(b)
+}
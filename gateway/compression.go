@@ -0,0 +1,317 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultCompressionMinSize  = 1024
+	defaultMaxDecompressedSize = 4 << 20
+)
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errBodyTooLarge        = errors.New("decompressed body too large")
+)
+
+// Compressor implements an HTTP content coding (i.e. gzip). Additional codings,
+// such as zstd, can be supported by implementing a Compressor.
+type Compressor interface {
+	// Name is the name of the coding, as used in the Content-Encoding and
+	// Accept-Encoding headers.
+	Name() string
+
+	Compress(w io.Writer) (io.WriteCloser, error)
+	Decompress(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip returns a gzip Compressor, using the specified compression level
+// (see compress/gzip).
+func Gzip(level int) Compressor {
+	return gzipCompressor{level: level}
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (c gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (c gzipCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// Deflate returns a deflate Compressor, using the specified compression level
+// (see compress/zlib). As specified by HTTP, the deflate coding uses the zlib
+// format, rather than raw deflate.
+func Deflate(level int) Compressor {
+	return deflateCompressor{level: level}
+}
+
+type deflateCompressor struct {
+	level int
+}
+
+func (c deflateCompressor) Name() string {
+	return "deflate"
+}
+
+func (c deflateCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, c.level)
+}
+
+func (c deflateCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// CompressionConfig configures the compression of unary requests and responses.
+type CompressionConfig struct {
+	// Compressors are the supported codings, in order of preference. If
+	// empty, gzip and deflate are supported.
+	Compressors []Compressor
+
+	// MinSize is the size of the smallest response that is compressed,
+	// since compressing small messages is rarely worthwhile. If zero, a
+	// default of 1KB is used.
+	MinSize int
+
+	// MaxDecompressedSize is the size of the largest request body once
+	// decompressed, so that small, highly compressed requests can't exhaust
+	// the gateway's memory. Larger requests are rejected with a 413 Request
+	// Entity Too Large. If zero, a default of 4MB is used.
+	MaxDecompressedSize int64
+}
+
+// WithCompression supports compressed unary requests (using the Content-Encoding
+// header), and compresses responses using the client's preferred coding (from the
+// Accept-Encoding header). Requests with an unsupported coding are rejected with
+// a 415 Unsupported Media Type.
+func WithCompression(config CompressionConfig) MuxOption {
+	return func(m *Mux) {
+		if len(config.Compressors) == 0 {
+			config.Compressors = []Compressor{
+				Gzip(gzip.DefaultCompression),
+				Deflate(zlib.DefaultCompression),
+			}
+		}
+		if config.MinSize <= 0 {
+			config.MinSize = defaultCompressionMinSize
+		}
+		if config.MaxDecompressedSize <= 0 {
+			config.MaxDecompressedSize = defaultMaxDecompressedSize
+		}
+
+		m.compression = &config
+	}
+}
+
+// WithWebsocketCompression negotiates per-message compression (permessage-deflate)
+// with websocket clients, compressing messages of at least minSize bytes using the
+// specified level (see compress/flate).
+func WithWebsocketCompression(level, minSize int) MuxOption {
+	return func(m *Mux) {
+		m.wsCompression = &websocketCompression{level: level, minSize: minSize}
+	}
+}
+
+type websocketCompression struct {
+	level   int
+	minSize int
+}
+
+// configure sets the compression level of the connection, if compression
+// was negotiated.
+func (c *websocketCompression) configure(ws *websocket.Conn) error {
+	if c == nil {
+		return nil
+	}
+
+	return ws.SetCompressionLevel(c.level)
+}
+
+// writeMessage writes a message consisting of the concatenated parts, only
+// compressing it if it's large enough. The parts are written directly to the
+// frame, so framing (i.e. a header) doesn't require copying the payload.
+func (c *websocketCompression) writeMessage(ws *websocket.Conn, messageType int, parts ...[]byte) error {
+	if c != nil {
+		size := 0
+		for _, p := range parts {
+			size += len(p)
+		}
+		ws.EnableWriteCompression(size >= c.minSize)
+	}
+
+	w, err := ws.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// requestBody returns the body of the request, decompressing it if necessary.
+// Reading a decompressed body fails with errBodyTooLarge once it exceeds the
+// CompressionConfig.MaxDecompressedSize.
+func (m *Mux) requestBody(req *http.Request) (io.ReadCloser, error) {
+	encoding := strings.TrimSpace(req.Header.Get("Content-Encoding"))
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		return req.Body, nil
+	}
+
+	c := m.compressor(encoding)
+	if c == nil {
+		return nil, errUnsupportedEncoding
+	}
+
+	r, err := c.Decompress(req.Body)
+	if err != nil {
+		req.Body.Close()
+		return nil, errors.Wrap(err, "invalid compressed body")
+	}
+
+	return &decompressedBody{ReadCloser: r, body: req.Body, remaining: m.compression.MaxDecompressedSize}, nil
+}
+
+// compressor returns the configured compressor for the coding, if any.
+func (m *Mux) compressor(encoding string) Compressor {
+	if m.compression == nil {
+		return nil
+	}
+
+	for _, c := range m.compression.Compressors {
+		if strings.EqualFold(c.Name(), encoding) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// decompressedBody limits the size of the decompressed body, and closes both
+// the decompressor and the underlying body.
+type decompressedBody struct {
+	io.ReadCloser
+	body      io.Closer
+	remaining int64
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	// We read (at most) a byte past the limit, to detect larger bodies.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errBodyTooLarge
+	}
+
+	return n, err
+}
+
+func (b *decompressedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if closeErr := b.body.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// compressResponse compresses the response using the client's preferred coding,
+// setting the corresponding headers, and returning the compressed response and
+// coding, or the original response if it shouldn't be compressed.
+func (m *Mux) compressResponse(w http.ResponseWriter, req *http.Request, resp []byte) ([]byte, string) {
+	if m.compression == nil {
+		return resp, ""
+	}
+
+	addVary(w.Header(), "Accept-Encoding")
+	if len(resp) < m.compression.MinSize {
+		return resp, ""
+	}
+
+	c := preferredCompressor(req.Header.Get("Accept-Encoding"), m.compression.Compressors)
+	if c == nil {
+		return resp, ""
+	}
+
+	var buf bytes.Buffer
+	cw, err := c.Compress(&buf)
+	if err != nil {
+		m.log.WithError(err).Warn("Failed to initialize compressor")
+		return resp, ""
+	}
+	if _, err := cw.Write(resp); err != nil {
+		m.log.WithError(err).Warn("Failed to compress response")
+		return resp, ""
+	}
+	if err := cw.Close(); err != nil {
+		m.log.WithError(err).Warn("Failed to compress response")
+		return resp, ""
+	}
+
+	w.Header().Set("Content-Encoding", c.Name())
+	return buf.Bytes(), c.Name()
+}
+
+// preferredCompressor returns the compressor with the highest quality in the
+// Accept-Encoding header, with ties broken by the order of the compressors.
+func preferredCompressor(acceptEncoding string, compressors []Compressor) Compressor {
+	if acceptEncoding == "" {
+		return nil
+	}
+
+	qualities := make(map[string]float64)
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, q := coding, 1.0
+		if i := strings.Index(coding, ";"); i >= 0 {
+			name = coding[:i]
+
+			param := strings.TrimSpace(coding[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		qualities[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	var preferred Compressor
+	var preferredQ float64
+	for _, c := range compressors {
+		q, ok := qualities[strings.ToLower(c.Name())]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > preferredQ {
+			preferred, preferredQ = c, q
+		}
+	}
+
+	return preferred
+}
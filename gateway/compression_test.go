@@ -0,0 +1,257 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression_Response(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			return req, nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithCompression(CompressionConfig{MinSize: 16})))
+	defer cleanup()
+
+	large := strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		acceptEncoding string
+		body           string
+		encoding       string
+	}{
+		{"", large, ""},
+		{"gzip", "small", ""},
+		{"gzip", large, "gzip"},
+		{"gzip, deflate", large, "gzip"},
+		{"gzip;q=0.5, deflate", large, "deflate"},
+		{"gzip;q=0, *", large, "deflate"},
+		{"br", large, ""},
+		{"*;q=0", large, ""},
+	} {
+		resp, body := postCompressed(t, addr, []byte(tc.body), "", tc.acceptEncoding)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, tc.encoding, resp.Header.Get("Content-Encoding"), tc.acceptEncoding)
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Equal(t, tc.body, decompress(t, tc.encoding, body))
+	}
+}
+
+func TestCompression_Request(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			return req, nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithCompression(CompressionConfig{})))
+	defer cleanup()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	resp, body := postCompressed(t, addr, buf.Bytes(), "gzip", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	resp, _ = postCompressed(t, addr, []byte("hello"), "identity", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = postCompressed(t, addr, []byte("hello"), "br", "")
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp, _ = postCompressed(t, addr, []byte("hello"), "gzip", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Without compression, compressed requests are rejected.
+	addr, cleanup = serveMux(t, New(fakeServices, cc))
+	defer cleanup()
+
+	resp, _ = postCompressed(t, addr, buf.Bytes(), "gzip", "")
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
+
+func TestCompression_RequestLimit(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			return nil, nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithCompression(CompressionConfig{})))
+	defer cleanup()
+
+	// 64MB of zeros compresses to ~64KB.
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	zeros := make([]byte, 1<<20)
+	for i := 0; i < 64; i++ {
+		_, err := w.Write(zeros)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	require.True(t, buf.Len() < 1<<20)
+
+	resp, _ := postCompressed(t, addr, buf.Bytes(), "gzip", "")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Empty(t, cc.recorded())
+
+	// Bodies up to the limit are accepted.
+	addr, cleanup = serveMux(t, New(fakeServices, cc, WithCompression(CompressionConfig{MaxDecompressedSize: 5})))
+	defer cleanup()
+
+	for body, code := range map[string]int{
+		"hello":  http.StatusOK,
+		"hello!": http.StatusRequestEntityTooLarge,
+	} {
+		buf.Reset()
+		w.Reset(&buf)
+		_, err := w.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		resp, _ = postCompressed(t, addr, buf.Bytes(), "gzip", "")
+		assert.Equal(t, code, resp.StatusCode, body)
+	}
+}
+
+func TestCompression_Cacheable(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			return bytes.Repeat(req, 64), nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc,
+		WithCacheableMethod("test.v1.Test/Unary", CachePolicy{MaxAge: time.Minute}),
+		WithCompression(CompressionConfig{MinSize: 16}),
+	))
+	defer cleanup()
+
+	get := func(acceptEncoding, ifNoneMatch string) *http.Response {
+		url := fmt.Sprintf("http://%s/api/test.v1.Test/Unary?message=%s", addr, base64.RawURLEncoding.EncodeToString([]byte("a")))
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		if resp.StatusCode == http.StatusOK {
+			assert.Equal(t, strings.Repeat("a", 64), decompress(t, resp.Header.Get("Content-Encoding"), body))
+		}
+		return resp
+	}
+
+	// Each coding is a distinct representation, with a distinct ETag.
+	identity := get("identity", "")
+	require.Equal(t, http.StatusOK, identity.StatusCode)
+	gzipped := get("gzip", "")
+	require.Equal(t, http.StatusOK, gzipped.StatusCode)
+	assert.Equal(t, "gzip", gzipped.Header.Get("Content-Encoding"))
+	assert.NotEqual(t, identity.Header.Get("ETag"), gzipped.Header.Get("ETag"))
+	assert.Equal(t, []string{"Accept-Encoding, Accept, Authorization"}, gzipped.Header.Values("Vary"))
+
+	assert.Equal(t, http.StatusNotModified, get("gzip", gzipped.Header.Get("ETag")).StatusCode)
+	assert.Equal(t, http.StatusOK, get("identity", gzipped.Header.Get("ETag")).StatusCode)
+}
+
+func TestCompression_Websocket(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			for req := range reqs {
+				send(req)
+			}
+			return nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithWebsocketCompression(1, 16)))
+	defer cleanup()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+
+	for _, msg := range []string{"small", strings.Repeat("a", 64)} {
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte(msg)))
+
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(data))
+	}
+
+	// Compression is only used if negotiated.
+	conn, resp, err = websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Empty(t, resp.Header.Get("Sec-Websocket-Extensions"))
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte(strings.Repeat("b", 64))))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("b", 64), string(data))
+}
+
+func postCompressed(t *testing.T, addr string, body []byte, contentEncoding, acceptEncoding string) (*http.Response, []byte) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/test.v1.Test/Unary", addr), bytes.NewBuffer(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/proto")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+
+	// Note: setting Accept-Encoding disables the transport's transparent
+	// decompression, so we can observe the coding.
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	if acceptEncoding == "" {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, b
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	var b []byte
+	switch encoding {
+	case "":
+		return string(body)
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		b, err = ioutil.ReadAll(r)
+		require.NoError(t, err)
+	case "deflate":
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		b, err = ioutil.ReadAll(r)
+		require.NoError(t, err)
+	default:
+		t.Fatalf("unexpected encoding %s", encoding)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The conformance tests run the gateway against a fake connection, asserting
+// the calls made by the gateway, rather than the behaviour of a real server.
+
+var fakeServices = Services{
+	"test.v1.Test": grpc.ServiceInfo{
+		Methods: []grpc.MethodInfo{
+			{Name: "Unary"},
+			{Name: "Bidi", IsClientStream: true, IsServerStream: true},
+		},
+	},
+}
+
+func TestConformance_Unary(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			return append([]byte("resp:"), req...), nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc))
+	defer cleanup()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/test.v1.Test/Unary", addr), bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/proto")
+	req.Header.Set("Authorization", "Bearer token")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "resp:hello", string(body))
+
+	calls := cc.recorded()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "/test.v1.Test/Unary", calls[0].method)
+	assert.Nil(t, calls[0].desc)
+	assert.Equal(t, [][]byte{[]byte("hello")}, calls[0].reqs)
+	assert.Equal(t, []string{"Bearer token"}, calls[0].md.Get("authorization"))
+}
+
+func TestConformance_UnaryError(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			return nil, status.Error(codes.NotFound, "no such thing")
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc))
+	defer cleanup()
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/api/test.v1.Test/Unary", addr), "application/proto", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "no such thing\n", string(body))
+}
+
+func TestConformance_Stream(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			for i := 0; i < 2; i++ {
+				send(<-reqs)
+			}
+			return status.Error(codes.PermissionDenied, "done")
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc))
+	defer cleanup()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, msg := range []string{"a", "b"} {
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte(msg)))
+
+		mType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, mType)
+		assert.Equal(t, msg, string(data))
+	}
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.PermissionDenied)))
+
+	calls := cc.recorded()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "/test.v1.Test/Bidi", calls[0].method)
+	assert.Equal(t, streamDesc, calls[0].desc)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, calls[0].reqs)
+}
+
+func TestConformance_Readiness(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			return proto.Marshal(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithAdminRoutes("admin"), WithHealthCheck("")))
+	defer cleanup()
+
+	// Connections that don't report their state are only health checked.
+	code, s := getReady(t, addr)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, ReadyStatus{Ready: true, Health: "SERVING"}, s)
+
+	calls := cc.recorded()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "/grpc.health.v1.Health/Check", calls[0].method)
+}
+
+type fakeCall struct {
+	method string
+	md     metadata.MD
+	desc   *grpc.StreamDesc
+	reqs   [][]byte
+}
+
+// fakeConn is a grpc.ClientConnInterface that records the calls made to it.
+// Unary calls are served by unary, and streams by stream, which receives the
+// messages sent by the client and sends responses until it returns.
+type fakeConn struct {
+	unary  func(method string, req []byte) ([]byte, error)
+	stream func(method string, reqs <-chan []byte, send func([]byte)) error
+
+	mu    sync.Mutex
+	calls []*fakeCall
+}
+
+func (c *fakeConn) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, _ ...grpc.CallOption) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+
+	// Requests are read into pooled buffers, so they're copied to be recorded.
+	req := append([]byte(nil), args.([]byte)...)
+	c.record(&fakeCall{method: method, md: md, reqs: [][]byte{req}})
+
+	resp, err := c.unary(method, req)
+	if err != nil {
+		return err
+	}
+
+	*reply.(*[]byte) = resp
+	return nil
+}
+
+func (c *fakeConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, _ ...grpc.CallOption) (grpc.ClientStream, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	call := &fakeCall{method: method, md: md, desc: desc}
+	c.record(call)
+
+	s := &fakeStream{
+		ctx:   ctx,
+		conn:  c,
+		call:  call,
+		reqs:  make(chan []byte, 16),
+		resps: make(chan []byte, 16),
+	}
+	go func() {
+		s.err = c.stream(method, s.reqs, func(b []byte) {
+			s.resps <- b
+		})
+		close(s.resps)
+	}()
+
+	return s, nil
+}
+
+func (c *fakeConn) record(call *fakeCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+func (c *fakeConn) recorded() []fakeCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	calls := make([]fakeCall, len(c.calls))
+	for i, call := range c.calls {
+		calls[i] = *call
+	}
+	return calls
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+
+	ctx   context.Context
+	conn  *fakeConn
+	call  *fakeCall
+	reqs  chan []byte
+	resps chan []byte
+	err   error
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeStream) SendMsg(m interface{}) error {
+	b := m.([]byte)
+
+	s.conn.mu.Lock()
+	s.call.reqs = append(s.call.reqs, b)
+	s.conn.mu.Unlock()
+
+	select {
+	case s.reqs <- b:
+		return nil
+	case <-s.ctx.Done():
+		return status.FromContextError(s.ctx.Err()).Err()
+	}
+}
+
+func (s *fakeStream) CloseSend() error {
+	return nil
+}
+
+func (s *fakeStream) Trailer() metadata.MD {
+	return nil
+}
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	select {
+	case b, ok := <-s.resps:
+		if !ok {
+			if s.err == nil {
+				return io.EOF
+			}
+			return s.err
+		}
+
+		*m.(*[]byte) = b
+		return nil
+	case <-s.ctx.Done():
+		return status.FromContextError(s.ctx.Err()).Err()
+	}
+}
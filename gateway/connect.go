@@ -0,0 +1,534 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	connectProtocolVersion = "1"
+	connectStreamPrefix    = "application/connect+"
+
+	connectFlagCompressed = 0x01
+	connectFlagEndStream  = 0x02
+
+	// maxConnectTimeoutDigits is the maximum length of Connect-Timeout-Ms.
+	maxConnectTimeoutDigits = 10
+
+	defaultConnectMaxMessageSize = 4 << 20
+)
+
+var (
+	errMessageTooLarge = errors.New("message too large")
+)
+
+// connectCodes are the names of the codes used by the Connect protocol.
+var connectCodes = map[codes.Code]string{
+	codes.Canceled:           "canceled",
+	codes.Unknown:            "unknown",
+	codes.InvalidArgument:    "invalid_argument",
+	codes.DeadlineExceeded:   "deadline_exceeded",
+	codes.NotFound:           "not_found",
+	codes.AlreadyExists:      "already_exists",
+	codes.PermissionDenied:   "permission_denied",
+	codes.ResourceExhausted:  "resource_exhausted",
+	codes.FailedPrecondition: "failed_precondition",
+	codes.Aborted:            "aborted",
+	codes.OutOfRange:         "out_of_range",
+	codes.Unimplemented:      "unimplemented",
+	codes.Internal:           "internal",
+	codes.Unavailable:        "unavailable",
+	codes.DataLoss:           "data_loss",
+	codes.Unauthenticated:    "unauthenticated",
+}
+
+// WithConnect serves the Connect protocol (https://connectrpc.com/docs/protocol),
+// as used by clients such as Connect-ES, on the gateway's routes.
+//
+// Unary methods accept Connect unary requests: POST requests with either an
+// application/proto or application/json body, identified by the
+// Connect-Protocol-Version header (or the JSON content type). Streaming methods
+// accept Connect streaming requests (application/connect+proto or
+// application/connect+json). All other requests continue to be handled by the
+// gateway. JSON messages are only supported for methods with descriptors (see
+// WithDescriptors).
+//
+// HTTP/1.1 streams are half-duplex, since the request must be read in full
+// before responses are sent, so bidirectional streams require HTTP/2. Serving
+// Connect accepts HTTP/2 cleartext (h2c) connections.
+func WithConnect() MuxOption {
+	return func(m *Mux) {
+		m.connect = true
+	}
+}
+
+// WithConnectMaxMessageSize sets the maximum size of the (possibly compressed)
+// messages of Connect streaming requests. Larger messages fail the stream with
+// ResourceExhausted before they're read. By default, messages are limited to 4MB.
+func WithConnectMaxMessageSize(size int) MuxOption {
+	return func(m *Mux) {
+		m.connectMaxMessageSize = size
+	}
+}
+
+// connectMessageLimit returns the maximum size of Connect stream messages.
+func (m *Mux) connectMessageLimit() int {
+	if m.connectMaxMessageSize <= 0 {
+		return defaultConnectMaxMessageSize
+	}
+
+	return m.connectMaxMessageSize
+}
+
+// connectError is the JSON representation of an error in the Connect protocol.
+type connectError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Details []connectDetail `json:"details,omitempty"`
+}
+
+type connectDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// connectEndStream is the final message of a Connect stream.
+type connectEndStream struct {
+	Error    *connectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+func newConnectError(s *status.Status) *connectError {
+	e := &connectError{
+		Code:    connectCodes[s.Code()],
+		Message: s.Message(),
+	}
+	if e.Code == "" {
+		e.Code = connectCodes[codes.Unknown]
+	}
+
+	for _, d := range s.Proto().Details {
+		e.Details = append(e.Details, connectDetail{
+			Type:  d.TypeUrl[strings.LastIndex(d.TypeUrl, "/")+1:],
+			Value: base64.RawStdEncoding.EncodeToString(d.Value),
+		})
+	}
+
+	return e
+}
+
+// isConnectUnaryRequest matches Connect unary requests.
+func isConnectUnaryRequest(req *http.Request, _ *mux.RouteMatch) bool {
+	if req.Method != "POST" {
+		return false
+	}
+	if req.Header.Get("Connect-Protocol-Version") != "" {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// isConnectStreamRequest matches Connect streaming requests.
+func isConnectStreamRequest(req *http.Request, _ *mux.RouteMatch) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return strings.HasPrefix(mediaType, connectStreamPrefix)
+}
+
+// connectCodec returns whether the content type is the JSON (rather than proto)
+// variant of the content types with the specified prefix.
+func connectCodec(contentType, prefix string) (isJSON bool, ok bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false, false
+	}
+
+	switch mediaType {
+	case prefix + "proto":
+		return false, true
+	case prefix + "json":
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// connectContext returns the context of a Connect request, bounded by its
+// timeout, if any.
+func (m *Mux) connectContext(req *http.Request) (context.Context, context.CancelFunc, error) {
+	if v := req.Header.Get("Connect-Protocol-Version"); v != "" && v != connectProtocolVersion {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "unsupported connect protocol version %q", v)
+	}
+
+	ctx := m.outgoingContext(req, req.Header)
+
+	timeout := req.Header.Get("Connect-Timeout-Ms")
+	if timeout == "" {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+
+	ms, err := strconv.ParseUint(timeout, 10, 64)
+	if err != nil || len(timeout) > maxConnectTimeoutDigits {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid timeout %q", timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+	return ctx, cancel, nil
+}
+
+func (m *Mux) connectUnaryHandler(fullMethod string, u *unaryMethod) http.HandlerFunc {
+	log := m.log.WithFields(logrus.Fields{
+		"method":    fullMethod,
+		"streaming": "false",
+		"protocol":  "connect",
+	})
+	limiter := u.limiter
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		mediaType, ok := m.requestMediaType(w, req, mediaTypeProto, mediaTypeJSON)
+		if !ok {
+			return
+		}
+		isJSON := mediaType == mediaTypeJSON
+
+		ctx, cancel, err := m.connectContext(req)
+		if err != nil {
+			writeConnectError(w, err)
+			return
+		}
+		defer cancel()
+
+		if limiter != nil {
+			if ok, retryAfter := limiter.allow(m.clientKey(req), time.Now()); !ok {
+				w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+				writeConnectError(w, status.Error(codes.ResourceExhausted, "rate limit exceeded"))
+				return
+			}
+		}
+
+		body, err := m.requestBody(req)
+		if err == errUnsupportedEncoding {
+			writeConnectError(w, status.Error(codes.Unimplemented, err.Error()))
+			return
+		} else if err != nil {
+			writeConnectError(w, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+
+		buf, err := readBody(body, req.ContentLength)
+		body.Close()
+		if err == errBodyTooLarge {
+			writeConnectError(w, status.Error(codes.ResourceExhausted, err.Error()))
+			return
+		} else if err != nil {
+			log.WithError(err).Trace("Failed to read request body")
+			writeConnectError(w, status.Error(codes.Internal, "failed to read request"))
+			return
+		}
+		defer putBuffer(buf)
+
+		codec := m.newJSONCodec(ctx, fullMethod)
+		b := buf.Bytes()
+		if isJSON {
+			if b, err = codec.unmarshalRequest(b); err != nil {
+				writeConnectError(w, status.Error(codes.InvalidArgument, err.Error()))
+				return
+			}
+		}
+
+		ctx, attempts := withAttempts(ctx)
+		resp, err := m.call(ctx, u.cc, fullMethod, b)
+		setAttemptsHeader(w.Header(), attempts)
+		if err != nil {
+			writeConnectError(w, err)
+			return
+		}
+
+		if isJSON {
+			if resp, err = codec.marshalResponse(resp); err != nil {
+				writeConnectError(w, status.Error(codes.Internal, err.Error()))
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", mediaType)
+		resp, _ = m.compressResponse(w, req, resp)
+		w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+		if n, err := w.Write(resp); err != nil {
+			log.WithError(err).Infof("Failed to send response (%d/%d transferred)", n, len(resp))
+		}
+	}
+}
+
+func (m *Mux) connectStreamHandler(fullMethod string, cc grpc.ClientConnInterface) http.HandlerFunc {
+	log := m.log.WithFields(logrus.Fields{
+		"method":    fullMethod,
+		"streaming": "true",
+		"protocol":  "connect",
+	})
+	limiter := m.limiter(fullMethod)
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		isJSON, ok := connectCodec(req.Header.Get("Content-Type"), connectStreamPrefix)
+		if !ok {
+			w.Header().Set("Accept-Post", connectStreamPrefix+"json, "+connectStreamPrefix+"proto")
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+		if isJSON {
+			w.Header().Set("Content-Type", connectStreamPrefix+"json")
+		} else {
+			w.Header().Set("Content-Type", connectStreamPrefix+"proto")
+		}
+
+		// Errors are sent in the final message of the stream, rather than
+		// with an HTTP status.
+		end := func(err error, trailer metadata.MD) {
+			if err := writeEndStream(w, err, trailer); err != nil {
+				log.WithError(err).Info("Failed to end stream")
+			}
+		}
+
+		ctx, cancelTimeout, err := m.connectContext(req)
+		if err != nil {
+			end(err, nil)
+			return
+		}
+		defer cancelTimeout()
+
+		var c Compressor
+		if encoding := req.Header.Get("Connect-Content-Encoding"); encoding != "" && encoding != "identity" {
+			if c = m.compressor(encoding); c == nil {
+				end(status.Errorf(codes.Unimplemented, "unsupported message encoding %q", encoding), nil)
+				return
+			}
+		}
+
+		if limiter != nil {
+			key := m.clientKey(req)
+			if ok, retryAfter := limiter.allow(key, time.Now()); !ok {
+				w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+				end(status.Error(codes.ResourceExhausted, "rate limit exceeded"), nil)
+				return
+			}
+			if !limiter.acquireStream(key) {
+				end(status.Error(codes.ResourceExhausted, "too many streams"), nil)
+				return
+			}
+			defer limiter.releaseStream(key)
+		}
+
+		streamCtx, cancelFunc := context.WithCancel(ctx)
+		defer cancelFunc()
+		cancel := &streamCancel{cancel: cancelFunc}
+
+		cs, err := cc.NewStream(streamCtx, streamDesc, "/"+fullMethod)
+		if err != nil {
+			log.WithError(err).Warn("Failed to initialize grpc stream")
+			end(err, nil)
+			return
+		}
+
+		codec := m.newJSONCodec(streamCtx, fullMethod)
+
+		sendDone := make(chan struct{})
+		go func() {
+			defer close(sendDone)
+
+			for {
+				flags, data, err := readEnvelope(req.Body, m.connectMessageLimit())
+				if err == io.EOF {
+					break
+				}
+				if err == nil && flags&connectFlagCompressed != 0 {
+					data, err = m.decompressMessage(c, data)
+				}
+				if err == nil && isJSON {
+					data, err = codec.unmarshalRequest(data)
+				}
+				if err == errMessageTooLarge {
+					cancel.cancelWith(status.Error(codes.ResourceExhausted, err.Error()))
+					return
+				} else if err == errBodyTooLarge {
+					cancel.cancelWith(status.Error(codes.ResourceExhausted, "decompressed message too large"))
+					return
+				} else if err != nil {
+					cancel.cancelWith(status.Error(codes.InvalidArgument, err.Error()))
+					return
+				}
+
+				// If the stream failed, the error is returned by RecvMsg.
+				if err := cs.SendMsg(data); err != nil {
+					return
+				}
+			}
+
+			if err := cs.CloseSend(); err != nil {
+				log.WithError(err).Info("Failed to close send")
+			}
+		}()
+
+		// HTTP/1.x request bodies can't be read once the response has
+		// been written, so the request is read in full first.
+		if req.ProtoMajor < 2 {
+			<-sendDone
+		}
+
+		flusher, _ := w.(http.Flusher)
+		for {
+			var resp []byte
+			if err = cs.RecvMsg(&resp); err != nil {
+				break
+			}
+
+			if isJSON {
+				if resp, err = codec.marshalResponse(resp); err != nil {
+					err = status.Error(codes.Internal, err.Error())
+					break
+				}
+			}
+			if err = writeEnvelope(w, 0, resp); err != nil {
+				log.WithError(err).Info("Failed to send message")
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err == io.EOF {
+			err = nil
+		}
+		if reason := cancel.reason(); reason != nil {
+			err = reason
+		}
+
+		end(err, cs.Trailer())
+	}
+}
+
+// readEnvelope reads an enveloped message from a Connect stream, returning
+// io.EOF if the stream ended cleanly, or errMessageTooLarge (without reading
+// the message) if it's larger than maxSize.
+func readEnvelope(r io.Reader, maxSize int) (byte, []byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err == io.EOF {
+		return 0, nil, io.EOF
+	} else if err != nil {
+		return 0, nil, errors.Wrap(err, "invalid envelope")
+	}
+
+	// The message is read into a pooled buffer, rather than allocating
+	// the (client specified) size up front.
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if int64(size) > int64(maxSize) {
+		return 0, nil, errMessageTooLarge
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := io.CopyN(buf, r, int64(size)); err != nil {
+		return 0, nil, errors.Wrap(err, "truncated message")
+	}
+
+	// Streams may retain messages, so they're copied from the buffer.
+	return prefix[0], append([]byte(nil), buf.Bytes()...), nil
+}
+
+func writeEnvelope(w io.Writer, flags byte, data []byte) error {
+	var prefix [5]byte
+	prefix[0] = flags
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// decompressMessage decompresses a message of a stream, failing with
+// errBodyTooLarge if it exceeds the CompressionConfig.MaxDecompressedSize.
+func (m *Mux) decompressMessage(c Compressor, data []byte) ([]byte, error) {
+	if c == nil {
+		return nil, errors.New("compressed message without an encoding")
+	}
+
+	r, err := c.Decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid compressed message")
+	}
+	defer r.Close()
+
+	max := m.compression.MaxDecompressedSize
+	b, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid compressed message")
+	}
+	if int64(len(b)) > max {
+		return nil, errBodyTooLarge
+	}
+
+	return b, nil
+}
+
+// writeEndStream writes the final message of a Connect stream.
+func writeEndStream(w io.Writer, err error, trailer metadata.MD) error {
+	var msg connectEndStream
+	if err != nil {
+		msg.Error = newConnectError(status.Convert(err))
+	}
+	if len(trailer) > 0 {
+		msg.Metadata = make(map[string][]string, len(trailer))
+		for k, v := range trailer {
+			if strings.HasSuffix(k, "-bin") {
+				encoded := make([]string, len(v))
+				for i := range v {
+					encoded[i] = base64.RawStdEncoding.EncodeToString([]byte(v[i]))
+				}
+				v = encoded
+			}
+			msg.Metadata[k] = v
+		}
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return writeEnvelope(w, connectFlagEndStream, b)
+}
+
+func writeConnectError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(runtime.HTTPStatusFromCode(s.Code()))
+	_ = json.NewEncoder(w).Encode(newConnectError(s))
+}
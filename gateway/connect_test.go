@@ -0,0 +1,315 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestConnect_Unary(t *testing.T) {
+	addr, cleanup := setup(t, WithConnect())
+	defer cleanup()
+
+	url := fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr)
+
+	resp, b := connectRequest(t, url, "application/json", []byte(`{"message":"a","repetitions":2}`), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"message":"aa"}`, string(b))
+
+	req, err := proto.Marshal(&echo.EchoRequest{Message: "b", Repetitions: 3})
+	require.NoError(t, err)
+	resp, b = connectRequest(t, url, "application/proto", req, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/proto", resp.Header.Get("Content-Type"))
+
+	echoResp := &echo.EchoResponse{}
+	require.NoError(t, proto.Unmarshal(b, echoResp))
+	assert.Equal(t, "bbb", echoResp.Message)
+
+	// Requests that aren't using Connect are handled by the gateway.
+	httpResp, err := http.Post(url, "application/proto", bytes.NewReader(req))
+	require.NoError(t, err)
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+}
+
+func TestConnect_UnaryErrors(t *testing.T) {
+	addr, cleanup := setup(t, WithConnect())
+	defer cleanup()
+
+	url := fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr)
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		header      http.Header
+		status      int
+		expected    connectError
+	}{
+		{
+			name:        "status",
+			contentType: "application/json",
+			body:        `{"statusCode":5}`,
+			status:      http.StatusNotFound,
+			expected:    connectError{Code: "not_found", Message: "induce"},
+		},
+		{
+			name:        "invalid json",
+			contentType: "application/json",
+			body:        `{"unknown":1}`,
+			status:      http.StatusBadRequest,
+			expected:    connectError{Code: "invalid_argument"},
+		},
+		{
+			name:        "invalid timeout",
+			contentType: "application/json",
+			body:        `{}`,
+			header:      http.Header{"Connect-Timeout-Ms": []string{"soon"}},
+			status:      http.StatusBadRequest,
+			expected:    connectError{Code: "invalid_argument", Message: `invalid timeout "soon"`},
+		},
+		{
+			name:        "unsupported version",
+			contentType: "application/json",
+			body:        `{}`,
+			header:      http.Header{"Connect-Protocol-Version": []string{"2"}},
+			status:      http.StatusBadRequest,
+			expected:    connectError{Code: "invalid_argument", Message: `unsupported connect protocol version "2"`},
+		},
+	} {
+		resp, b := connectRequest(t, url, tc.contentType, []byte(tc.body), tc.header)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.name)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"), tc.name)
+
+		var actual connectError
+		require.NoError(t, json.Unmarshal(b, &actual), tc.name)
+		assert.Equal(t, tc.expected.Code, actual.Code, tc.name)
+		if tc.expected.Message != "" {
+			assert.Equal(t, tc.expected.Message, actual.Message, tc.name)
+		}
+	}
+
+	resp, _ := connectRequest(t, url, "text/plain", []byte("hello"), nil)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.Equal(t, "application/proto, application/protobuf, application/x-google-protobuf, application/x-protobuf, application/json", resp.Header.Get("Accept-Post"))
+}
+
+func TestConnect_ServerStream(t *testing.T) {
+	addr, cleanup := setup(t, WithConnect())
+	defer cleanup()
+
+	url := fmt.Sprintf("http://%s/api/echo.v1.Echo/EchoStream", addr)
+
+	body := envelope(0, []byte(`{"message":"a","repetitions":2,"responses":2,"interval":"0s"}`))
+	resp, b := connectRequest(t, url, "application/connect+json", body, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/connect+json", resp.Header.Get("Content-Type"))
+
+	msgs, end := readConnectStream(t, bytes.NewReader(b))
+	require.Len(t, msgs, 2)
+	assert.JSONEq(t, `{"message":"aa"}`, string(msgs[0]))
+	assert.JSONEq(t, `{"message":"aa","index":"1"}`, string(msgs[1]))
+	assert.Nil(t, end.Error)
+
+	// Errors are returned in the final message.
+	req, err := proto.Marshal(&echo.EchoStreamRequest{
+		Message:      "b",
+		Responses:    2,
+		Interval:     ptypes.DurationProto(0),
+		StatusCode:   5,
+		FailureIndex: 1,
+	})
+	require.NoError(t, err)
+	resp, b = connectRequest(t, url, "application/connect+proto", envelope(0, req), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	msgs, end = readConnectStream(t, bytes.NewReader(b))
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, &connectError{Code: "not_found", Message: "induced"}, end.Error)
+}
+
+func TestConnect_StreamErrors(t *testing.T) {
+	addr, cleanup := setup(t, WithConnect())
+	defer cleanup()
+
+	url := fmt.Sprintf("http://%s/api/echo.v1.Echo/EchoStream", addr)
+
+	// Streams are bounded by the timeout.
+	body := envelope(0, []byte(`{"message":"a","responses":10,"interval":"0.05s"}`))
+	_, b := connectRequest(t, url, "application/connect+json", body, http.Header{"Connect-Timeout-Ms": []string{"20"}})
+	_, end := readConnectStream(t, bytes.NewReader(b))
+	require.NotNil(t, end.Error)
+	assert.Equal(t, "deadline_exceeded", end.Error.Code)
+
+	// Truncated messages are rejected.
+	body = envelope(0, []byte(`{"message":"a"}`))
+	_, b = connectRequest(t, url, "application/connect+json", body[:len(body)-1], nil)
+	_, end = readConnectStream(t, bytes.NewReader(b))
+	require.NotNil(t, end.Error)
+	assert.Equal(t, "invalid_argument", end.Error.Code)
+
+	// Compressed messages require a supported encoding.
+	_, b = connectRequest(t, url, "application/connect+json", envelope(connectFlagCompressed, []byte("{}")), nil)
+	_, end = readConnectStream(t, bytes.NewReader(b))
+	require.NotNil(t, end.Error)
+	assert.Equal(t, "invalid_argument", end.Error.Code)
+
+	_, b = connectRequest(t, url, "application/connect+json", body, http.Header{"Connect-Content-Encoding": []string{"br"}})
+	_, end = readConnectStream(t, bytes.NewReader(b))
+	require.NotNil(t, end.Error)
+	assert.Equal(t, "unimplemented", end.Error.Code)
+}
+
+func TestConnect_StreamDecompressionLimit(t *testing.T) {
+	addr, cleanup := setup(t, WithConnect(), WithCompression(CompressionConfig{MaxDecompressedSize: 64}))
+	defer cleanup()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(`{"message":"` + strings.Repeat("a", 64) + `"}`))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	url := fmt.Sprintf("http://%s/api/echo.v1.Echo/EchoStream", addr)
+	_, b := connectRequest(t, url, "application/connect+json", envelope(connectFlagCompressed, buf.Bytes()), http.Header{"Connect-Content-Encoding": []string{"gzip"}})
+	_, end := readConnectStream(t, bytes.NewReader(b))
+	require.NotNil(t, end.Error)
+	assert.Equal(t, "resource_exhausted", end.Error.Code)
+}
+
+func TestConnect_Bidi(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			send(<-reqs)
+			send(<-reqs)
+			return nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithConnect()))
+	defer cleanup()
+
+	// Over HTTP/2, responses are received while the request is being sent.
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	r, w := io.Pipe()
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/test.v1.Test/Bidi", addr), r)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/connect+proto")
+
+	go func() {
+		_, _ = w.Write(envelope(0, []byte("a")))
+	}()
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	flags, data := readTestEnvelope(t, resp.Body)
+	assert.Equal(t, byte(0), flags)
+	assert.Equal(t, "a", string(data))
+
+	_, err = w.Write(envelope(0, []byte("b")))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	msgs, end := readConnectStream(t, resp.Body)
+	assert.Equal(t, [][]byte{[]byte("b")}, msgs)
+	assert.Nil(t, end.Error)
+}
+
+func connectRequest(t *testing.T, url, contentType string, body []byte, header http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	if req.Header.Get("Connect-Protocol-Version") == "" {
+		req.Header.Set("Connect-Protocol-Version", "1")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, b
+}
+
+func TestConnect_StreamMessageLimit(t *testing.T) {
+	addr, cleanup := setup(t, WithConnect(), WithConnectMaxMessageSize(64))
+	defer cleanup()
+
+	// Only the header of the (claimed) 4GB message is sent, since it should
+	// be rejected without reading the message.
+	header := []byte{0, 0xff, 0xff, 0xff, 0xff}
+
+	url := fmt.Sprintf("http://%s/api/echo.v1.Echo/EchoStream", addr)
+	for _, body := range [][]byte{header, envelope(0, []byte(`{"message":"`+strings.Repeat("a", 64)+`"}`))} {
+		_, b := connectRequest(t, url, "application/connect+json", body, nil)
+		_, end := readConnectStream(t, bytes.NewReader(b))
+		require.NotNil(t, end.Error)
+		assert.Equal(t, "resource_exhausted", end.Error.Code)
+		assert.Equal(t, "message too large", end.Error.Message)
+	}
+
+	// Messages within the limit are accepted.
+	_, b := connectRequest(t, url, "application/connect+json", envelope(0, []byte(`{"message":"a","repetitions":1,"responses":1,"interval":"0s"}`)), nil)
+	msgs, end := readConnectStream(t, bytes.NewReader(b))
+	assert.Nil(t, end.Error)
+	assert.Len(t, msgs, 1)
+}
+
+func envelope(flags byte, data []byte) []byte {
+	b := make([]byte, 5, 5+len(data))
+	b[0] = flags
+	binary.BigEndian.PutUint32(b[1:], uint32(len(data)))
+	return append(b, data...)
+}
+
+func readTestEnvelope(t *testing.T, r io.Reader) (byte, []byte) {
+	flags, data, err := readEnvelope(r, math.MaxInt32)
+	require.NoError(t, err)
+	return flags, data
+}
+
+// readConnectStream reads the messages of a stream, until its final message.
+func readConnectStream(t *testing.T, r io.Reader) ([][]byte, connectEndStream) {
+	var msgs [][]byte
+	for {
+		flags, data := readTestEnvelope(t, r)
+		if flags&connectFlagEndStream != 0 {
+			var end connectEndStream
+			require.NoError(t, json.Unmarshal(data, &end))
+			return msgs, end
+		}
+
+		msgs = append(msgs, data)
+	}
+}
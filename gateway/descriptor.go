@@ -0,0 +1,466 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const (
+	// descriptorRetryInterval is the time for which a failure to resolve the
+	// descriptors is returned, before they're resolved again.
+	descriptorRetryInterval = 30 * time.Second
+)
+
+// Description is a summary of the services exposed by the gateway.
+type Description struct {
+	Services []ServiceDescription `json:"services"`
+
+	// Messages contains all of the message types used by the
+	// services' methods, including those used by fields.
+	Messages []string `json:"messages"`
+}
+
+// ServiceDescription describes a service exposed by the gateway.
+type ServiceDescription struct {
+	Name    string              `json:"name"`
+	File    string              `json:"file"`
+	Methods []MethodDescription `json:"methods"`
+}
+
+// MethodDescription describes a method exposed by the gateway.
+type MethodDescription struct {
+	Name          string `json:"name"`
+	Path          string `json:"path"`
+	Input         string `json:"input"`
+	Output        string `json:"output"`
+	ClientStreams bool   `json:"client_streams"`
+	ServerStreams bool   `json:"server_streams"`
+}
+
+// WithDescriptorRoutes registers routes describing the services exposed
+// by the gateway under the specified prefix (i.e. `/describe`):
+//
+//	<prefix>/descriptors: the FileDescriptorSet containing the services, encoded
+//	                      as application/proto, or as JSON if accepted by the client.
+//	<prefix>/services:    a JSON Description of the services.
+func WithDescriptorRoutes(prefix string) MuxOption {
+	return func(m *Mux) {
+		m.descriptorPrefix = path.Join("/", prefix)
+	}
+}
+
+// WithDescriptors provides the descriptors of services that are not in the
+// global protobuf registry, such as services that are not served in the same
+// process (see ServicesFromDescriptors).
+func WithDescriptors(set *descriptorpb.FileDescriptorSet) MuxOption {
+	return func(m *Mux) {
+		m.descriptorSet = set
+	}
+}
+
+// WithReflection resolves the descriptors of services that are not in the
+// global protobuf registry using the reflection service of the gRPC server
+// (or backend) that provides them.
+func WithReflection() MuxOption {
+	return func(m *Mux) {
+		m.reflection = true
+	}
+}
+
+// Descriptors returns the FileDescriptorSet containing the services exposed
+// by the gateway, and their dependencies.
+func (m *Mux) Descriptors(ctx context.Context) (*descriptorpb.FileDescriptorSet, error) {
+	d, err := m.descriptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.set, nil
+}
+
+// Describe returns a Description of the services exposed by the gateway.
+func (m *Mux) Describe(ctx context.Context) (*Description, error) {
+	d, err := m.descriptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &Description{}
+	messages := make(map[protoreflect.FullName]bool)
+	for _, service := range m.services() {
+		sd, err := d.service(service)
+		if err != nil {
+			return nil, err
+		}
+
+		s := ServiceDescription{
+			Name: service,
+			File: sd.ParentFile().Path(),
+		}
+		for _, r := range m.routes {
+			if !strings.HasPrefix(r.Method, service+"/") {
+				continue
+			}
+
+			md := sd.Methods().ByName(protoreflect.Name(path.Base(r.Method)))
+			if md == nil {
+				return nil, errors.Errorf("no descriptor for %s", r.Method)
+			}
+
+			s.Methods = append(s.Methods, MethodDescription{
+				Name:          string(md.Name()),
+				Path:          r.Path,
+				Input:         string(md.Input().FullName()),
+				Output:        string(md.Output().FullName()),
+				ClientStreams: md.IsStreamingClient(),
+				ServerStreams: md.IsStreamingServer(),
+			})
+			collectMessages(md.Input(), messages)
+			collectMessages(md.Output(), messages)
+		}
+
+		desc.Services = append(desc.Services, s)
+	}
+
+	for name := range messages {
+		desc.Messages = append(desc.Messages, string(name))
+	}
+	sort.Strings(desc.Messages)
+
+	return desc, nil
+}
+
+func (m *Mux) registerDescriptorRoutes() {
+	if m.descriptorPrefix == "" {
+		return
+	}
+
+	m.router.HandleFunc(path.Join(m.descriptorPrefix, "descriptors"), func(w http.ResponseWriter, req *http.Request) {
+		set, err := m.Descriptors(req.Context())
+		if err != nil {
+			m.log.WithError(err).Warn("Failed to resolve descriptors")
+			http.Error(w, "failed to resolve descriptors", http.StatusInternalServerError)
+			return
+		}
+
+		contentType, mediaType, ok := m.responseMediaType(w, req, mediaTypeProto, mediaTypeJSON)
+		if !ok {
+			return
+		}
+
+		var b []byte
+		if mediaType == mediaTypeJSON {
+			b, err = protojson.Marshal(set)
+		} else {
+			b, err = proto.Marshal(set)
+		}
+		if err != nil {
+			http.Error(w, "failed to marshal descriptors", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(b)
+	})
+	m.router.HandleFunc(path.Join(m.descriptorPrefix, "services"), func(w http.ResponseWriter, req *http.Request) {
+		desc, err := m.Describe(req.Context())
+		if err != nil {
+			m.log.WithError(err).Warn("Failed to resolve descriptors")
+			http.Error(w, "failed to resolve descriptors", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, desc)
+	})
+}
+
+// services returns the names of the services exposed by the gateway.
+func (m *Mux) services() []string {
+	var services []string
+	for _, r := range m.routes {
+		service := path.Dir(r.Method)
+		if len(services) == 0 || services[len(services)-1] != service {
+			services = append(services, service)
+		}
+	}
+
+	return services
+}
+
+type descriptors struct {
+	set   *descriptorpb.FileDescriptorSet
+	files *protoregistry.Files
+}
+
+func (d *descriptors) service(name string) (protoreflect.ServiceDescriptor, error) {
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "no descriptor for %s", name)
+	}
+
+	sd, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, errors.Errorf("%s is not a service", name)
+	}
+
+	return sd, nil
+}
+
+// method returns the descriptor of the specified method (i.e. `echo.v1.Echo/Echo`).
+func (m *Mux) method(ctx context.Context, fullMethod string) (protoreflect.MethodDescriptor, error) {
+	d, err := m.descriptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sd, err := d.service(path.Dir(fullMethod))
+	if err != nil {
+		return nil, err
+	}
+
+	md := sd.Methods().ByName(protoreflect.Name(path.Base(fullMethod)))
+	if md == nil {
+		return nil, errors.Errorf("no descriptor for %s", fullMethod)
+	}
+
+	return md, nil
+}
+
+// idempotencyLevel returns the declared idempotency level of the specified
+// method. Levels are cached, since they're checked on every call of methods
+// that may be retried.
+func (m *Mux) idempotencyLevel(ctx context.Context, fullMethod string) (descriptorpb.MethodOptions_IdempotencyLevel, error) {
+	m.levelMu.Lock()
+	level, ok := m.levels[fullMethod]
+	m.levelMu.Unlock()
+	if ok {
+		return level, nil
+	}
+
+	md, err := m.method(ctx, fullMethod)
+	if err != nil {
+		return descriptorpb.MethodOptions_IDEMPOTENCY_UNKNOWN, err
+	}
+
+	if opts, ok := md.Options().(*descriptorpb.MethodOptions); ok {
+		level = opts.GetIdempotencyLevel()
+	}
+
+	m.levelMu.Lock()
+	defer m.levelMu.Unlock()
+
+	if m.levels == nil {
+		m.levels = make(map[string]descriptorpb.MethodOptions_IdempotencyLevel)
+	}
+	m.levels[fullMethod] = level
+
+	return level, nil
+}
+
+// descriptorResolution is a resolution of the descriptors that concurrent
+// callers wait for.
+type descriptorResolution struct {
+	done chan struct{}
+	desc *descriptors
+	err  error
+
+	// cancelled is whether the resolution failed due to the context of the
+	// caller that made it, in which case its error isn't shared.
+	cancelled bool
+}
+
+// descriptors resolves (and caches) the file descriptors for the services
+// exposed by the gateway.
+//
+// Concurrent calls are coalesced into a single resolution, which is made
+// without holding descMu, so that callers can give up once their context is
+// done. Failures are cached for descriptorRetryInterval, so that requests
+// don't each repeat the reflection calls of a resolution that can't succeed.
+func (m *Mux) descriptors(ctx context.Context) (*descriptors, error) {
+	m.descMu.Lock()
+	if m.desc != nil {
+		m.descMu.Unlock()
+		return m.desc, nil
+	}
+	if m.descErr != nil && time.Now().Before(m.descErrExpires) {
+		m.descMu.Unlock()
+		return nil, m.descErr
+	}
+
+	if r := m.descResolving; r != nil {
+		m.descMu.Unlock()
+
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if r.cancelled {
+			return m.descriptors(ctx)
+		}
+		return r.desc, r.err
+	}
+
+	r := &descriptorResolution{done: make(chan struct{})}
+	m.descResolving = r
+	m.descMu.Unlock()
+
+	r.desc, r.err = m.resolveDescriptors(ctx)
+	r.cancelled = r.err != nil && ctx.Err() != nil
+
+	m.descMu.Lock()
+	m.descResolving = nil
+	if r.err == nil {
+		m.desc = r.desc
+	} else if !r.cancelled {
+		m.descErr = r.err
+		m.descErrExpires = time.Now().Add(descriptorRetryInterval)
+	}
+	m.descMu.Unlock()
+	close(r.done)
+
+	return r.desc, r.err
+}
+
+// resolveDescriptors resolves the file descriptors for the services exposed
+// by the gateway.
+func (m *Mux) resolveDescriptors(ctx context.Context) (*descriptors, error) {
+	protos := make(map[string]*descriptorpb.FileDescriptorProto)
+
+	var provided *protoregistry.Files
+	if m.descriptorSet != nil {
+		var err error
+		if provided, err = protodesc.NewFiles(m.descriptorSet); err != nil {
+			return nil, errors.Wrap(err, "invalid descriptor set")
+		}
+	}
+
+	clients := make(map[*backend]*reflectionClient)
+	defer func() {
+		for _, r := range clients {
+			r.close()
+		}
+	}()
+
+	for _, service := range m.services() {
+		name := protoreflect.FullName(service)
+		if provided != nil {
+			if d, err := provided.FindDescriptorByName(name); err == nil {
+				addFile(protos, d.ParentFile())
+				continue
+			}
+		}
+
+		d, err := protoregistry.GlobalFiles.FindDescriptorByName(name)
+		if err == nil {
+			addFile(protos, d.ParentFile())
+			continue
+		}
+		if !m.reflection {
+			return nil, errors.Wrapf(err, "no descriptor for %s", service)
+		}
+
+		b := m.serviceBackends[service]
+		r, ok := clients[b]
+		if !ok {
+			if r, err = newReflectionClient(ctx, b.cc); err != nil {
+				return nil, err
+			}
+			clients[b] = r
+		}
+		if err := r.resolve(service, protos); err != nil {
+			return nil, err
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{File: sortFiles(protos)}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid descriptors")
+	}
+
+	return &descriptors{set: set, files: files}, nil
+}
+
+func addFile(protos map[string]*descriptorpb.FileDescriptorProto, fd protoreflect.FileDescriptor) {
+	if _, ok := protos[fd.Path()]; ok {
+		return
+	}
+
+	protos[fd.Path()] = protodesc.ToFileDescriptorProto(fd)
+	for i := 0; i < fd.Imports().Len(); i++ {
+		addFile(protos, fd.Imports().Get(i).FileDescriptor)
+	}
+}
+
+func missingDependencies(protos map[string]*descriptorpb.FileDescriptorProto) []string {
+	var missing []string
+	for _, fd := range protos {
+		for _, dep := range fd.GetDependency() {
+			if _, ok := protos[dep]; !ok {
+				missing = append(missing, dep)
+			}
+		}
+	}
+
+	return missing
+}
+
+// sortFiles returns the files in topological order, such that each
+// file comes after its dependencies.
+func sortFiles(protos map[string]*descriptorpb.FileDescriptorProto) []*descriptorpb.FileDescriptorProto {
+	names := make([]string, 0, len(protos))
+	for name := range protos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sorted []*descriptorpb.FileDescriptorProto
+	visited := make(map[string]bool)
+
+	var visit func(name string)
+	visit = func(name string) {
+		fd, ok := protos[name]
+		if !ok || visited[name] {
+			return
+		}
+		visited[name] = true
+
+		for _, dep := range fd.GetDependency() {
+			visit(dep)
+		}
+		sorted = append(sorted, fd)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+
+	return sorted
+}
+
+func collectMessages(md protoreflect.MessageDescriptor, messages map[protoreflect.FullName]bool) {
+	if messages[md.FullName()] {
+		return
+	}
+	messages[md.FullName()] = true
+
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if fd := fields.Get(i); fd.Message() != nil {
+			collectMessages(fd.Message(), messages)
+		}
+	}
+}
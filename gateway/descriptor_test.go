@@ -0,0 +1,330 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestDescriptors_Registry(t *testing.T) {
+	addr, cleanup := setup(t, WithDescriptorRoutes("describe"))
+	defer cleanup()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/describe/descriptors", addr))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/proto", resp.Header.Get("Content-Type"))
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	set := &descriptorpb.FileDescriptorSet{}
+	require.NoError(t, proto.Unmarshal(b, set))
+	assert.Equal(t, []string{"google/protobuf/duration.proto", "examples/echo/echo_service.proto"}, fileNames(set))
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/describe/services", addr))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var desc Description
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&desc))
+	assert.Equal(t, Description{
+		Services: []ServiceDescription{
+			{
+				Name: "echo.v1.Echo",
+				File: "examples/echo/echo_service.proto",
+				Methods: []MethodDescription{
+					{
+						Name:   "Echo",
+						Path:   "/api/echo.v1.Echo/Echo",
+						Input:  "echo.v1.EchoRequest",
+						Output: "echo.v1.EchoResponse",
+					},
+					{
+						Name:          "EchoStream",
+						Path:          "/api/echo.v1.Echo/EchoStream",
+						Input:         "echo.v1.EchoStreamRequest",
+						Output:        "echo.v1.EchoStreamResponse",
+						ServerStreams: true,
+					},
+				},
+			},
+		},
+		Messages: []string{
+			"echo.v1.EchoRequest",
+			"echo.v1.EchoResponse",
+			"echo.v1.EchoStreamRequest",
+			"echo.v1.EchoStreamResponse",
+			"google.protobuf.Duration",
+		},
+	}, desc)
+}
+
+func TestDescriptors_JSON(t *testing.T) {
+	addr, cleanup := setup(t, WithDescriptorRoutes("describe"))
+	defer cleanup()
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/describe/descriptors", addr), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var set struct {
+		File []struct {
+			Name string `json:"name"`
+		} `json:"file"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&set))
+	require.Len(t, set.File, 2)
+	assert.Equal(t, "examples/echo/echo_service.proto", set.File[1].Name)
+}
+
+func TestDescriptors_Unresolved(t *testing.T) {
+	m, cleanup := setupMux(t, registerHidden(t))
+	defer cleanup()
+
+	_, err := m.Descriptors(context.Background())
+	assert.Error(t, err)
+}
+
+func TestDescriptors_Reflection(t *testing.T) {
+	m, cleanup := setupMux(t, registerHidden(t), WithReflection())
+	defer cleanup()
+
+	set, err := m.Descriptors(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, fileNames(set), "hidden/hidden.proto")
+	assert.Contains(t, fileNames(set), "examples/echo/echo_service.proto")
+
+	desc, err := m.Describe(context.Background())
+	require.NoError(t, err)
+
+	var hidden *ServiceDescription
+	for i := range desc.Services {
+		if desc.Services[i].Name == "hidden.v1.Hidden" {
+			hidden = &desc.Services[i]
+		}
+	}
+	require.NotNil(t, hidden)
+	assert.Equal(t, []MethodDescription{
+		{
+			Name:   "Ping",
+			Path:   "/api/hidden.v1.Hidden/Ping",
+			Input:  "hidden.v1.Ping",
+			Output: "hidden.v1.Ping",
+		},
+	}, hidden.Methods)
+	assert.Contains(t, desc.Messages, "google.protobuf.Duration")
+}
+
+// registerHidden registers the echo service, and a service that is not in
+// the global registry, but is available via reflection.
+func registerHidden(t *testing.T) func(s *grpc.Server) {
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("hidden/hidden.proto"),
+		Package:    proto.String("hidden.v1"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/duration.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Ping"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{
+						Name:     proto.String("delay"),
+						JsonName: proto.String("delay"),
+						Number:   proto.Int32(1),
+						Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+						TypeName: proto.String(".google.protobuf.Duration"),
+					},
+				},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{
+				Name: proto.String("Hidden"),
+				Method: []*descriptorpb.MethodDescriptorProto{
+					{
+						Name:       proto.String("Ping"),
+						InputType:  proto.String(".hidden.v1.Ping"),
+						OutputType: proto.String(".hidden.v1.Ping"),
+					},
+				},
+			},
+		},
+	}, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+
+	files := &protoregistry.Files{}
+	require.NoError(t, files.RegisterFile(durationpb.File_google_protobuf_duration_proto))
+	require.NoError(t, files.RegisterFile(fd))
+
+	return func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, &serv{})
+		s.RegisterService(&grpc.ServiceDesc{
+			ServiceName: "hidden.v1.Hidden",
+			HandlerType: (*interface{})(nil),
+			Methods: []grpc.MethodDesc{
+				{
+					MethodName: "Ping",
+					Handler: func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+						return nil, status.Error(codes.Unimplemented, "")
+					},
+				},
+			},
+		}, struct{}{})
+		reflectionpb.RegisterServerReflectionServer(s, reflection.NewServerV1(reflection.ServerOptions{
+			Services:           s,
+			DescriptorResolver: files,
+		}))
+	}
+}
+
+func fileNames(set *descriptorpb.FileDescriptorSet) []string {
+	var names []string
+	for _, fd := range set.File {
+		names = append(names, fd.GetName())
+	}
+
+	return names
+}
+
+func TestDescriptors_ReflectionMissingDependency(t *testing.T) {
+	m, cleanup := setupMux(t, func(s *grpc.Server) {
+		s.RegisterService(&grpc.ServiceDesc{
+			ServiceName: "hidden.v1.Hidden",
+			HandlerType: (*interface{})(nil),
+			Streams:     []grpc.StreamDesc{{StreamName: "Ping", ServerStreams: true}},
+		}, struct{}{})
+		reflectionpb.RegisterServerReflectionServer(s, &missingReflectionServer{})
+	}, WithReflection())
+	defer cleanup()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := m.Descriptors(context.Background())
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "missing/missing.proto")
+	case <-time.After(5 * time.Second):
+		t.Fatal("resolving descriptors didn't finish")
+	}
+}
+
+func TestDescriptors_ReflectionFailureCached(t *testing.T) {
+	reflectionServer := &missingReflectionServer{}
+	m, cleanup := setupMux(t, func(s *grpc.Server) {
+		s.RegisterService(&grpc.ServiceDesc{
+			ServiceName: "hidden.v1.Hidden",
+			HandlerType: (*interface{})(nil),
+			Streams:     []grpc.StreamDesc{{StreamName: "Ping", ServerStreams: true}},
+		}, struct{}{})
+		reflectionpb.RegisterServerReflectionServer(s, reflectionServer)
+	}, WithReflection())
+	defer cleanup()
+
+	// Concurrent calls are coalesced, and the failure is cached.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Descriptors(context.Background())
+			assert.Error(t, err)
+		}()
+	}
+	wg.Wait()
+
+	_, err := m.Descriptors(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reflectionServer.resolved))
+
+	// Once the failure expires, the descriptors are resolved again.
+	m.descMu.Lock()
+	m.descErrExpires = time.Now()
+	m.descMu.Unlock()
+
+	_, err = m.Descriptors(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reflectionServer.resolved))
+}
+
+// missingReflectionServer is a reflection server that provides a file, but
+// never its dependency.
+type missingReflectionServer struct {
+	reflectionpb.UnimplementedServerReflectionServer
+
+	// resolved is the number of times the file was requested.
+	resolved int32
+}
+
+func (s *missingReflectionServer) ServerReflectionInfo(stream reflectionpb.ServerReflection_ServerReflectionInfoServer) error {
+	hidden, err := proto.Marshal(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("hidden/hidden.proto"),
+		Package:    proto.String("hidden.v1"),
+		Dependency: []string{"missing/missing.proto"},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		resp := &reflectionpb.ServerReflectionResponse{}
+		switch req.MessageRequest.(type) {
+		case *reflectionpb.ServerReflectionRequest_ListServices:
+			resp.MessageResponse = &reflectionpb.ServerReflectionResponse_ListServicesResponse{
+				ListServicesResponse: &reflectionpb.ListServiceResponse{
+					Service: []*reflectionpb.ServiceResponse{{Name: "hidden.v1.Hidden"}},
+				},
+			}
+		case *reflectionpb.ServerReflectionRequest_FileContainingSymbol:
+			atomic.AddInt32(&s.resolved, 1)
+			resp.MessageResponse = &reflectionpb.ServerReflectionResponse_FileDescriptorResponse{
+				FileDescriptorResponse: &reflectionpb.FileDescriptorResponse{FileDescriptorProto: [][]byte{hidden}},
+			}
+		default:
+			// The dependency is "found", but no files are returned.
+			resp.MessageResponse = &reflectionpb.ServerReflectionResponse_FileDescriptorResponse{
+				FileDescriptorResponse: &reflectionpb.FileDescriptorResponse{},
+			}
+		}
+
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
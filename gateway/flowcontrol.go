@@ -0,0 +1,264 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FlowControlSubprotocol is the websocket subprotocol that clients offer to use
+// credit-based flow control (see FlowControlConfig.Credits).
+const FlowControlSubprotocol = "grpc-over-http.flow.v1"
+
+const (
+	defaultQueueSize      = 16
+	defaultInitialCredits = 16
+
+	// The types of framed messages, which are used by clients using credit-based
+	// flow control, and for resumable streams (see WithResumableStreams).
+	frameMessage      = 0
+	frameWindowUpdate = 1
+)
+
+var (
+	errSendQueueFull    = status.Error(codes.ResourceExhausted, "send queue full")
+	errReceiveQueueFull = status.Error(codes.ResourceExhausted, "receive queue full")
+)
+
+// OverflowPolicy determines what happens when a stream's queue is full, which
+// occurs when the consumer (either the client or the server) falls behind.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the producer until the queue has room, propagating
+	// the backpressure to it (i.e. via TCP or HTTP/2 flow control).
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest queued message to make room, which
+	// suits streams of updates where only the latest state matters.
+	OverflowDropOldest
+
+	// OverflowClose closes the stream with ResourceExhausted.
+	OverflowClose
+)
+
+// FlowControlConfig configures the flow control of streams, which is bounded by
+// a queue in each direction.
+type FlowControlConfig struct {
+	// SendQueueSize is the number of messages from the server that are queued
+	// to be sent to the client. If zero, a default of 16 is used.
+	SendQueueSize int
+
+	// ReceiveQueueSize is the number of messages from the client that are
+	// queued to be sent to the server. If zero, a default of 16 is used.
+	ReceiveQueueSize int
+
+	// Policy is applied when either queue is full.
+	Policy OverflowPolicy
+
+	// Credits allows clients that offer the FlowControlSubprotocol to limit
+	// the messages that are sent to them with window updates. Each message
+	// sent to the client consumes a credit, and messages are queued while the
+	// client has no credits.
+	//
+	// Using the subprotocol, every binary message sent by the client is prefixed
+	// with a frame type: 0 for a message (followed by the message), or 1 for a
+	// window update (followed by the number of credits to add, as a big endian
+	// uint32). Text messages, and messages sent to the client, are unchanged.
+	Credits bool
+
+	// InitialCredits is the number of credits clients start with. If zero, a
+	// default of 16 is used.
+	InitialCredits int
+}
+
+// WithFlowControl configures the flow control of streams. By default, streams
+// are unbuffered, and block in both directions.
+func WithFlowControl(config FlowControlConfig) MuxOption {
+	return func(m *Mux) {
+		if config.SendQueueSize <= 0 {
+			config.SendQueueSize = defaultQueueSize
+		}
+		if config.ReceiveQueueSize <= 0 {
+			config.ReceiveQueueSize = defaultQueueSize
+		}
+		if config.InitialCredits <= 0 {
+			config.InitialCredits = defaultInitialCredits
+		}
+
+		m.flowControl = &config
+	}
+}
+
+// streamFlow is the flow control of a single stream.
+type streamFlow struct {
+	policy OverflowPolicy
+	send   chan []byte
+	recv   chan []byte
+
+	// window is nil if the client isn't using credits.
+	window *window
+}
+
+func (m *Mux) newStreamFlow(ws *websocket.Conn) *streamFlow {
+	if m.flowControl == nil {
+		return &streamFlow{
+			send: make(chan []byte),
+			recv: make(chan []byte),
+		}
+	}
+
+	f := &streamFlow{
+		policy: m.flowControl.Policy,
+		send:   make(chan []byte, m.flowControl.SendQueueSize),
+		recv:   make(chan []byte, m.flowControl.ReceiveQueueSize),
+	}
+	if m.flowControl.Credits && ws.Subprotocol() == FlowControlSubprotocol {
+		f.window = newWindow(m.flowControl.InitialCredits)
+	}
+
+	return f
+}
+
+// received handles a frame from the client, returning the message it contains,
+// if any. Only binary messages are framed.
+func (f *streamFlow) received(messageType int, data []byte) ([]byte, error) {
+	if f.window == nil || messageType != websocket.BinaryMessage {
+		return data, nil
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty frame")
+	}
+
+	switch data[0] {
+	case frameMessage:
+		return data[1:], nil
+	case frameWindowUpdate:
+		if len(data) != 5 {
+			return nil, errors.New("invalid window update")
+		}
+
+		f.window.add(int64(binary.BigEndian.Uint32(data[1:])))
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unknown frame type %d", data[0])
+	}
+}
+
+// enqueue adds a message to the queue, applying the overflow policy if it's full.
+func (f *streamFlow) enqueue(ctx context.Context, q chan []byte, msg []byte, errFull error) error {
+	select {
+	case q <- msg:
+		return nil
+	default:
+	}
+
+	switch f.policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case q <- msg:
+				return nil
+			default:
+			}
+
+			// Note: the consumer may have emptied the queue in the
+			// meantime, in which case there's nothing to drop.
+			select {
+			case <-q:
+			default:
+			}
+		}
+	case OverflowClose:
+		// Unbuffered queues have no room to overflow, so they always block.
+		if cap(q) > 0 {
+			return errFull
+		}
+	}
+
+	select {
+	case q <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// window tracks the credits of a client.
+type window struct {
+	mu      sync.Mutex
+	credits int64
+	updated chan struct{}
+}
+
+func newWindow(credits int) *window {
+	return &window{
+		credits: int64(credits),
+		updated: make(chan struct{}, 1),
+	}
+}
+
+// acquire consumes a credit, waiting for one if necessary. If there's no window,
+// it returns immediately.
+func (w *window) acquire(ctx context.Context) error {
+	if w == nil {
+		return nil
+	}
+
+	for {
+		w.mu.Lock()
+		if w.credits > 0 {
+			w.credits--
+			w.mu.Unlock()
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *window) add(credits int64) {
+	w.mu.Lock()
+	w.credits += credits
+	w.mu.Unlock()
+
+	select {
+	case w.updated <- struct{}{}:
+	default:
+	}
+}
+
+// streamCancel cancels a stream, recording the reason, so that the stream can
+// be closed with the reason, rather than Canceled.
+type streamCancel struct {
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *streamCancel) cancelWith(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	c.cancel()
+}
+
+func (c *streamCancel) reason() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
@@ -0,0 +1,205 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestFlowControl_Credits(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			for i := 0; i < 5; i++ {
+				send([]byte(fmt.Sprint(i)))
+			}
+			send(<-reqs)
+			return nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithFlowControl(FlowControlConfig{
+		Credits:        true,
+		InitialCredits: 2,
+	})))
+	defer cleanup()
+
+	conn, resp, err := (&websocket.Dialer{Subprotocols: []string{FlowControlSubprotocol}}).Dial(
+		fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil,
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, FlowControlSubprotocol, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	msgs := make(chan string, 16)
+	closeErr := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				closeErr <- err
+				return
+			}
+			msgs <- string(data)
+		}
+	}()
+
+	// Only the initial credits are consumed until the client grants more.
+	assert.Equal(t, []string{"0", "1"}, receiveN(t, msgs, 2))
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, msgs, 0)
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, windowUpdate(4)))
+	assert.Equal(t, []string{"2", "3", "4"}, receiveN(t, msgs, 3))
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("\x00hello")))
+	assert.Equal(t, []string{"hello"}, receiveN(t, msgs, 1))
+	assert.True(t, websocket.IsCloseError(<-closeErr, websocket.CloseNormalClosure))
+
+	calls := cc.recorded()
+	require.Len(t, calls, 1)
+	assert.Equal(t, [][]byte{[]byte("hello")}, calls[0].reqs)
+}
+
+func TestFlowControl_InvalidFrame(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			<-reqs
+			return nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithFlowControl(FlowControlConfig{Credits: true})))
+	defer cleanup()
+
+	conn, _, err := (&websocket.Dialer{Subprotocols: []string{FlowControlSubprotocol}}).Dial(
+		fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil,
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("\x07")))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.InvalidArgument)), err)
+}
+
+func TestFlowControl_NoSubprotocol(t *testing.T) {
+	addr, cleanup := serveMux(t, New(fakeServices, echoConn{}, WithFlowControl(FlowControlConfig{Credits: true})))
+	defer cleanup()
+
+	// Clients that don't offer the subprotocol send and receive plain messages.
+	conn, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	for i := 0; i < 2*defaultInitialCredits; i++ {
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("\x00a")))
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "\x00a", string(data))
+	}
+}
+
+func TestFlowControl_SendQueueFull(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			for i := 0; i < 5; i++ {
+				send([]byte(fmt.Sprint(i)))
+			}
+			<-reqs
+			return nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithFlowControl(FlowControlConfig{
+		SendQueueSize:  1,
+		Policy:         OverflowClose,
+		Credits:        true,
+		InitialCredits: 1,
+	})))
+	defer cleanup()
+
+	conn, _, err := (&websocket.Dialer{Subprotocols: []string{FlowControlSubprotocol}}).Dial(
+		fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil,
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The client doesn't grant any more credits, so the queue overflows.
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			assert.True(t, websocket.IsCloseError(err, 4000+int(codes.ResourceExhausted)), err)
+			assert.Contains(t, err.Error(), "send queue full")
+			break
+		}
+	}
+}
+
+func TestFlowControl_Enqueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Messages are dropped from the front of the queue.
+	f := &streamFlow{policy: OverflowDropOldest}
+	q := make(chan []byte, 2)
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, f.enqueue(ctx, q, []byte(msg), errSendQueueFull))
+	}
+	assert.Equal(t, "c", string(<-q))
+	assert.Equal(t, "d", string(<-q))
+
+	f = &streamFlow{policy: OverflowClose}
+	require.NoError(t, f.enqueue(ctx, q, []byte("a"), errSendQueueFull))
+	require.NoError(t, f.enqueue(ctx, q, []byte("b"), errSendQueueFull))
+	assert.Equal(t, errSendQueueFull, f.enqueue(ctx, q, []byte("c"), errSendQueueFull))
+
+	// Blocked producers are released when the stream is cancelled.
+	f = &streamFlow{policy: OverflowBlock}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f.enqueue(ctx, q, []byte("c"), errSendQueueFull)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errCh)
+}
+
+func TestFlowControl_Subprotocols(t *testing.T) {
+	m := New(fakeServices, echoConn{}, WithFlowControl(FlowControlConfig{Credits: true}))
+
+	req := &http.Request{Header: http.Header{}}
+	req.Header.Set("Sec-WebSocket-Protocol", "other, "+FlowControlSubprotocol)
+	assert.Equal(t, FlowControlSubprotocol, m.subprotocolHeader(req, nil).Get("Sec-WebSocket-Protocol"))
+
+	// Upgraders with subprotocols select them themselves.
+	m = New(fakeServices, echoConn{},
+		WithUpgrader(websocket.Upgrader{Subprotocols: []string{FlowControlSubprotocol}}),
+		WithFlowControl(FlowControlConfig{Credits: true}),
+	)
+	assert.Nil(t, m.subprotocolHeader(req, nil))
+}
+
+func windowUpdate(credits uint32) []byte {
+	b := []byte{frameWindowUpdate, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], credits)
+	return b
+}
+
+func receiveN(t *testing.T, msgs <-chan string, n int) []string {
+	var received []string
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-msgs:
+			received = append(received, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d messages", len(received), n)
+		}
+	}
+	return received
+}
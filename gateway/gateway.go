@@ -1,21 +1,25 @@
 package gateway
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 var (
@@ -48,13 +52,103 @@ func WithRouter(router *mux.Router) MuxOption {
 	}
 }
 
+// WithPathPrefix sets the path prefix of the method routes. By default,
+// methods are served under `/api`.
+func WithPathPrefix(prefix string) MuxOption {
+	return func(m *Mux) {
+		m.pathPrefix = path.Join("/", prefix)
+	}
+}
+
+// unaryMethod is a unary method exposed by the gateway.
+type unaryMethod struct {
+	cc      grpc.ClientConnInterface
+	limiter *limiter
+}
+
 // Mux serves HTTP and Websocket endpoints that re-routes
 type Mux struct {
 	log *logrus.Entry
 
-	cc       *grpc.ClientConn
-	router   *mux.Router
-	upgrader websocket.Upgrader
+	backends        []*backend
+	serviceBackends map[string]*backend
+	unaryMethods    map[string]*unaryMethod
+
+	router     *mux.Router
+	upgrader   websocket.Upgrader
+	pathPrefix string
+
+	mediaTypeAliases map[string]string
+
+	forwardedHeaders []string
+	streamAuth       []StreamAuth
+
+	clientKey        ClientKeyFunc
+	rateLimit        *RateLimit
+	methodRateLimits map[string]RateLimit
+	methodLimiters   map[string]*limiter
+	defaultLimiter   *limiter
+
+	cachePolicies    map[string]CachePolicy
+	idempotentPolicy *CachePolicy
+
+	responseCacheConfig ResponseCacheConfig
+	cachedMethods       map[string]time.Duration
+	responseCache       *responseCache
+
+	routes        []Route
+	adminPrefix   string
+	healthService *string
+
+	descriptorPrefix string
+	descriptorSet    *descriptorpb.FileDescriptorSet
+	reflection       bool
+	descMu           sync.Mutex
+	desc             *descriptors
+	descErr          error
+	descErrExpires   time.Time
+	descResolving    *descriptorResolution
+	levelMu          sync.Mutex
+	levels           map[string]descriptorpb.MethodOptions_IdempotencyLevel
+
+	openAPIRoute string
+	openAPIInfo  OpenAPIInfo
+
+	batchRoute  string
+	batchConfig BatchConfig
+
+	compression   *CompressionConfig
+	wsCompression *websocketCompression
+	keepalive     *KeepaliveConfig
+	flowControl   *FlowControlConfig
+
+	resume      *ResumeConfig
+	resumableMu sync.Mutex
+	resumable   map[string]*resumableStream
+
+	longPollRoute  string
+	longPollConfig LongPollConfig
+	pollSessionsMu sync.Mutex
+	pollSessions   map[string]*pollSession
+
+	grpcPassthrough    bool
+	grpcServer         *grpc.Server
+	passthroughMethods map[string]*passthroughMethod
+
+	connect               bool
+	connectMaxMessageSize int
+
+	retryPolicies         map[string]RetryPolicy
+	idempotentRetryPolicy *RetryPolicy
+	retryBudgetConfig     RetryBudget
+	retryBudget           *retryBudget
+	retryStats            *RetryStats
+	retryWarnMu           sync.Mutex
+	retryWarned           map[string]bool
+
+	circuitBreaker        *CircuitBreaker
+	methodCircuitBreakers map[string]CircuitBreaker
+	breakers              map[string]*breaker
 }
 
 // New creates a new Mux that loads all registered services in the gRPC
@@ -62,35 +156,103 @@ type Mux struct {
 //
 // Unary requests are set up as basic HTTP/1.1 requests.
 // Streaming requests are set up as Websocket connections.
-func New(serv *grpc.Server, cc *grpc.ClientConn, opts ...MuxOption) *Mux {
+//
+// Typically, serv is the *grpc.Server that cc is connected to. Services that
+// are served elsewhere can be exposed using Services. cc may be any connection
+// (i.e. a *grpc.ClientConn, or one wrapped with interceptors), as long as it
+// sends and receives raw bytes (see BinaryCodec). Additional backends can
+// be provided using WithBackend, in which case serv may be nil.
+//
+// Unary requests are passed to cc in pooled buffers, which are reused once
+// Invoke returns, so cc (and its interceptors) must not retain the request
+// after returning.
+func New(serv ServiceInfoProvider, cc grpc.ClientConnInterface, opts ...MuxOption) *Mux {
 	// todo: mux options
 	m := &Mux{
 		log:    logrus.WithField("type", "gateway/mux"),
-		cc:     cc,
 		router: mux.NewRouter(),
 		upgrader: websocket.Upgrader{
 			HandshakeTimeout: 0,
 			ReadBufferSize:   1024,
 			WriteBufferSize:  1024,
 		},
+		pathPrefix:       "/api",
+		forwardedHeaders: defaultForwardedHeaders,
+		clientKey:        ClientIP,
+		mediaTypeAliases: copyMediaTypeAliases(defaultMediaTypeAliases),
+		retryStats:       &RetryStats{},
+	}
+
+	if serv != nil {
+		m.backends = append(m.backends, &backend{serv: serv, cc: cc})
 	}
 
 	for _, o := range opts {
 		o(m)
 	}
 
-	for service, info := range serv.GetServiceInfo() {
-		for _, method := range info.Methods {
-			fullMethod := fmt.Sprintf("%s/%s", service, method.Name)
-			httpPath := path.Join("/api", fullMethod)
+	// Similar to registering a service twice with a *grpc.Server, conflicting
+	// backends are a programming (or configuration) error.
+	if err := m.assignServices(); err != nil {
+		panic(fmt.Sprintf("gateway: %v", err))
+	}
+
+	if m.wsCompression != nil {
+		m.upgrader.EnableCompression = true
+	}
+	if len(m.cachedMethods) > 0 {
+		m.responseCache = newResponseCache(m.responseCacheConfig)
+	}
+	if m.retriesEnabled() {
+		m.retryBudget = newRetryBudget(m.retryBudgetConfig)
+	}
+
+	m.unaryMethods = make(map[string]*unaryMethod)
+
+	for _, b := range m.backends {
+		for service, info := range b.serv.GetServiceInfo() {
+			for _, method := range info.Methods {
+				fullMethod := fmt.Sprintf("%s/%s", service, method.Name)
+				httpPath := path.Join(m.pathPrefix, fullMethod)
+				cc := m.breakerConn(fullMethod, b.cc)
+
+				if method.IsServerStream || method.IsClientStream {
+					if m.connect {
+						m.router.HandleFunc(httpPath, m.connectStreamHandler(fullMethod, cc)).MatcherFunc(isConnectStreamRequest)
+					}
+					m.router.HandleFunc(httpPath, m.streamHandler(fullMethod, cc))
+					if m.longPollRoute != "" {
+						m.router.HandleFunc(path.Join(m.longPollRoute, fullMethod), m.longPollHandler(fullMethod, cc))
+					}
+				} else {
+					u := &unaryMethod{cc: cc, limiter: m.limiter(fullMethod)}
+					m.unaryMethods[fullMethod] = u
+					if m.connect {
+						m.router.HandleFunc(httpPath, m.connectUnaryHandler(fullMethod, u)).MatcherFunc(isConnectUnaryRequest)
+					}
+					m.router.HandleFunc(httpPath, m.unaryHandler(fullMethod, u))
+				}
 
-			if method.IsServerStream || method.IsClientStream {
-				m.router.HandleFunc(httpPath, m.streamHandler(fullMethod))
-			} else {
-				m.router.HandleFunc(httpPath, m.unaryHandler(fullMethod))
+				m.routes = append(m.routes, Route{
+					Path:          httpPath,
+					Method:        fullMethod,
+					Streaming:     method.IsServerStream || method.IsClientStream,
+					ClientStreams: method.IsClientStream,
+					ServerStreams: method.IsServerStream,
+				})
 			}
 		}
 	}
+	sort.Slice(m.routes, func(i, j int) bool {
+		return m.routes[i].Path < m.routes[j].Path
+	})
+
+	m.configurePassthrough(serv)
+	m.registerAdminRoutes()
+	m.registerDescriptorRoutes()
+	m.registerOpenAPIRoute()
+	m.registerBatchRoute()
+	m.registerLongPollRoutes()
 
 	return m
 }
@@ -98,35 +260,84 @@ func New(serv *grpc.Server, cc *grpc.ClientConn, opts ...MuxOption) *Mux {
 // ServeHTTP serves HTTP on the provided listener, forwarding requests
 // to the gRPC server.
 func (m *Mux) ServeHTTP(l net.Listener) error {
-	return http.Serve(l, m.router)
+	return http.Serve(l, m.handler())
 }
 
 // ServeHTTP listens on the specified address, and forwards requests
 // to the gRPC server.
 func (m *Mux) ListenAndServeHTTP(listenAddr string) error {
-	return http.ListenAndServe(listenAddr, m.router)
+	return http.ListenAndServe(listenAddr, m.handler())
 }
 
-func (m *Mux) unaryHandler(fullMethod string) http.HandlerFunc {
+func (m *Mux) unaryHandler(fullMethod string, u *unaryMethod) http.HandlerFunc {
 	log := m.log.WithFields(logrus.Fields{
 		"method":    fullMethod,
 		"streaming": "false",
 	})
+	limiter := u.limiter
 
-	// todo: proper header propagation
 	return func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "POST" {
+		var policy *CachePolicy
+		if req.Method == "GET" {
+			policy = m.cachePolicy(req.Context(), fullMethod)
+		}
+
+		if req.Method != "POST" && policy == nil {
 			http.Error(w, "", http.StatusMethodNotAllowed)
 			return
 		}
-		if req.Header.Get("Content-type") != "application/proto" {
-			http.Error(w, "", http.StatusBadRequest)
+		if policy == nil {
+			if _, ok := m.requestMediaType(w, req, mediaTypeProto); !ok {
+				return
+			}
+		}
+		mediaType, _, ok := m.responseMediaType(w, req, mediaTypeProto)
+		if !ok {
 			return
 		}
+		if limiter != nil {
+			if ok, retryAfter := limiter.allow(m.clientKey(req), time.Now()); !ok {
+				w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
 
-		b, err := ioutil.ReadAll(req.Body)
-		req.Body.Close()
-		if err != nil {
+		if policy != nil {
+			b, err := m.queryRequest(req.Context(), req, fullMethod)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			resp, ok := m.invoke(w, req, u.cc, fullMethod, b)
+			if !ok {
+				return
+			}
+
+			w.Header().Set("Content-Type", mediaType)
+			body, encoding := m.compressResponse(w, req, resp)
+			if err := writeCacheable(w, req, policy, resp, body, encoding); err != nil {
+				log.WithError(err).Info("Failed to send response")
+			}
+			return
+		}
+
+		body, err := m.requestBody(req)
+		if err == errUnsupportedEncoding {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		buf, err := readBody(body, req.ContentLength)
+		body.Close()
+		if err == errBodyTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
 			// The two primary sources of errors are:
 			//
 			//     1. Client side connection closed / issues, or
@@ -140,111 +351,241 @@ func (m *Mux) unaryHandler(fullMethod string) http.HandlerFunc {
 			return
 		}
 
-		resp := new([]byte)
-		if err = m.cc.Invoke(req.Context(), fullMethod, b, resp); err != nil {
-			s, ok := status.FromError(err)
-			if !ok {
-				// In this case, the gateway setup has likely been mis-configured.
-				http.Error(w, "gateway error", http.StatusBadGateway)
-				return
-			}
+		defer putBuffer(buf)
 
-			http.Error(w, s.Message(), runtime.HTTPStatusFromCode(s.Code()))
+		resp, ok := m.invoke(w, req, u.cc, fullMethod, buf.Bytes())
+		if !ok {
 			return
 		}
 
-		if n, err := io.Copy(w, bytes.NewBuffer(*resp)); err != nil {
+		w.Header().Set("Content-Type", mediaType)
+		resp, _ = m.compressResponse(w, req, resp)
+		w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+		if n, err := w.Write(resp); err != nil {
 			// Note: we _probably_ don't need to send back an error here, since the
 			// connection is most likely dead
-			log.WithError(err).Infof("Failed to send response (%d/%d transferred)", n, len(*resp))
+			log.WithError(err).Infof("Failed to send response (%d/%d transferred)", n, len(resp))
+		}
+	}
+}
+
+// invoke forwards a unary request, writing an error response if it fails.
+func (m *Mux) invoke(w http.ResponseWriter, req *http.Request, cc grpc.ClientConnInterface, fullMethod string, b []byte) ([]byte, bool) {
+	ctx, attempts := withAttempts(m.outgoingContext(req, req.Header))
+	resp, err := m.call(ctx, cc, fullMethod, b)
+	setAttemptsHeader(w.Header(), attempts)
+	if err != nil {
+		s, ok := status.FromError(err)
+		if !ok {
+			// In this case, the gateway setup has likely been mis-configured.
+			http.Error(w, "gateway error", http.StatusBadGateway)
+			return nil, false
 		}
+
+		http.Error(w, s.Message(), runtime.HTTPStatusFromCode(s.Code()))
+		return nil, false
 	}
+
+	return resp, true
 }
 
-func (m *Mux) streamHandler(fullMethod string) http.HandlerFunc {
+func (m *Mux) streamHandler(fullMethod string, cc grpc.ClientConnInterface) http.HandlerFunc {
 	log := m.log.WithFields(logrus.Fields{
 		"method":    fullMethod,
 		"streaming": "true",
 	})
+	limiter := m.limiter(fullMethod)
 
-	// todo: proper header propagation
 	return func(w http.ResponseWriter, req *http.Request) {
-		ws, err := m.upgrader.Upgrade(w, req, nil)
+		header, respHeader, firstMessage := m.streamCredentials(req)
+
+		respHeader = m.subprotocolHeader(req, respHeader)
+		ws, err := m.upgrader.Upgrade(w, req, respHeader)
 		if err != nil {
 			log.WithError(err).Info("Failed to upgrade connection")
 			return
 		}
 		defer ws.Close()
 
-		streamCtx, cancelFunc := context.WithCancel(req.Context())
+		if err := m.wsCompression.configure(ws); err != nil {
+			log.WithError(err).Warn("Failed to configure compression")
+		}
+
+		if limiter != nil {
+			key := m.clientKey(req)
+			if ok, _ := limiter.allow(key, time.Now()); !ok {
+				writeCloseStatus(ws, log, status.Error(codes.ResourceExhausted, "rate limit exceeded"))
+				return
+			}
+			if !limiter.acquireStream(key) {
+				writeCloseStatus(ws, log, status.Error(codes.ResourceExhausted, "too many streams"))
+				return
+			}
+			defer limiter.releaseStream(key)
+		}
+
+		if firstMessage != nil {
+			token, err := readAuthMessage(ws, firstMessage)
+			if err != nil || token == "" {
+				log.WithError(err).Debug("Failed to read auth message")
+				writeCloseStatus(ws, log, status.Error(codes.Unauthenticated, "missing credentials"))
+				return
+			}
+
+			header = withBearer(header, token)
+		}
+
+		if m.serveResumable(ws, req, header, cc, fullMethod, log) {
+			return
+		}
+
+		streamCtx, cancelFunc := context.WithCancel(m.outgoingContext(req, header))
 		defer cancelFunc()
-		cs, err := m.cc.NewStream(streamCtx, streamDesc, fullMethod)
+		cancel := &streamCancel{cancel: cancelFunc}
+		keepalive := m.startKeepalive(ws, cancel)
+		defer keepalive.stop()
+
+		cs, err := cc.NewStream(streamCtx, streamDesc, "/"+fullMethod)
 		if err != nil {
 			log.WithError(err).Warn("Failed to initialize grpc stream")
-			if err := ws.WriteMessage(
-				websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""),
-			); err != nil {
-				log.WithError(err).Warn("Failed to write close message")
-			}
+			writeCloseStatus(ws, log, err)
 			return
 		}
 
+		// Messages in each direction are passed through a queue (see WithFlowControl),
+		// so that the producer only blocks (or overflows) when the consumer falls behind.
+		flow := m.newStreamFlow(ws)
+		messages := m.newStreamMessages(streamCtx, ws, fullMethod)
+
 		// note: we put the read loop in a separate goroutine rather than the write loop
 		// because clients have no way of performing a CloseSend() equivalent.
-		readErrCh := make(chan error, 1)
 		go func() {
-			defer close(readErrCh)
+			defer close(flow.recv)
 
 			for {
-				_, data, err := ws.ReadMessage()
+				messageType, data, err := readMessage(ws)
 				if err != nil {
 					// Reads from clients tend to be a connection issue, in which case
-					// sending back an error doesn't usually make it back. However, if
-					// there was a server error (i.e. failed to allocate enough memory
-					// for the read), then it's a server error.
-					//
-					// Since sending back client type errors won't likely make it back,
-					// we just treat it as an server error. Practically, this just means
-					// we don't have to differentiate between errors here.
-					readErrCh <- err
+					// sending back an error doesn't usually make it back, so we simply
+					// stop reading. The stream is torn down once it finishes, or fails
+					// to write to the client (or expires, see WithWebsocketKeepalive).
+					keepalive.readFailed(err)
+					return
+				}
+				keepalive.received()
+
+				data, err = flow.received(messageType, data)
+				if err != nil {
+					cancel.cancelWith(status.Error(codes.InvalidArgument, err.Error()))
+					return
+				}
+				if data == nil {
+					continue
+				}
+
+				data, err = messages.decode(messageType, data)
+				if err != nil {
+					cancel.cancelWith(status.Error(codes.InvalidArgument, err.Error()))
+					return
+				}
+
+				if err := flow.enqueue(streamCtx, flow.recv, data, errReceiveQueueFull); err != nil {
+					cancel.cancelWith(err)
 					return
 				}
+			}
+		}()
 
+		go func() {
+			for data := range flow.recv {
 				if err := cs.SendMsg(data); err != nil {
-					readErrCh <- err
 					return
 				}
 			}
 		}()
 
-		respBytes := new([]byte)
-		for {
-			select {
-			case err = <-readErrCh:
+		var recvErr error
+		go func() {
+			defer close(flow.send)
+
+			for {
+				var resp []byte
+				if err := cs.RecvMsg(&resp); err != nil {
+					recvErr = err
+					return
+				}
+
+				if err := flow.enqueue(streamCtx, flow.send, resp, errSendQueueFull); err != nil {
+					cancel.cancelWith(err)
+					return
+				}
+			}
+		}()
+
+		for resp := range flow.send {
+			if err = flow.window.acquire(streamCtx); err != nil {
 				break
-			default:
 			}
 
-			if err = cs.RecvMsg(respBytes); err != nil {
+			messageType, data, encodeErr := messages.encode(resp)
+			if encodeErr != nil {
+				err = status.Error(codes.Internal, encodeErr.Error())
 				break
 			}
 
-			if err = ws.WriteMessage(websocket.BinaryMessage, *respBytes); err != nil {
+			keepalive.sending()
+			if err = m.wsCompression.writeMessage(ws, messageType, data); err != nil {
 				break
 			}
 		}
+		if err == nil {
+			err = recvErr
+		}
+
+		// If the stream was cancelled by the gateway, we report why instead.
+		keepalive.stop()
+		if reason := cancel.reason(); reason != nil {
+			err = reason
+		}
+		keepalive.sending()
 
 		// We _could_ differentiate between ws and cs errors here, but it's likely more overhead
 		// to split the two vs trying to just blind write the error code, which at worst case writes
 		// to a closed ws.
-		if err := ws.WriteMessage(
-			websocket.CloseMessage,
-			grpcStatusToCloseMessage(err),
-		); err != nil {
-			log.WithError(err).Trace("Failed to write error status")
+		writeCloseStatus(ws, log, err)
+	}
+}
+
+// subprotocolHeader selects the first subprotocol offered by the client that the
+// gateway supports (see JSONSubprotocol and FlowControlSubprotocol), unless the
+// upgrader selects subprotocols itself.
+func (m *Mux) subprotocolHeader(req *http.Request, respHeader http.Header) http.Header {
+	if len(m.upgrader.Subprotocols) > 0 {
+		return respHeader
+	}
+
+	for _, p := range websocket.Subprotocols(req) {
+		if p == JSONSubprotocol || (p == FlowControlSubprotocol && m.flowControl != nil && m.flowControl.Credits) {
+			if respHeader == nil {
+				respHeader = http.Header{}
+			}
+			respHeader.Set("Sec-WebSocket-Protocol", p)
+			break
 		}
 	}
+
+	return respHeader
+}
+
+// writeCloseStatus writes a websocket close message that 'wraps'
+// the gRPC status of err.
+func writeCloseStatus(ws *websocket.Conn, log *logrus.Entry, err error) {
+	if err := ws.WriteMessage(
+		websocket.CloseMessage,
+		grpcStatusToCloseMessage(err),
+	); err != nil {
+		log.WithError(err).Trace("Failed to write error status")
+	}
 }
 
 // grpcStatusToCloseMessage returns a websocket close
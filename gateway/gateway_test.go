@@ -94,7 +94,7 @@ func TestUnary_ErrorCodes(t *testing.T) {
 		{
 			"POST",
 			"application/json",
-			http.StatusBadRequest,
+			http.StatusUnsupportedMediaType,
 		},
 	} {
 		req, err := http.NewRequest(tc.method, fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr), bytes.NewReader(b))
@@ -264,31 +264,30 @@ func (s serv) EchoStream(req *echo.EchoStreamRequest, stream echo.Echo_EchoStrea
 	return nil
 }
 
-func setup(t *testing.T) (addr string, cleanup func()) {
-	s := grpc.NewServer()
-	echo.RegisterEchoServer(s, &serv{})
+func setup(t *testing.T, opts ...MuxOption) (addr string, cleanup func()) {
+	return setupWithServer(t, &serv{}, opts...)
+}
 
-	gl, err := net.Listen("tcp", "localhost:0")
-	require.NoError(t, err)
+func setupWithServer(t *testing.T, impl echo.EchoServer, opts ...MuxOption) (addr string, cleanup func()) {
+	return setupWithRegister(t, func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, impl)
+	}, opts...)
+}
 
-	port := gl.Addr().(*net.TCPAddr).Port
-	cc, err := grpc.Dial(
-		fmt.Sprintf("localhost:%d", port),
-		grpc.WithInsecure(),
-		grpc.WithDefaultCallOptions(grpc.ForceCodec(&BinaryCodec{})),
-	)
-	require.NoError(t, err)
+func setupWithRegister(t *testing.T, register func(*grpc.Server), opts ...MuxOption) (addr string, cleanup func()) {
+	m, cleanupMux := setupMux(t, register, opts...)
 
-	m := New(s, cc)
+	addr, cleanupHTTP := serveMux(t, m)
+	return addr, func() {
+		cleanupHTTP()
+		cleanupMux()
+	}
+}
 
+func serveMux(t testing.TB, m *Mux) (addr string, cleanup func()) {
 	hl, err := net.Listen("tcp", "localhost:0")
 	require.NoError(t, err)
 
-	go func() {
-		if err := s.Serve(gl); err != nil {
-			require.Equal(t, err, grpc.ErrServerStopped)
-		}
-	}()
 	go func() {
 		if err := m.ServeHTTP(hl); err != nil {
 			// Since we don't expose or use an http.Server directly, we
@@ -300,7 +299,36 @@ func setup(t *testing.T) (addr string, cleanup func()) {
 
 	return hl.Addr().String(), func() {
 		hl.Close()
+	}
+}
+
+func setupMux(t *testing.T, register func(*grpc.Server), opts ...MuxOption) (m *Mux, cleanup func()) {
+	s, cc, cleanup := serveGRPC(t, register)
+	return New(s, cc, opts...), cleanup
+}
+
+func serveGRPC(t *testing.T, register func(*grpc.Server)) (s *grpc.Server, cc *grpc.ClientConn, cleanup func()) {
+	s = grpc.NewServer()
+	register(s)
+
+	gl, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	port := gl.Addr().(*net.TCPAddr).Port
+	cc, err = grpc.Dial(
+		fmt.Sprintf("localhost:%d", port),
+		grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(&BinaryCodec{})),
+	)
+	require.NoError(t, err)
+
+	go func() {
+		if err := s.Serve(gl); err != nil {
+			require.Equal(t, err, grpc.ErrServerStopped)
+		}
+	}()
 
+	return s, cc, func() {
 		s.Stop()
 		gl.Close()
 	}
@@ -0,0 +1,204 @@
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// queryMessageParam is the query parameter containing the base64url
+	// encoded protobuf request of GET requests.
+	queryMessageParam = "message"
+
+	// queryJSONParam is the query parameter containing the JSON encoded
+	// request of GET requests, as an alternative to queryMessageParam.
+	queryJSONParam = "json"
+)
+
+// CachePolicy configures the caching of responses to GET requests.
+type CachePolicy struct {
+	// MaxAge is the time for which responses are fresh. If zero, clients
+	// must revalidate responses (using their ETag) before reusing them.
+	MaxAge time.Duration
+
+	// Public responses can be cached by shared caches such as CDNs, and
+	// not just by the client. Since shared caches may serve a response to
+	// other callers, responses that depend on the caller's credentials must
+	// not be public.
+	Public bool
+}
+
+// cacheVary is the request headers that cacheable responses may depend on.
+var cacheVary = []string{"Accept", "Authorization", "Accept-Encoding"}
+
+// cacheControl returns the Cache-Control header value for the policy.
+func (p CachePolicy) cacheControl() string {
+	visibility := "private"
+	if p.Public {
+		visibility = "public"
+	}
+	if p.MaxAge <= 0 {
+		return visibility + ", no-cache"
+	}
+
+	return fmt.Sprintf("%s, max-age=%d", visibility, int64(p.MaxAge/time.Second))
+}
+
+// WithCacheableMethod allows the specified unary method (i.e. `echo.v1.Echo/Echo`)
+// to be called with GET requests, which can be cached by browsers and CDNs.
+//
+// The request is provided in the query, either as base64url encoded protobuf
+// (`?message=<base64url>`), or as JSON (`?json=<json>`) if the method's
+// descriptors can be resolved, from the global protobuf registry, or using
+// WithDescriptors or WithReflection. Responses include
+// an ETag and a Cache-Control header set by the policy, and requests with a
+// matching If-None-Match header receive a 304 Not Modified.
+func WithCacheableMethod(fullMethod string, policy CachePolicy) MuxOption {
+	return func(m *Mux) {
+		if m.cachePolicies == nil {
+			m.cachePolicies = make(map[string]CachePolicy)
+		}
+		m.cachePolicies[strings.TrimPrefix(fullMethod, "/")] = policy
+	}
+}
+
+// WithCacheableIdempotentMethods allows GET requests (see WithCacheableMethod)
+// for all unary methods that are declared free of side effects, using the
+// specified policy:
+//
+//	rpc GetThing(GetThingRequest) returns (Thing) {
+//	    option idempotency_level = NO_SIDE_EFFECTS;
+//	}
+//
+// Policies set by WithCacheableMethod take precedence.
+func WithCacheableIdempotentMethods(policy CachePolicy) MuxOption {
+	return func(m *Mux) {
+		m.idempotentPolicy = &policy
+	}
+}
+
+// cachePolicy returns the cache policy for the method, or nil if it can't be
+// called using GET requests.
+func (m *Mux) cachePolicy(ctx context.Context, fullMethod string) *CachePolicy {
+	if policy, ok := m.cachePolicies[fullMethod]; ok {
+		return &policy
+	}
+	if m.idempotentPolicy == nil {
+		return nil
+	}
+
+	level, err := m.idempotencyLevel(ctx, fullMethod)
+	if err != nil {
+		m.log.WithError(err).WithField("method", fullMethod).Debug("Failed to resolve method options")
+		return nil
+	}
+	if level != descriptorpb.MethodOptions_NO_SIDE_EFFECTS {
+		return nil
+	}
+
+	return m.idempotentPolicy
+}
+
+// queryRequest returns the request encoded in the query of a GET request.
+func (m *Mux) queryRequest(ctx context.Context, req *http.Request, fullMethod string) ([]byte, error) {
+	query := req.URL.Query()
+	if encoded, ok := query[queryMessageParam]; ok {
+		// Padding is optional, since it has to be escaped in URLs.
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded[0], "="))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid message encoding")
+		}
+
+		return b, nil
+	}
+
+	if encoded, ok := query[queryJSONParam]; ok {
+		md, err := m.method(ctx, fullMethod)
+		if err != nil {
+			return nil, errors.Wrap(err, "JSON requests are not supported")
+		}
+
+		msg := dynamicpb.NewMessage(md.Input())
+		if err := protojson.Unmarshal([]byte(encoded[0]), msg); err != nil {
+			return nil, errors.Wrap(err, "invalid JSON message")
+		}
+
+		return protov2.Marshal(msg)
+	}
+
+	// Similar to an empty body, a missing message is the default message.
+	return nil, nil
+}
+
+// writeCacheable writes a response to a GET request, or a 304 Not Modified
+// if the client already has the response. The body is the (possibly compressed)
+// response, using the specified content coding.
+func writeCacheable(w http.ResponseWriter, req *http.Request, policy *CachePolicy, resp, body []byte, encoding string) error {
+	sum := sha256.Sum256(resp)
+	etag := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// Each coding is a different representation of the response, so they
+	// need distinct (strong) ETags.
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	etag = `"` + etag + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", policy.cacheControl())
+	addVary(w.Header(), cacheVary...)
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	_, err := w.Write(body)
+	return err
+}
+
+// addVary adds the request headers to the Vary header, if not already present.
+func addVary(h http.Header, headers ...string) {
+	var vary []string
+	present := make(map[string]bool)
+	for _, v := range h.Values("Vary") {
+		for _, header := range strings.Split(v, ",") {
+			header = strings.TrimSpace(header)
+			if header != "" && !present[http.CanonicalHeaderKey(header)] {
+				present[http.CanonicalHeaderKey(header)] = true
+				vary = append(vary, header)
+			}
+		}
+	}
+	for _, header := range headers {
+		if !present[http.CanonicalHeaderKey(header)] {
+			present[http.CanonicalHeaderKey(header)] = true
+			vary = append(vary, header)
+		}
+	}
+
+	h.Set("Vary", strings.Join(vary, ", "))
+}
+
+// etagMatches returns whether or not the If-None-Match header matches the
+// etag, using the weak comparison required by RFC 7232.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestCacheable_Get(t *testing.T) {
+	addr, cleanup := setup(t, WithCacheableMethod("/echo.v1.Echo/Echo", CachePolicy{MaxAge: time.Minute, Public: true}))
+	defer cleanup()
+
+	b, err := proto.Marshal(&echo.EchoRequest{Message: "a", Repetitions: 2})
+	require.NoError(t, err)
+	query := url.Values{"message": {base64.URLEncoding.EncodeToString(b)}}
+
+	resp, body := getCacheable(t, addr, query, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "public, max-age=60", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "application/proto", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "Accept, Authorization, Accept-Encoding", resp.Header.Get("Vary"))
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	var echoResp echo.EchoResponse
+	require.NoError(t, proto.Unmarshal(body, &echoResp))
+	assert.Equal(t, "aa", echoResp.Message)
+
+	// The same response has the same ETag, regardless of the request encoding.
+	resp, _ = getCacheable(t, addr, url.Values{"json": {`{"message": "a", "repetitions": 2}`}}, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		resp, body = getCacheable(t, addr, query, ifNoneMatch)
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Equal(t, "public, max-age=60", resp.Header.Get("Cache-Control"))
+		assert.Equal(t, "Accept, Authorization, Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Empty(t, body)
+	}
+
+	resp, _ = getCacheable(t, addr, query, `"other"`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Unpadded encodings are accepted.
+	resp, _ = getCacheable(t, addr, url.Values{"message": {base64.RawURLEncoding.EncodeToString(b)}}, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp, _ = getCacheable(t, addr, url.Values{"message": {"!!"}}, "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = getCacheable(t, addr, url.Values{"json": {`{"nope": 1}`}}, "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestCacheable_NotCacheable(t *testing.T) {
+	addr, cleanup := setup(t)
+	defer cleanup()
+
+	resp, _ := getCacheable(t, addr, nil, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestCacheable_Idempotent(t *testing.T) {
+	cc := &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			return req, nil
+		},
+	}
+	m := New(thingsServices, cc, WithDescriptors(thingsDescriptors()), WithCacheableIdempotentMethods(CachePolicy{}))
+	addr, cleanup := serveMux(t, m)
+	defer cleanup()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/things.v1.Things/Get?json=%s", addr, url.QueryEscape(`{"name": "a"}`)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "private, no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "Accept, Authorization, Accept-Encoding", resp.Header.Get("Vary"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x0a, 0x01, 'a'}, body)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/things.v1.Things/Put", addr))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func getCacheable(t *testing.T, addr string, query url.Values, ifNoneMatch string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo?%s", addr, query.Encode()), nil)
+	require.NoError(t, err)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, body
+}
+
+// thingsServices are the services described by thingsDescriptors.
+var thingsServices = Services{
+	"things.v1.Things": grpc.ServiceInfo{
+		Methods: []grpc.MethodInfo{{Name: "Get"}, {Name: "Put"}},
+	},
+}
+
+// thingsDescriptors returns the descriptors of a service with methods that
+// are, and are not, free of side effects.
+func thingsDescriptors() *descriptorpb.FileDescriptorSet {
+	return &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			{
+				Name:    proto.String("things/things.proto"),
+				Package: proto.String("things.v1"),
+				Syntax:  proto.String("proto3"),
+				MessageType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("Thing"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							{
+								Name:     proto.String("name"),
+								JsonName: proto.String("name"),
+								Number:   proto.Int32(1),
+								Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+								Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+							},
+						},
+					},
+				},
+				Service: []*descriptorpb.ServiceDescriptorProto{
+					{
+						Name: proto.String("Things"),
+						Method: []*descriptorpb.MethodDescriptorProto{
+							{
+								Name:       proto.String("Get"),
+								InputType:  proto.String(".things.v1.Thing"),
+								OutputType: proto.String(".things.v1.Thing"),
+								Options: &descriptorpb.MethodOptions{
+									IdempotencyLevel: descriptorpb.MethodOptions_NO_SIDE_EFFECTS.Enum(),
+								},
+							},
+							{
+								Name:       proto.String("Put"),
+								InputType:  proto.String(".things.v1.Thing"),
+								OutputType: proto.String(".things.v1.Thing"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	h := http.Header{}
+	addVary(h, "Accept-Encoding")
+	assert.Equal(t, []string{"Accept-Encoding"}, h.Values("Vary"))
+
+	// Existing values are merged, ignoring case and duplicates.
+	h.Add("Vary", "origin, accept-encoding")
+	addVary(h, cacheVary...)
+	assert.Equal(t, []string{"Accept-Encoding, origin, Accept, Authorization"}, h.Values("Vary"))
+}
@@ -0,0 +1,197 @@
+package gateway
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errKeepaliveTimeout = status.Error(codes.DeadlineExceeded, "keepalive timeout")
+	errIdleTimeout      = status.Error(codes.DeadlineExceeded, "idle timeout")
+)
+
+// KeepaliveConfig configures the keepalives of streams, so that connections that
+// are no longer responsive (i.e. half-open connections behind a NAT) don't hold
+// open their gRPC streams indefinitely.
+//
+// Expired streams are cancelled, and closed with a DeadlineExceeded status
+// (close code 4004).
+type KeepaliveConfig struct {
+	// PingInterval is the interval at which pings are sent to the client. If
+	// zero, pings aren't sent.
+	PingInterval time.Duration
+
+	// PongTimeout is how long to wait for a pong (or any other message) after
+	// a ping is sent, before the connection is considered dead. If zero, it
+	// defaults to the PingInterval.
+	PongTimeout time.Duration
+
+	// WriteTimeout bounds each write to the client. If zero, writes can block
+	// indefinitely.
+	WriteTimeout time.Duration
+
+	// IdleTimeout closes streams which haven't sent or received a message for
+	// the duration. Pings and pongs don't count as activity. If zero, idle
+	// streams aren't closed.
+	IdleTimeout time.Duration
+}
+
+// WithWebsocketKeepalive configures the keepalives of streams.
+func WithWebsocketKeepalive(config KeepaliveConfig) MuxOption {
+	return func(m *Mux) {
+		if config.PongTimeout <= 0 {
+			config.PongTimeout = config.PingInterval
+		}
+
+		m.keepalive = &config
+	}
+}
+
+// keepalive manages the keepalive of a single stream.
+//
+// All of its methods are safe to call on a nil keepalive (i.e. if keepalives
+// aren't configured), in which case they do nothing.
+type keepalive struct {
+	config KeepaliveConfig
+	ws     *websocket.Conn
+	cancel *streamCancel
+
+	activity chan struct{}
+	done     chan struct{}
+}
+
+// startKeepalive starts the keepalive of a stream, which is cancelled using
+// cancel if it expires.
+func (m *Mux) startKeepalive(ws *websocket.Conn, cancel *streamCancel) *keepalive {
+	if m.keepalive == nil {
+		return nil
+	}
+
+	k := &keepalive{
+		config:   *m.keepalive,
+		ws:       ws,
+		cancel:   cancel,
+		activity: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	if k.config.PingInterval > 0 {
+		k.extendReadDeadline()
+		ws.SetPongHandler(func(string) error {
+			k.extendReadDeadline()
+			return nil
+		})
+	}
+
+	go k.run()
+	return k
+}
+
+func (k *keepalive) run() {
+	var ping <-chan time.Time
+	if k.config.PingInterval > 0 {
+		ticker := time.NewTicker(k.config.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if k.config.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(k.config.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ping:
+			deadline := time.Now().Add(k.config.PongTimeout)
+			if err := k.ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				k.cancel.cancelWith(errKeepaliveTimeout)
+				return
+			}
+		case <-k.activity:
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(k.config.IdleTimeout)
+		case <-idle:
+			k.cancel.cancelWith(errIdleTimeout)
+			return
+		}
+	}
+}
+
+// extendReadDeadline allows the client another ping interval (plus the pong
+// timeout) to respond.
+func (k *keepalive) extendReadDeadline() {
+	_ = k.ws.SetReadDeadline(time.Now().Add(k.config.PingInterval + k.config.PongTimeout))
+}
+
+// received records that a message was received from the client.
+func (k *keepalive) received() {
+	if k == nil {
+		return
+	}
+
+	if k.config.PingInterval > 0 {
+		k.extendReadDeadline()
+	}
+	k.active()
+}
+
+// sending records that a message is about to be sent to the client, bounding
+// the write by the write timeout.
+func (k *keepalive) sending() {
+	if k == nil {
+		return
+	}
+
+	if k.config.WriteTimeout > 0 {
+		_ = k.ws.SetWriteDeadline(time.Now().Add(k.config.WriteTimeout))
+	}
+	k.active()
+}
+
+func (k *keepalive) active() {
+	if k.config.IdleTimeout <= 0 {
+		return
+	}
+
+	select {
+	case k.activity <- struct{}{}:
+	default:
+	}
+}
+
+// readFailed handles a failed read from the client, expiring the stream if
+// the client failed to respond in time.
+func (k *keepalive) readFailed(err error) {
+	if k == nil {
+		return
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		k.cancel.cancelWith(errKeepaliveTimeout)
+	}
+}
+
+// stop stops the keepalive.
+func (k *keepalive) stop() {
+	if k == nil {
+		return
+	}
+
+	select {
+	case <-k.done:
+	default:
+		close(k.done)
+	}
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestKeepalive_PongTimeout(t *testing.T) {
+	cc := &streamCtxConn{ctxs: make(chan context.Context, 1)}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithWebsocketKeepalive(KeepaliveConfig{
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  20 * time.Millisecond,
+	})))
+	defer cleanup()
+
+	conn := dialBidi(t, addr)
+	defer conn.Close()
+
+	// The client keeps reading, but stops responding to pings.
+	conn.SetPingHandler(func(string) error {
+		return nil
+	})
+
+	start := time.Now()
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.DeadlineExceeded)), err)
+	assert.Contains(t, err.Error(), "keepalive timeout")
+	assert.True(t, time.Since(start) < time.Second)
+
+	// The upstream stream is cancelled.
+	assertCancelled(t, <-cc.ctxs)
+}
+
+func TestKeepalive_Responsive(t *testing.T) {
+	addr, cleanup := serveMux(t, New(fakeServices, echoConn{}, WithWebsocketKeepalive(KeepaliveConfig{
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  100 * time.Millisecond,
+		WriteTimeout: time.Second,
+	})))
+	defer cleanup()
+
+	conn := dialBidi(t, addr)
+	defer conn.Close()
+
+	// Pongs are sent by the client (while it's reading), keeping the stream
+	// alive well past the pong timeout.
+	msgs := make(chan string, 1)
+	go func() {
+		defer close(msgs)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msgs <- string(data)
+		}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+	assert.Equal(t, "hello", <-msgs)
+}
+
+func TestKeepalive_IdleTimeout(t *testing.T) {
+	cc := &streamCtxConn{ctxs: make(chan context.Context, 1)}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithWebsocketKeepalive(KeepaliveConfig{
+		IdleTimeout: 200 * time.Millisecond,
+	})))
+	defer cleanup()
+
+	conn := dialBidi(t, addr)
+	defer conn.Close()
+
+	// Activity keeps the stream open past the idle timeout.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.DeadlineExceeded)), err)
+	assert.Contains(t, err.Error(), "idle timeout")
+
+	assertCancelled(t, <-cc.ctxs)
+}
+
+func dialBidi(t *testing.T, addr string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil)
+	require.NoError(t, err)
+	return conn
+}
+
+func assertCancelled(t *testing.T, ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream wasn't cancelled")
+	}
+}
+
+// streamCtxConn is an echoConn that exposes the context of each stream.
+type streamCtxConn struct {
+	echoConn
+	ctxs chan context.Context
+}
+
+func (c *streamCtxConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	c.ctxs <- ctx
+	return c.echoConn.NewStream(ctx, desc, method, opts...)
+}
@@ -0,0 +1,449 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultLongPollMaxSessions    = 1024
+	defaultLongPollSessionTimeout = time.Minute
+	defaultLongPollPollTimeout    = 25 * time.Second
+	defaultLongPollMaxPending     = 64
+)
+
+// LongPollConfig configures the long-polling transport.
+type LongPollConfig struct {
+	// MaxSessions is the maximum number of open sessions. If zero, a default
+	// of 1024 is used.
+	MaxSessions int
+
+	// SessionTimeout is how long a session can go without being used (i.e. polled)
+	// before its stream is cancelled. If zero, a default of one minute is used.
+	SessionTimeout time.Duration
+
+	// PollTimeout is how long a poll waits for messages before returning an empty
+	// response. It should be less than the SessionTimeout, and any proxy timeouts.
+	// If zero, a default of 25 seconds is used.
+	PollTimeout time.Duration
+
+	// MaxPending is the number of messages from the server that are buffered per
+	// session, until they're polled. While the buffer is full, the stream isn't
+	// read from. If zero, a default of 64 is used.
+	MaxPending int
+}
+
+// WithLongPolling registers a long-polling transport for streaming methods under
+// route (i.e. `/poll`), for clients that can't use websockets:
+//
+//	POST   <route>/<service>/<method>     opens a session, returning {"session": "<id>"}
+//	POST   <route>/sessions/<id>          sends the (application/proto) body as a message
+//	POST   <route>/sessions/<id>/close    half-closes the stream
+//	GET    <route>/sessions/<id>          polls for messages
+//	DELETE <route>/sessions/<id>          cancels the stream
+//
+// The body of the request that opens the session, if any, is sent as the first
+// message. Polls wait (up to the PollTimeout) for messages, and return all of the
+// pending messages, and the final status once the stream has finished:
+//
+//	{"messages": ["<base64>", ...], "status": {"code": 0}}
+//
+// Once the final status is returned, the session is closed. Session IDs are the
+// only credential required to use a session, so they should be treated as secrets.
+func WithLongPolling(route string, config LongPollConfig) MuxOption {
+	return func(m *Mux) {
+		if config.MaxSessions <= 0 {
+			config.MaxSessions = defaultLongPollMaxSessions
+		}
+		if config.SessionTimeout <= 0 {
+			config.SessionTimeout = defaultLongPollSessionTimeout
+		}
+		if config.PollTimeout <= 0 {
+			config.PollTimeout = defaultLongPollPollTimeout
+		}
+		if config.MaxPending <= 0 {
+			config.MaxPending = defaultLongPollMaxPending
+		}
+
+		m.longPollRoute = path.Join("/", route)
+		m.longPollConfig = config
+		m.pollSessions = make(map[string]*pollSession)
+	}
+}
+
+type pollResponse struct {
+	Messages [][]byte    `json:"messages"`
+	Status   *jsonStatus `json:"status,omitempty"`
+}
+
+func (m *Mux) registerLongPollRoutes() {
+	if m.longPollRoute == "" {
+		return
+	}
+
+	sessionPath := path.Join(m.longPollRoute, "sessions", "{id}")
+	m.router.HandleFunc(sessionPath, m.pollSessionHandler)
+	m.router.HandleFunc(sessionPath+"/close", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s, ok := m.pollSession(mux.Vars(req)["id"])
+		if !ok {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+
+		s.sendMu.Lock()
+		err := s.cs.CloseSend()
+		if err == nil {
+			s.closed = true
+		}
+		s.sendMu.Unlock()
+		if err != nil {
+			writeStatusError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// longPollHandler opens long-polling sessions for a streaming method.
+func (m *Mux) longPollHandler(fullMethod string, cc grpc.ClientConnInterface) http.HandlerFunc {
+	log := m.log.WithFields(logrus.Fields{
+		"method":    fullMethod,
+		"streaming": "true",
+		"transport": "long-poll",
+	})
+	limiter := m.limiter(fullMethod)
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var first []byte
+		if req.ContentLength != 0 {
+			if _, ok := m.requestMediaType(w, req, mediaTypeProto); !ok {
+				return
+			}
+
+			buf, err := readBody(req.Body, req.ContentLength)
+			req.Body.Close()
+			if err != nil {
+				log.WithError(err).Trace("Failed to read request body")
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+
+			// Streams may retain messages, so the body is copied from the buffer.
+			first = append([]byte(nil), buf.Bytes()...)
+			putBuffer(buf)
+		}
+
+		var key string
+		if limiter != nil {
+			key = m.clientKey(req)
+			if ok, retryAfter := limiter.allow(key, time.Now()); !ok {
+				w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			if !limiter.acquireStream(key) {
+				http.Error(w, "too many streams", http.StatusTooManyRequests)
+				return
+			}
+		}
+		release := func() {
+			if limiter != nil {
+				limiter.releaseStream(key)
+			}
+		}
+
+		id, err := newToken()
+		if err != nil {
+			release()
+			log.WithError(err).Warn("Failed to generate session id")
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		// The stream outlives the request, so it isn't bound to its context.
+		ctx, cancel := context.WithCancel(m.detachedContext(req, req.Header))
+		s := &pollSession{
+			m:       m,
+			id:      id,
+			config:  m.longPollConfig,
+			ctx:     ctx,
+			cancel:  cancel,
+			release: release,
+			changed: make(chan struct{}),
+		}
+		s.expiry = time.AfterFunc(m.longPollConfig.SessionTimeout, s.expire)
+
+		// Reserve the session before opening the stream, so the limit
+		// can't be exceeded by concurrent requests.
+		m.pollSessionsMu.Lock()
+		if len(m.pollSessions) >= m.longPollConfig.MaxSessions {
+			m.pollSessionsMu.Unlock()
+			s.expiry.Stop()
+			cancel()
+			release()
+			http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+			return
+		}
+		m.pollSessions[id] = s
+		m.pollSessionsMu.Unlock()
+
+		s.cs, err = cc.NewStream(ctx, streamDesc, "/"+fullMethod)
+		if err != nil {
+			m.removePollSession(s)
+			log.WithError(err).Warn("Failed to initialize grpc stream")
+			writeStatusError(w, err)
+			return
+		}
+		if first != nil {
+			if err := s.cs.SendMsg(first); err != nil && err != io.EOF {
+				m.removePollSession(s)
+				writeStatusError(w, err)
+				return
+			}
+		}
+
+		go s.recv()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Session string `json:"session"`
+		}{id}); err != nil {
+			log.WithError(err).Info("Failed to send response")
+		}
+	}
+}
+
+// pollSessionHandler sends messages to, polls, and cancels a session.
+func (m *Mux) pollSessionHandler(w http.ResponseWriter, req *http.Request) {
+	s, ok := m.pollSession(mux.Vars(req)["id"])
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		resp := s.poll(req.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			m.log.WithError(err).Info("Failed to send poll response")
+		}
+	case "POST":
+		if _, ok := m.requestMediaType(w, req, mediaTypeProto); !ok {
+			return
+		}
+
+		buf, err := readBody(req.Body, req.ContentLength)
+		req.Body.Close()
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		msg := append([]byte(nil), buf.Bytes()...)
+		putBuffer(buf)
+
+		s.touch()
+		s.sendMu.Lock()
+		if s.closed {
+			s.sendMu.Unlock()
+			http.Error(w, "stream closed for sending", http.StatusConflict)
+			return
+		}
+		err = s.cs.SendMsg(msg)
+		s.sendMu.Unlock()
+		if err == io.EOF {
+			// The stream has finished, and its status is available by polling.
+			http.Error(w, "stream finished", http.StatusConflict)
+			return
+		} else if err != nil {
+			writeStatusError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		m.removePollSession(s)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *Mux) pollSession(id string) (*pollSession, bool) {
+	m.pollSessionsMu.Lock()
+	defer m.pollSessionsMu.Unlock()
+
+	s, ok := m.pollSessions[id]
+	return s, ok
+}
+
+func (m *Mux) removePollSession(s *pollSession) {
+	m.pollSessionsMu.Lock()
+	_, ok := m.pollSessions[s.id]
+	delete(m.pollSessions, s.id)
+	m.pollSessionsMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	s.expiry.Stop()
+	s.cancel()
+	s.release()
+}
+
+// writeStatusError writes an error response for a gRPC error.
+func writeStatusError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	http.Error(w, s.Message(), runtime.HTTPStatusFromCode(s.Code()))
+}
+
+// pollSession is a gRPC stream that's served using long-polling.
+type pollSession struct {
+	m       *Mux
+	id      string
+	config  LongPollConfig
+	ctx     context.Context
+	cancel  context.CancelFunc
+	release func()
+	expiry  *time.Timer
+
+	cs     grpc.ClientStream
+	sendMu sync.Mutex
+
+	// closed is set (with sendMu held) once the stream is half-closed, after
+	// which messages can't be sent.
+	closed bool
+
+	mu      sync.Mutex
+	pending [][]byte
+	done    bool
+	err     error
+
+	// changed is closed (and replaced) whenever the state changes.
+	changed chan struct{}
+}
+
+// notify wakes up anything waiting for the state to change. s.mu must be held.
+func (s *pollSession) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// recv buffers the messages from the server until the stream finishes.
+func (s *pollSession) recv() {
+	for {
+		var msg []byte
+		err := s.cs.RecvMsg(&msg)
+
+		s.mu.Lock()
+		if err != nil {
+			s.done, s.err = true, err
+			s.notify()
+			s.mu.Unlock()
+			return
+		}
+
+		for len(s.pending) >= s.config.MaxPending {
+			changed := s.changed
+			s.mu.Unlock()
+
+			select {
+			case <-changed:
+			case <-s.ctx.Done():
+				return
+			}
+			s.mu.Lock()
+		}
+
+		s.pending = append(s.pending, msg)
+		s.notify()
+		s.mu.Unlock()
+	}
+}
+
+// poll waits for, and returns, the pending messages, along with the final
+// status if the stream has finished.
+func (s *pollSession) poll(ctx context.Context) pollResponse {
+	s.touch()
+	defer s.touch()
+
+	timeout := time.NewTimer(s.config.PollTimeout)
+	defer timeout.Stop()
+
+	s.mu.Lock()
+	for len(s.pending) == 0 && !s.done {
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return pollResponse{Messages: [][]byte{}}
+		case <-ctx.Done():
+			return pollResponse{Messages: [][]byte{}}
+		case <-s.ctx.Done():
+			return pollResponse{Messages: [][]byte{}, Status: &jsonStatus{Code: codes.Canceled, Message: "session expired"}}
+		}
+		s.mu.Lock()
+	}
+
+	resp := pollResponse{Messages: s.pending}
+	s.pending = nil
+	s.notify()
+
+	done, err := s.done, s.err
+	s.mu.Unlock()
+
+	if done {
+		if err == io.EOF {
+			err = nil
+		}
+		st := status.Convert(err)
+		resp.Status = &jsonStatus{Code: st.Code(), Message: st.Message()}
+
+		// The final status has been delivered, so the session is complete.
+		s.m.removePollSession(s)
+	}
+
+	return resp
+}
+
+// touch extends the session's expiry, unless it has been removed.
+func (s *pollSession) touch() {
+	s.m.pollSessionsMu.Lock()
+	defer s.m.pollSessionsMu.Unlock()
+
+	if s.m.pollSessions[s.id] == s {
+		s.expiry.Reset(s.config.SessionTimeout)
+	}
+}
+
+func (s *pollSession) expire() {
+	s.m.removePollSession(s)
+}
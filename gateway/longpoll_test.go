@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLongPoll(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			for i := 0; i < 2; i++ {
+				send(<-reqs)
+			}
+			return status.Error(codes.PermissionDenied, "done")
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithLongPolling("poll", LongPollConfig{})))
+	defer cleanup()
+
+	code, id := openPollSession(t, addr, "a")
+	require.Equal(t, http.StatusOK, code)
+
+	resp := poll(t, addr, id)
+	assert.Equal(t, [][]byte{[]byte("a")}, resp.Messages)
+	assert.Nil(t, resp.Status)
+
+	code, _ = pollRequest(t, "POST", fmt.Sprintf("http://%s/poll/sessions/%s", addr, id), "b")
+	require.Equal(t, http.StatusNoContent, code)
+
+	// Poll until the final status is returned.
+	var messages [][]byte
+	for resp.Status == nil {
+		resp = poll(t, addr, id)
+		messages = append(messages, resp.Messages...)
+	}
+	assert.Equal(t, [][]byte{[]byte("b")}, messages)
+	assert.Equal(t, &jsonStatus{Code: codes.PermissionDenied, Message: "done"}, resp.Status)
+
+	// The session is closed once the status is returned.
+	code, _ = pollRequest(t, "GET", fmt.Sprintf("http://%s/poll/sessions/%s", addr, id), "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	calls := cc.recorded()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "/test.v1.Test/Bidi", calls[0].method)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, calls[0].reqs)
+}
+
+func TestLongPoll_Sessions(t *testing.T) {
+	cc := &streamCtxConn{ctxs: make(chan context.Context, 2)}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithLongPolling("poll", LongPollConfig{
+		MaxSessions: 1,
+		PollTimeout: 10 * time.Millisecond,
+	})))
+	defer cleanup()
+
+	code, id := openPollSession(t, addr, "")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = openPollSession(t, addr, "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// Polls without any messages time out with an empty response.
+	resp := poll(t, addr, id)
+	assert.Equal(t, [][]byte{}, resp.Messages)
+	assert.Nil(t, resp.Status)
+
+	code, _ = pollRequest(t, "POST", fmt.Sprintf("http://%s/poll/sessions/%s/close", addr, id), "")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	// Messages can't be sent once the stream is half-closed.
+	code, _ = pollRequest(t, "POST", fmt.Sprintf("http://%s/poll/sessions/%s", addr, id), "a")
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = pollRequest(t, "DELETE", fmt.Sprintf("http://%s/poll/sessions/%s", addr, id), "")
+	assert.Equal(t, http.StatusNoContent, code)
+	assertCancelled(t, <-cc.ctxs)
+
+	code, _ = openPollSession(t, addr, "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = pollRequest(t, "GET", fmt.Sprintf("http://%s/poll/test.v1.Test/Bidi", addr), "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = pollRequest(t, "GET", fmt.Sprintf("http://%s/poll/sessions/unknown", addr), "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestLongPoll_Finished(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			return nil
+		},
+	}
+	m := New(fakeServices, cc, WithLongPolling("poll", LongPollConfig{}))
+	addr, cleanup := serveMux(t, m)
+	defer cleanup()
+
+	code, id := openPollSession(t, addr, "")
+	require.Equal(t, http.StatusOK, code)
+	s, ok := m.pollSession(id)
+	require.True(t, ok)
+
+	resp := poll(t, addr, id)
+	require.NotNil(t, resp.Status)
+	assert.Equal(t, codes.OK, resp.Status.Code)
+
+	// The expiry of the removed session isn't extended by the poll.
+	assert.False(t, s.expiry.Stop())
+}
+
+func TestLongPoll_Expiry(t *testing.T) {
+	cc := &streamCtxConn{ctxs: make(chan context.Context, 1)}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithLongPolling("poll", LongPollConfig{
+		SessionTimeout: 50 * time.Millisecond,
+	})))
+	defer cleanup()
+
+	code, id := openPollSession(t, addr, "")
+	require.Equal(t, http.StatusOK, code)
+
+	// Sessions that aren't used are cancelled.
+	assertCancelled(t, <-cc.ctxs)
+	code, _ = pollRequest(t, "GET", fmt.Sprintf("http://%s/poll/sessions/%s", addr, id), "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func openPollSession(t *testing.T, addr, body string) (int, string) {
+	code, b := pollRequest(t, "POST", fmt.Sprintf("http://%s/poll/test.v1.Test/Bidi", addr), body)
+	if code != http.StatusOK {
+		return code, ""
+	}
+
+	var resp struct {
+		Session string `json:"session"`
+	}
+	require.NoError(t, json.Unmarshal(b, &resp))
+	require.NotEmpty(t, resp.Session)
+	return code, resp.Session
+}
+
+func poll(t *testing.T, addr, id string) pollResponse {
+	code, b := pollRequest(t, "GET", fmt.Sprintf("http://%s/poll/sessions/%s", addr, id), "")
+	require.Equal(t, http.StatusOK, code)
+
+	var resp pollResponse
+	require.NoError(t, json.Unmarshal(b, &resp))
+	return resp
+}
+
+func pollRequest(t *testing.T, method, url, body string) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/proto")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, b
+}
@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeProto = "application/proto"
+	mediaTypeJSON  = "application/json"
+)
+
+// defaultMediaTypeAliases are the other commonly used protobuf media types.
+var defaultMediaTypeAliases = map[string]string{
+	"application/protobuf":          mediaTypeProto,
+	"application/x-protobuf":        mediaTypeProto,
+	"application/x-google-protobuf": mediaTypeProto,
+}
+
+// WithMediaTypeAlias accepts the alias (i.e. a vendor specific media type)
+// wherever the gateway accepts mediaType, which is either application/proto or
+// application/json. By default, application/protobuf, application/x-protobuf,
+// and application/x-google-protobuf are aliases of application/proto.
+//
+// Clients that list an alias in their Accept header receive responses using it.
+func WithMediaTypeAlias(alias, mediaType string) MuxOption {
+	return func(m *Mux) {
+		m.mediaTypeAliases[strings.ToLower(alias)] = strings.ToLower(mediaType)
+	}
+}
+
+func copyMediaTypeAliases(aliases map[string]string) map[string]string {
+	c := make(map[string]string, len(aliases))
+	for k, v := range aliases {
+		c[k] = v
+	}
+	return c
+}
+
+// mediaType returns the canonical media type of a Content-Type (or Accept)
+// value, resolving aliases.
+func (m *Mux) mediaType(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid media type")
+	}
+	if canonical, ok := m.mediaTypeAliases[mediaType]; ok {
+		mediaType = canonical
+	}
+
+	if charset, ok := params["charset"]; ok && mediaType == mediaTypeJSON && !strings.EqualFold(charset, "utf-8") {
+		return "", errors.Errorf("unsupported charset %q", charset)
+	}
+
+	return mediaType, nil
+}
+
+// mediaTypes returns the supported media types, along with their aliases.
+func (m *Mux) mediaTypes(supported []string) []string {
+	var all []string
+	for _, s := range supported {
+		all = append(all, s)
+
+		var aliases []string
+		for alias, canonical := range m.mediaTypeAliases {
+			if canonical == s {
+				aliases = append(aliases, alias)
+			}
+		}
+		sort.Strings(aliases)
+		all = append(all, aliases...)
+	}
+
+	return all
+}
+
+// requestMediaType returns the canonical media type of the request body. If it
+// isn't one of the supported media types, a 415 Unsupported Media Type listing
+// the supported media types is written.
+func (m *Mux) requestMediaType(w http.ResponseWriter, req *http.Request, supported ...string) (string, bool) {
+	contentType := req.Header.Get("Content-Type")
+
+	var err error
+	if contentType == "" {
+		err = errors.New("missing content type")
+	} else if mediaType, parseErr := m.mediaType(contentType); parseErr != nil {
+		err = parseErr
+	} else {
+		for _, s := range supported {
+			if mediaType == s {
+				return mediaType, true
+			}
+		}
+		err = errors.Errorf("unsupported media type %q", contentType)
+	}
+
+	accepted := strings.Join(m.mediaTypes(supported), ", ")
+	w.Header().Set("Accept-Post", accepted)
+	http.Error(w, fmt.Sprintf("%v (supported media types: %s)", err, accepted), http.StatusUnsupportedMediaType)
+	return "", false
+}
+
+// responseMediaType negotiates the media type of the response from the Accept
+// header, given the offered (canonical) media types in order of preference. It
+// returns the media type to respond with, which may be an alias requested by the
+// client, and its canonical media type. If none of the offered media types are
+// acceptable, a 406 Not Acceptable is written.
+func (m *Mux) responseMediaType(w http.ResponseWriter, req *http.Request, offered ...string) (mediaType, canonical string, ok bool) {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return offered[0], offered[0], true
+	}
+
+	type acceptRange struct {
+		mediaType string
+		canonical string
+		q         float64
+	}
+	var ranges []acceptRange
+	for _, r := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		canonical := mediaType
+		if c, ok := m.mediaTypeAliases[mediaType]; ok {
+			canonical = c
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, canonical: canonical, q: q})
+	}
+
+	// Each offered media type uses the quality of the most specific range
+	// that matches it, with ties broken by the order of the offered types.
+	var bestQ float64
+	for _, o := range offered {
+		respond, q, specificity := o, 0.0, -1
+		for _, r := range ranges {
+			s := -1
+			switch {
+			case r.canonical == o:
+				s = 2
+			case r.mediaType == o[:strings.Index(o, "/")]+"/*":
+				s = 1
+			case r.mediaType == "*/*":
+				s = 0
+			}
+
+			if s > specificity || (s == specificity && r.q > q) {
+				specificity, q = s, r.q
+				respond = o
+				if s == 2 {
+					respond = r.mediaType
+				}
+			}
+		}
+
+		if specificity >= 0 && q > bestQ {
+			mediaType, canonical, bestQ = respond, o, q
+		}
+	}
+	if bestQ > 0 {
+		return mediaType, canonical, true
+	}
+
+	http.Error(w, fmt.Sprintf("not acceptable (available media types: %s)", strings.Join(m.mediaTypes(offered), ", ")), http.StatusNotAcceptable)
+	return "", "", false
+}
@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestMediaTypes_Unary(t *testing.T) {
+	addr, cleanup := setup(t, WithMediaTypeAlias("application/vnd.example+proto", mediaTypeProto))
+	defer cleanup()
+
+	b, err := proto.Marshal(&echo.EchoRequest{Message: "a", Repetitions: 2})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		contentType  string
+		accept       string
+		status       int
+		responseType string
+	}{
+		{"application/proto", "", http.StatusOK, "application/proto"},
+		{"application/protobuf", "", http.StatusOK, "application/proto"},
+		{"application/x-protobuf; charset=binary", "", http.StatusOK, "application/proto"},
+		{"Application/Proto", "*/*", http.StatusOK, "application/proto"},
+		{"application/vnd.example+proto", "", http.StatusOK, "application/proto"},
+		{"application/proto", "application/x-protobuf, */*;q=0.1", http.StatusOK, "application/x-protobuf"},
+		{"application/proto", "application/*", http.StatusOK, "application/proto"},
+		{"application/proto", "application/json", http.StatusNotAcceptable, ""},
+		{"application/octet-stream", "", http.StatusUnsupportedMediaType, ""},
+		{"", "", http.StatusUnsupportedMediaType, ""},
+	} {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr), bytes.NewReader(b))
+		require.NoError(t, err)
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		name := fmt.Sprintf("%q (accept %q)", tc.contentType, tc.accept)
+		require.Equal(t, tc.status, resp.StatusCode, name)
+		if tc.status != http.StatusOK {
+			continue
+		}
+		assert.Equal(t, tc.responseType, resp.Header.Get("Content-Type"), name)
+
+		echoResp := &echo.EchoResponse{}
+		require.NoError(t, proto.Unmarshal(body, echoResp), name)
+		assert.Equal(t, "aa", echoResp.Message, name)
+	}
+}
+
+func TestMediaTypes_Unsupported(t *testing.T) {
+	m := New(fakeServices, echoConn{})
+
+	req := httptest.NewRequest("POST", "/api/test.v1.Test/Unary", bytes.NewReader([]byte("a")))
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	m.router.ServeHTTP(w, req)
+
+	// Clients are told which media types are supported.
+	supported := "application/proto, application/protobuf, application/x-google-protobuf, application/x-protobuf"
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, supported, w.Header().Get("Accept-Post"))
+	assert.Contains(t, w.Body.String(), `unsupported media type "text/plain"`)
+	assert.Contains(t, w.Body.String(), supported)
+}
+
+func TestMediaTypes_Negotiation(t *testing.T) {
+	m := New(fakeServices, echoConn{})
+
+	for _, tc := range []struct {
+		accept    string
+		mediaType string
+		canonical string
+	}{
+		{"", "application/proto", mediaTypeProto},
+		{"*/*", "application/proto", mediaTypeProto},
+		{"application/json", "application/json", mediaTypeJSON},
+		{"application/json;q=0.5, application/protobuf", "application/protobuf", mediaTypeProto},
+		{"application/json, application/proto;q=0.5", "application/json", mediaTypeJSON},
+		{"*/*, application/proto;q=0", "application/json", mediaTypeJSON},
+		{"application/*;q=0.5, application/json;q=0.4", "application/proto", mediaTypeProto},
+		{"application/json; charset=utf-8", "application/json", mediaTypeJSON},
+		{"text/html", "", ""},
+		{"invalid, application/json", "application/json", mediaTypeJSON},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", tc.accept)
+		w := httptest.NewRecorder()
+
+		mediaType, canonical, ok := m.responseMediaType(w, req, mediaTypeProto, mediaTypeJSON)
+		assert.Equal(t, tc.mediaType != "", ok, tc.accept)
+		assert.Equal(t, tc.mediaType, mediaType, tc.accept)
+		assert.Equal(t, tc.canonical, canonical, tc.accept)
+		if !ok {
+			assert.Equal(t, http.StatusNotAcceptable, w.Code)
+		}
+	}
+}
+
+func TestMediaTypes_Charset(t *testing.T) {
+	m := New(fakeServices, echoConn{})
+
+	mediaType, err := m.mediaType("application/json; charset=UTF-8")
+	require.NoError(t, err)
+	assert.Equal(t, mediaTypeJSON, mediaType)
+
+	_, err = m.mediaType("application/json; charset=latin1")
+	assert.Error(t, err)
+
+	_, err = m.mediaType("application/")
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	defaultForwardedHeaders = []string{"Authorization"}
+)
+
+// WithForwardedHeaders sets the HTTP headers that are forwarded to the
+// gRPC server as (lower-cased) metadata. By default, only the Authorization
+// header is forwarded.
+func WithForwardedHeaders(headers ...string) MuxOption {
+	return func(m *Mux) {
+		m.forwardedHeaders = headers
+	}
+}
+
+// outgoingContext returns the request's context carrying the forwarded
+// headers, and the client's certificate identity, as outgoing gRPC metadata.
+func (m *Mux) outgoingContext(req *http.Request, header http.Header) context.Context {
+	ctx := req.Context()
+
+	md := metadata.MD{}
+	for _, h := range m.forwardedHeaders {
+		values := header.Values(h)
+		if len(values) == 0 {
+			continue
+		}
+
+		md.Append(strings.ToLower(h), values...)
+	}
+
+	// The identity keys are only ever set by the gateway, so that clients
+	// can't impersonate others by setting the corresponding headers.
+	for _, k := range identityKeys {
+		delete(md, k)
+	}
+	for k, v := range clientIdentity(req.TLS) {
+		md[k] = v
+	}
+
+	if len(md) == 0 {
+		return ctx
+	}
+	if existing, ok := metadata.FromOutgoingContext(ctx); ok {
+		md = metadata.Join(existing, md)
+	}
+
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// detachedContext returns a context carrying the same outgoing metadata as
+// outgoingContext, but which isn't bound to the request, for streams that
+// outlive it.
+func (m *Mux) detachedContext(req *http.Request, header http.Header) context.Context {
+	ctx := context.Background()
+	if md, ok := metadata.FromOutgoingContext(m.outgoingContext(req, header)); ok {
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+
+	return ctx
+}
@@ -0,0 +1,380 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// OpenAPIInfo is the info object of the generated OpenAPI document.
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// WithOpenAPIRoute serves an OpenAPI 3 document describing the gateway's
+// routes at the specified path (see Mux.OpenAPI).
+func WithOpenAPIRoute(route string, info OpenAPIInfo) MuxOption {
+	return func(m *Mux) {
+		m.openAPIRoute = path.Join("/", route)
+		m.openAPIInfo = info
+	}
+}
+
+type openAPIDoc struct {
+	OpenAPI    string                      `json:"openapi"`
+	Info       OpenAPIInfo                 `json:"info"`
+	Paths      map[string]*openAPIPathItem `json:"paths"`
+	Components openAPIComponents           `json:"components"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*openAPISchema `json:"schemas"`
+}
+
+type openAPIPathItem struct {
+	Get  *openAPIOperation `json:"get,omitempty"`
+	Post *openAPIOperation `json:"post,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Tags        []string                    `json:"tags"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+
+	GRPCMethod string            `json:"x-grpc-method"`
+	Websocket  *openAPIWebsocket `json:"x-websocket,omitempty"`
+}
+
+// openAPIWebsocket documents a streaming method, since OpenAPI has no
+// way of describing websocket messages.
+type openAPIWebsocket struct {
+	ClientStreams bool           `json:"client_streams"`
+	ServerStreams bool           `json:"server_streams"`
+	Request       *openAPISchema `json:"request"`
+	Response      *openAPISchema `json:"response"`
+	CloseCodes    string         `json:"close_codes"`
+}
+
+type openAPIParameter struct {
+	Name        string                       `json:"name"`
+	In          string                       `json:"in"`
+	Description string                       `json:"description"`
+	Schema      *openAPISchema               `json:"schema,omitempty"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+
+	ProtobufType string `json:"x-protobuf-type,omitempty"`
+}
+
+// OpenAPI returns an OpenAPI 3 document (in JSON) describing the gateway's routes.
+//
+// Each unary method is described as a POST operation, whose application/proto
+// request and response bodies are binary protobuf messages (identified by the
+// `x-protobuf-type` extension). If the Connect protocol is enabled (see
+// WithConnect), which accepts JSON requests, application/json bodies are also
+// described, using schemas that follow the protobuf JSON mapping of the method's
+// messages. Streaming methods are described as GET operations (the websocket
+// upgrade), with the message schemas documented in the `x-websocket` extension.
+func (m *Mux) OpenAPI(ctx context.Context) ([]byte, error) {
+	d, err := m.descriptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info:    m.openAPIInfo,
+		Paths:   make(map[string]*openAPIPathItem),
+		Components: openAPIComponents{
+			Schemas: map[string]*openAPISchema{
+				"grpc.Status": {
+					Type:        "string",
+					Description: "The gRPC status message. The HTTP status code is derived from the gRPC status code.",
+				},
+			},
+		},
+	}
+	if m.connect {
+		doc.Components.Schemas["connect.Error"] = &openAPISchema{
+			Type:        "object",
+			Description: "The Connect error of a JSON request.",
+			Properties: map[string]*openAPISchema{
+				"code":    {Type: "string", Description: "The gRPC status code, in snake case (i.e. not_found)."},
+				"message": {Type: "string"},
+			},
+		}
+	}
+
+	for _, r := range m.routes {
+		sd, err := d.service(path.Dir(r.Method))
+		if err != nil {
+			return nil, err
+		}
+		md := sd.Methods().ByName(protoreflect.Name(path.Base(r.Method)))
+		if md == nil {
+			continue
+		}
+
+		op := &openAPIOperation{
+			OperationID: string(md.FullName()),
+			Tags:        []string{string(sd.FullName())},
+			GRPCMethod:  r.Method,
+			Responses: map[string]*openAPIResponse{
+				"default": errorResponse(),
+			},
+		}
+
+		request := messageSchema(md.Input(), doc.Components.Schemas)
+		response := messageSchema(md.Output(), doc.Components.Schemas)
+
+		if r.Streaming {
+			op.Responses["101"] = &openAPIResponse{Description: "Switching Protocols"}
+			op.Websocket = &openAPIWebsocket{
+				ClientStreams: r.ClientStreams,
+				ServerStreams: r.ServerStreams,
+				Request:       request,
+				Response:      response,
+				CloseCodes:    "1000 on success, or 4000 + the gRPC status code on failure",
+			}
+			doc.Paths[r.Path] = &openAPIPathItem{Get: op}
+			continue
+		}
+
+		op.RequestBody = &openAPIBody{
+			Required: true,
+			Content: map[string]*openAPIMediaType{
+				mediaTypeProto: {Schema: binarySchema(md.Input())},
+			},
+		}
+		op.Responses["200"] = &openAPIResponse{
+			Description: "OK",
+			Content: map[string]*openAPIMediaType{
+				mediaTypeProto: {Schema: binarySchema(md.Output())},
+			},
+		}
+		if m.connect {
+			op.RequestBody.Content[mediaTypeJSON] = &openAPIMediaType{Schema: request}
+			op.Responses["200"].Content[mediaTypeJSON] = &openAPIMediaType{Schema: response}
+			op.Responses["default"].Content[mediaTypeJSON] = &openAPIMediaType{Schema: &openAPISchema{Ref: "#/components/schemas/connect.Error"}}
+		}
+		item := &openAPIPathItem{Post: op}
+
+		if m.cachePolicy(ctx, r.Method) != nil {
+			get := *op
+			get.OperationID += ".Get"
+			get.RequestBody = nil
+			get.Parameters = []*openAPIParameter{
+				{
+					Name:        queryMessageParam,
+					In:          "query",
+					Description: "The base64url encoded protobuf request.",
+					Schema:      &openAPISchema{Type: "string", Format: "byte"},
+				},
+				{
+					Name:        queryJSONParam,
+					In:          "query",
+					Description: "The JSON encoded request, as an alternative to message.",
+					Content: map[string]*openAPIMediaType{
+						"application/json": {Schema: request},
+					},
+				},
+			}
+			// GET requests are served by the gateway, rather than Connect,
+			// so responses are always protobuf.
+			get.Responses = map[string]*openAPIResponse{
+				"200": {
+					Description: "OK",
+					Content: map[string]*openAPIMediaType{
+						mediaTypeProto: {Schema: binarySchema(md.Output())},
+					},
+				},
+				"304":     {Description: "Not Modified"},
+				"default": errorResponse(),
+			}
+			item.Get = &get
+		}
+
+		doc.Paths[r.Path] = item
+	}
+
+	return json.Marshal(doc)
+}
+
+func (m *Mux) registerOpenAPIRoute() {
+	if m.openAPIRoute == "" {
+		return
+	}
+
+	m.router.HandleFunc(m.openAPIRoute, func(w http.ResponseWriter, req *http.Request) {
+		b, err := m.OpenAPI(req.Context())
+		if err != nil {
+			m.log.WithError(err).Warn("Failed to generate OpenAPI document")
+			http.Error(w, "failed to generate document", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	})
+}
+
+// errorResponse describes the error responses of the gateway.
+func errorResponse() *openAPIResponse {
+	return &openAPIResponse{
+		Description: "Error",
+		Content: map[string]*openAPIMediaType{
+			"text/plain": {Schema: &openAPISchema{Ref: "#/components/schemas/grpc.Status"}},
+		},
+	}
+}
+
+// binarySchema describes the message encoded as binary protobuf.
+func binarySchema(md protoreflect.MessageDescriptor) *openAPISchema {
+	return &openAPISchema{Type: "string", Format: "binary", ProtobufType: string(md.FullName())}
+}
+
+// messageSchema returns a reference to the message's schema, adding
+// it (and any messages it refers to) to the components.
+func messageSchema(md protoreflect.MessageDescriptor, schemas map[string]*openAPISchema) *openAPISchema {
+	if s, ok := wellKnownSchemas[md.FullName()]; ok {
+		return s
+	}
+
+	name := string(md.FullName())
+	ref := &openAPISchema{Ref: "#/components/schemas/" + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+
+	s := &openAPISchema{
+		Type:         "object",
+		Properties:   make(map[string]*openAPISchema),
+		ProtobufType: name,
+	}
+	schemas[name] = s
+
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		switch {
+		case fd.IsMap():
+			s.Properties[fd.JSONName()] = &openAPISchema{
+				Type:                 "object",
+				AdditionalProperties: fieldSchema(fd.MapValue(), schemas),
+			}
+		case fd.IsList():
+			s.Properties[fd.JSONName()] = &openAPISchema{
+				Type:  "array",
+				Items: fieldSchema(fd, schemas),
+			}
+		default:
+			s.Properties[fd.JSONName()] = fieldSchema(fd, schemas)
+		}
+	}
+
+	return ref
+}
+
+// fieldSchema returns the schema of a (singular) field value, following
+// the protobuf JSON mapping.
+func fieldSchema(fd protoreflect.FieldDescriptor, schemas map[string]*openAPISchema) *openAPISchema {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return &openAPISchema{Type: "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return &openAPISchema{Type: "integer", Format: "uint32"}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return &openAPISchema{Type: "string", Format: "int64"}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return &openAPISchema{Type: "string", Format: "uint64"}
+	case protoreflect.FloatKind:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case protoreflect.DoubleKind:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case protoreflect.StringKind:
+		return &openAPISchema{Type: "string"}
+	case protoreflect.BytesKind:
+		return &openAPISchema{Type: "string", Format: "byte"}
+	case protoreflect.EnumKind:
+		return enumSchema(fd.Enum(), schemas)
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return messageSchema(fd.Message(), schemas)
+	}
+
+	return &openAPISchema{}
+}
+
+func enumSchema(ed protoreflect.EnumDescriptor, schemas map[string]*openAPISchema) *openAPISchema {
+	name := string(ed.FullName())
+	ref := &openAPISchema{Ref: "#/components/schemas/" + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+
+	s := &openAPISchema{Type: "string", ProtobufType: name}
+	values := ed.Values()
+	for i := 0; i < values.Len(); i++ {
+		s.Enum = append(s.Enum, string(values.Get(i).Name()))
+	}
+	schemas[name] = s
+
+	return ref
+}
+
+var (
+	// wellKnownSchemas are the schemas of the well-known types, which
+	// have special representations in the protobuf JSON mapping.
+	wellKnownSchemas = map[protoreflect.FullName]*openAPISchema{
+		"google.protobuf.Any":         {Type: "object", Description: "An Any, with its type in the '@type' field."},
+		"google.protobuf.Duration":    {Type: "string", Format: "duration", Description: "A duration in seconds, with an 's' suffix (i.e. '1.5s')."},
+		"google.protobuf.Timestamp":   {Type: "string", Format: "date-time"},
+		"google.protobuf.FieldMask":   {Type: "string"},
+		"google.protobuf.Empty":       {Type: "object"},
+		"google.protobuf.Struct":      {Type: "object"},
+		"google.protobuf.Value":       {},
+		"google.protobuf.ListValue":   {Type: "array", Items: &openAPISchema{}},
+		"google.protobuf.BoolValue":   {Type: "boolean"},
+		"google.protobuf.Int32Value":  {Type: "integer", Format: "int32"},
+		"google.protobuf.UInt32Value": {Type: "integer", Format: "uint32"},
+		"google.protobuf.Int64Value":  {Type: "string", Format: "int64"},
+		"google.protobuf.UInt64Value": {Type: "string", Format: "uint64"},
+		"google.protobuf.FloatValue":  {Type: "number", Format: "float"},
+		"google.protobuf.DoubleValue": {Type: "number", Format: "double"},
+		"google.protobuf.StringValue": {Type: "string"},
+		"google.protobuf.BytesValue":  {Type: "string", Format: "byte"},
+	}
+)
@@ -0,0 +1,124 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestOpenAPI(t *testing.T) {
+	addr, cleanup := setup(t, WithOpenAPIRoute("openapi.json", OpenAPIInfo{Title: "Echo", Version: "v1"}))
+	defer cleanup()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/openapi.json", addr))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var doc openAPIDoc
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	assert.Equal(t, OpenAPIInfo{Title: "Echo", Version: "v1"}, doc.Info)
+	require.Len(t, doc.Paths, 2)
+
+	unary := doc.Paths["/api/echo.v1.Echo/Echo"]
+	require.NotNil(t, unary)
+	require.NotNil(t, unary.Post)
+	assert.Nil(t, unary.Get)
+	assert.Equal(t, "echo.v1.Echo.Echo", unary.Post.OperationID)
+	assert.Equal(t, "echo.v1.Echo/Echo", unary.Post.GRPCMethod)
+	assert.Equal(t, map[string]*openAPIMediaType{
+		"application/proto": {Schema: &openAPISchema{Type: "string", Format: "binary", ProtobufType: "echo.v1.EchoRequest"}},
+	}, unary.Post.RequestBody.Content)
+	assert.Equal(t, map[string]*openAPIMediaType{
+		"application/proto": {Schema: &openAPISchema{Type: "string", Format: "binary", ProtobufType: "echo.v1.EchoResponse"}},
+	}, unary.Post.Responses["200"].Content)
+	assert.Equal(t, "#/components/schemas/grpc.Status", unary.Post.Responses["default"].Content["text/plain"].Schema.Ref)
+	assert.Nil(t, unary.Post.Websocket)
+
+	stream := doc.Paths["/api/echo.v1.Echo/EchoStream"]
+	require.NotNil(t, stream)
+	require.NotNil(t, stream.Get)
+	assert.Nil(t, stream.Post)
+	require.NotNil(t, stream.Get.Websocket)
+	assert.True(t, stream.Get.Websocket.ServerStreams)
+	assert.False(t, stream.Get.Websocket.ClientStreams)
+	assert.Equal(t, "#/components/schemas/echo.v1.EchoStreamRequest", stream.Get.Websocket.Request.Ref)
+	assert.Equal(t, "#/components/schemas/echo.v1.EchoStreamResponse", stream.Get.Websocket.Response.Ref)
+	assert.Contains(t, stream.Get.Responses, "101")
+
+	schemas := doc.Components.Schemas
+	assert.Equal(t, &openAPISchema{
+		Type: "object",
+		Properties: map[string]*openAPISchema{
+			"message":      {Type: "string"},
+			"repetitions":  {Type: "integer", Format: "uint32"},
+			"responses":    {Type: "string", Format: "uint64"},
+			"interval":     wellKnownSchemas["google.protobuf.Duration"],
+			"statusCode":   {Type: "integer", Format: "int32"},
+			"failureIndex": {Type: "integer", Format: "int32"},
+		},
+		ProtobufType: "echo.v1.EchoStreamRequest",
+	}, schemas["echo.v1.EchoStreamRequest"])
+	assert.NotContains(t, schemas, "google.protobuf.Duration")
+}
+
+func TestOpenAPI_Cacheable(t *testing.T) {
+	m, cleanup := setupMux(t, func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, &serv{})
+	}, WithCacheableMethod("echo.v1.Echo/Echo", CachePolicy{}))
+	defer cleanup()
+
+	b, err := m.OpenAPI(context.Background())
+	require.NoError(t, err)
+
+	var doc openAPIDoc
+	require.NoError(t, json.Unmarshal(b, &doc))
+
+	unary := doc.Paths["/api/echo.v1.Echo/Echo"]
+	require.NotNil(t, unary.Post)
+	require.NotNil(t, unary.Get)
+	assert.Equal(t, "echo.v1.Echo.Echo.Get", unary.Get.OperationID)
+	assert.Nil(t, unary.Get.RequestBody)
+	require.Len(t, unary.Get.Parameters, 2)
+	assert.Equal(t, "message", unary.Get.Parameters[0].Name)
+	assert.Equal(t, "#/components/schemas/echo.v1.EchoRequest", unary.Get.Parameters[1].Content["application/json"].Schema.Ref)
+	assert.NotNil(t, unary.Get.Responses["304"])
+	assert.NotNil(t, unary.Get.Responses["200"])
+	assert.Nil(t, unary.Post.Responses["304"])
+}
+
+func TestOpenAPI_Connect(t *testing.T) {
+	m, cleanup := setupMux(t, func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, &serv{})
+	}, WithConnect(), WithCacheableMethod("echo.v1.Echo/Echo", CachePolicy{}))
+	defer cleanup()
+
+	b, err := m.OpenAPI(context.Background())
+	require.NoError(t, err)
+
+	var doc openAPIDoc
+	require.NoError(t, json.Unmarshal(b, &doc))
+
+	// JSON requests are served using Connect.
+	post := doc.Paths["/api/echo.v1.Echo/Echo"].Post
+	assert.Equal(t, "#/components/schemas/echo.v1.EchoRequest", post.RequestBody.Content["application/json"].Schema.Ref)
+	assert.Equal(t, "binary", post.RequestBody.Content["application/proto"].Schema.Format)
+	assert.Equal(t, "#/components/schemas/echo.v1.EchoResponse", post.Responses["200"].Content["application/json"].Schema.Ref)
+	assert.Equal(t, "#/components/schemas/connect.Error", post.Responses["default"].Content["application/json"].Schema.Ref)
+	assert.Contains(t, doc.Components.Schemas, "connect.Error")
+
+	// GET requests aren't, so their responses are only protobuf.
+	get := doc.Paths["/api/echo.v1.Echo/Echo"].Get
+	assert.Len(t, get.Responses["200"].Content, 1)
+	assert.Len(t, get.Responses["default"].Content, 1)
+}
@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// passthroughMethod is a method served to native gRPC clients.
+type passthroughMethod struct {
+	limiter   *limiter
+	streaming bool
+}
+
+// WithGRPCPassthrough serves native gRPC clients on the same port as the
+// gateway.
+//
+// HTTP/2 requests with a gRPC content type (application/grpc, optionally with
+// a +codec suffix) are handed to the *grpc.Server passed to New, while all other
+// requests (HTTP/1.1, websockets, etc) continue to be handled by the gateway.
+// When serving without TLS, HTTP/2 cleartext (h2c) connections are accepted.
+//
+// As with gateway requests, the client certificate identity metadata (see
+// TLSConfig) is only ever set by the gateway, and rate limits apply. Limits
+// are shared with the gateway's transports.
+//
+// grpc.Server.ServeHTTP uses the net/http HTTP/2 implementation, which doesn't
+// support some of the features (and performance) of grpc.Server.Serve.
+func WithGRPCPassthrough() MuxOption {
+	return func(m *Mux) {
+		m.grpcPassthrough = true
+	}
+}
+
+// configurePassthrough sets up passthrough to serv, if configured. Passthrough
+// is disabled if serv isn't a *grpc.Server.
+func (m *Mux) configurePassthrough(serv ServiceInfoProvider) {
+	if !m.grpcPassthrough {
+		return
+	}
+
+	s, ok := serv.(*grpc.Server)
+	if !ok {
+		m.log.Errorf("gRPC passthrough requires a *grpc.Server (got %T), disabling passthrough", serv)
+		return
+	}
+	m.grpcServer = s
+
+	// Limiters are resolved up front, since they're created lazily.
+	m.passthroughMethods = make(map[string]*passthroughMethod)
+	for service, info := range s.GetServiceInfo() {
+		for _, method := range info.Methods {
+			fullMethod := fmt.Sprintf("%s/%s", service, method.Name)
+			m.passthroughMethods[fullMethod] = &passthroughMethod{
+				limiter:   m.limiter(fullMethod),
+				streaming: method.IsServerStream || method.IsClientStream,
+			}
+		}
+	}
+}
+
+// serveGRPC serves a native gRPC request using the *grpc.Server.
+func (m *Mux) serveGRPC(w http.ResponseWriter, req *http.Request) {
+	// The identity keys are only ever set by the gateway, so that clients
+	// can't impersonate others by setting the corresponding metadata.
+	for _, k := range identityKeys {
+		req.Header.Del(k)
+	}
+	for k, v := range clientIdentity(req.TLS) {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+
+	if method, ok := m.passthroughMethods[strings.TrimPrefix(req.URL.Path, "/")]; ok && method.limiter != nil {
+		key := m.clientKey(req)
+		if ok, _ := method.limiter.allow(key, time.Now()); !ok {
+			writeGRPCStatus(w, status.New(codes.ResourceExhausted, "rate limit exceeded"))
+			return
+		}
+		if method.streaming {
+			if !method.limiter.acquireStream(key) {
+				writeGRPCStatus(w, status.New(codes.ResourceExhausted, "too many streams"))
+				return
+			}
+			defer method.limiter.releaseStream(key)
+		}
+	}
+
+	m.grpcServer.ServeHTTP(w, req)
+}
+
+// writeGRPCStatus writes a trailers-only gRPC response with the status.
+func writeGRPCStatus(w http.ResponseWriter, s *status.Status) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(s.Code())))
+	w.Header().Set("Grpc-Message", s.Message())
+	w.WriteHeader(http.StatusOK)
+}
+
+// handler returns the handler for all requests served by the Mux.
+func (m *Mux) handler() http.Handler {
+	if !m.http2() {
+		return m.router
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if m.grpcServer != nil && isGRPCRequest(req) {
+			m.serveGRPC(w, req)
+			return
+		}
+
+		m.router.ServeHTTP(w, req)
+	})
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// http2 returns whether HTTP/2 is served, which is required for gRPC
+// passthrough, and bidirectional Connect streams.
+func (m *Mux) http2() bool {
+	return m.grpcServer != nil || m.connect
+}
+
+// tlsServer returns the server used to serve HTTPS, negotiating HTTP/2 if
+// necessary.
+func (m *Mux) tlsServer(config *tls.Config) (*http.Server, error) {
+	srv := &http.Server{Handler: m.handler()}
+	if !m.http2() {
+		return srv, nil
+	}
+
+	// The certificates (and protocols) are selected per connection, so that
+	// they can be reloaded.
+	getConfig := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		conf, err := getConfig(hello)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.NextProtos = append([]string{http2.NextProtoTLS}, conf.NextProtos...)
+		return conf, nil
+	}
+
+	return srv, http2.ConfigureServer(srv, &http2.Server{})
+}
+
+func isGRPCRequest(req *http.Request) bool {
+	if req.ProtoMajor != 2 {
+		return false
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+")
+}
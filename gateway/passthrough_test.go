@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestGRPCPassthrough(t *testing.T) {
+	addr, cleanup := setup(t, WithGRPCPassthrough())
+	defer cleanup()
+
+	cc, err := grpc.Dial(addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+
+	// Native gRPC clients are served over h2c.
+	client := echo.NewEchoClient(cc)
+	resp, err := client.Echo(context.Background(), &echo.EchoRequest{Message: "a", Repetitions: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "aaa", resp.Message)
+
+	stream, err := client.EchoStream(context.Background(), &echo.EchoStreamRequest{
+		Message:     "b",
+		Repetitions: 2,
+		Responses:   2,
+		Interval:    ptypes.DurationProto(0),
+	})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "bb", resp.Message)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	// Gateway requests are still served over HTTP/1.1 and h2c.
+	b, err := proto.Marshal(&echo.EchoRequest{Message: "c", Repetitions: 2})
+	require.NoError(t, err)
+
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	for _, httpClient := range []*http.Client{http.DefaultClient, h2cClient} {
+		httpResp, err := httpClient.Post(fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr), "application/proto", bytes.NewReader(b))
+		require.NoError(t, err)
+
+		respBytes, err := ioutil.ReadAll(httpResp.Body)
+		require.NoError(t, err)
+		httpResp.Body.Close()
+		require.Equal(t, http.StatusOK, httpResp.StatusCode)
+
+		resp := &echo.EchoResponse{}
+		require.NoError(t, proto.Unmarshal(respBytes, resp))
+		assert.Equal(t, "cc", resp.Message)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"d","repetitions":1,"responses":1,"interval":"0s"}`)))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"message":"d"}`, string(data))
+}
+
+func TestGRPCPassthrough_TLS(t *testing.T) {
+	ca := newTestCert(t, nil, "ca")
+	server := newTestCert(t, ca, "server")
+	client := newTestCert(t, ca, "client")
+
+	addr, cleanup := setupTLS(t, ca, server, false, WithGRPCPassthrough())
+	defer cleanup()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-key", "value", ClientSubjectKey, "CN=admin")
+	resp, err := echo.NewEchoClient(cc).Echo(ctx, &echo.EchoRequest{Message: "x-key"})
+	require.NoError(t, err)
+	assert.Equal(t, "value", resp.Message)
+
+	// Clients can't impersonate a verified identity.
+	resp, err = echo.NewEchoClient(cc).Echo(ctx, &echo.EchoRequest{Message: ClientSubjectKey})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Message)
+
+	certCC, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{client.tlsCert()},
+	})))
+	require.NoError(t, err)
+	defer certCC.Close()
+
+	resp, err = echo.NewEchoClient(certCC).Echo(ctx, &echo.EchoRequest{Message: ClientSubjectKey})
+	require.NoError(t, err)
+	assert.Equal(t, "CN=client", resp.Message)
+
+	// Gateway requests continue to work over HTTP/1.1.
+	actual, err := tlsEcho(addr, ca, nil, nil, ClientSubjectKey)
+	require.NoError(t, err)
+	assert.Empty(t, actual)
+}
+
+func TestGRPCPassthrough_RateLimit(t *testing.T) {
+	addr, cleanup := setup(t,
+		WithGRPCPassthrough(),
+		WithMethodRateLimit("echo.v1.Echo/Echo", RateLimit{Rate: 0.1, Burst: 1}),
+	)
+	defer cleanup()
+
+	cc, err := grpc.Dial(addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+
+	client := echo.NewEchoClient(cc)
+	_, err = client.Echo(context.Background(), &echo.EchoRequest{Message: "a"})
+	require.NoError(t, err)
+
+	_, err = client.Echo(context.Background(), &echo.EchoRequest{Message: "a"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// The limit is shared with gateway requests.
+	httpResp, err := http.Post(fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr), "application/proto", nil)
+	require.NoError(t, err)
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+}
+
+func TestGRPCPassthrough_RequiresServer(t *testing.T) {
+	for _, serv := range []ServiceInfoProvider{fakeServices, nil} {
+		var m *Mux
+		require.NotPanics(t, func() {
+			m = New(serv, echoConn{}, WithGRPCPassthrough())
+		})
+		assert.Nil(t, m.grpcServer)
+	}
+}
+
+func TestIsGRPCRequest(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"application/grpc":       true,
+		"application/grpc+proto": true,
+		"application/grpc-web":   false,
+		"application/proto":      false,
+	} {
+		req := &http.Request{ProtoMajor: 2, Header: http.Header{}}
+		req.Header.Set("Content-Type", contentType)
+		assert.Equal(t, expected, isGRPCRequest(req), contentType)
+
+		// gRPC requires HTTP/2.
+		req.ProtoMajor = 1
+		assert.False(t, isGRPCRequest(req), contentType)
+	}
+}
@@ -0,0 +1,230 @@
+package gateway
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sweepInterval = time.Minute
+)
+
+// ClientKeyFunc identifies the client making a request, for the purposes
+// of rate limiting.
+type ClientKeyFunc func(req *http.Request) string
+
+// ClientIP identifies clients by their remote IP address.
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// ClientHeader identifies clients by the value of the specified header,
+// falling back to ClientIP if the header is not present.
+func ClientHeader(name string) ClientKeyFunc {
+	return func(req *http.Request) string {
+		if v := req.Header.Get(name); v != "" {
+			return name + ":" + v
+		}
+
+		return ClientIP(req)
+	}
+}
+
+// ClientSubject identifies clients by the subject of their verified client
+// certificate (see TLSConfig), falling back to ClientIP if not present.
+func ClientSubject(req *http.Request) string {
+	if md := clientIdentity(req.TLS); md != nil {
+		return "subject:" + md.Get(ClientSubjectKey)[0]
+	}
+
+	return ClientIP(req)
+}
+
+// RateLimit limits the requests made by a single client.
+type RateLimit struct {
+	// Rate is the number of requests (or new streams) permitted per second,
+	// with bursts of up to Burst requests. If Rate is zero, requests are not
+	// rate limited.
+	Rate  float64
+	Burst int
+
+	// MaxStreams is the maximum number of concurrent streams. If zero, the
+	// number of streams is not limited.
+	MaxStreams int
+}
+
+// WithClientKey sets the function used to identify clients for rate limiting.
+// By default, clients are identified by ClientIP.
+func WithClientKey(f ClientKeyFunc) MuxOption {
+	return func(m *Mux) {
+		m.clientKey = f
+	}
+}
+
+// WithRateLimit sets the limit applied to each client. The limit is shared
+// across all methods that don't have a limit set by WithMethodRateLimit.
+//
+// Unary requests that exceed the limit are rejected with a 429 and Retry-After
+// header. Streams that exceed the limit are closed with ResourceExhausted.
+func WithRateLimit(limit RateLimit) MuxOption {
+	return func(m *Mux) {
+		m.rateLimit = &limit
+	}
+}
+
+// WithMethodRateLimit sets the limit applied to each client for the specified
+// method (i.e. `echo.v1.Echo/Echo`).
+func WithMethodRateLimit(fullMethod string, limit RateLimit) MuxOption {
+	return func(m *Mux) {
+		if m.methodRateLimits == nil {
+			m.methodRateLimits = make(map[string]RateLimit)
+		}
+		m.methodRateLimits[strings.TrimPrefix(fullMethod, "/")] = limit
+	}
+}
+
+// limiter returns the limiter for the specified method, or nil if the
+// method isn't limited. A method's limiter is shared by all of the transports
+// it's served over, so clients can't exceed the limit by switching between them.
+func (m *Mux) limiter(fullMethod string) *limiter {
+	if limit, ok := m.methodRateLimits[fullMethod]; ok {
+		if l, ok := m.methodLimiters[fullMethod]; ok {
+			return l
+		}
+
+		if m.methodLimiters == nil {
+			m.methodLimiters = make(map[string]*limiter)
+		}
+		m.methodLimiters[fullMethod] = newLimiter(limit)
+		return m.methodLimiters[fullMethod]
+	}
+	if m.rateLimit == nil {
+		return nil
+	}
+
+	if m.defaultLimiter == nil {
+		m.defaultLimiter = newLimiter(*m.rateLimit)
+	}
+	return m.defaultLimiter
+}
+
+// limiter is a set of per-client token buckets and stream counts.
+type limiter struct {
+	limit RateLimit
+
+	sync.Mutex
+	buckets   map[string]*bucket
+	streams   map[string]int
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(limit RateLimit) *limiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	return &limiter{
+		limit:     limit,
+		buckets:   make(map[string]*bucket),
+		streams:   make(map[string]int),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow consumes a token for the client, returning how long the client
+// should wait before retrying if none were available.
+func (l *limiter) allow(key string, now time.Time) (ok bool, retryAfter time.Duration) {
+	if l.limit.Rate <= 0 {
+		return true, 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// acquireStream reserves a stream for the client, returning false if the
+// client has reached the maximum number of streams.
+func (l *limiter) acquireStream(key string) bool {
+	if l.limit.MaxStreams <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.streams[key] >= l.limit.MaxStreams {
+		return false
+	}
+
+	l.streams[key]++
+	return true
+}
+
+func (l *limiter) releaseStream(key string) {
+	if l.limit.MaxStreams <= 0 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.streams[key] <= 1 {
+		delete(l.streams, key)
+	} else {
+		l.streams[key]--
+	}
+}
+
+// sweep removes buckets that would have refilled completely, since they're
+// equivalent to a new bucket.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// retryAfterSeconds formats a Retry-After value, rounding up to the nearest second.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(math.Max(d.Seconds(), 1))))
+}
@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestLimiter_TokenBucket(t *testing.T) {
+	l := newLimiter(RateLimit{Rate: 2, Burst: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.allow("a", now)
+		require.True(t, ok)
+	}
+
+	ok, retryAfter := l.allow("a", now)
+	require.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// Other clients have their own bucket.
+	ok, _ = l.allow("b", now)
+	assert.True(t, ok)
+
+	ok, _ = l.allow("a", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	// Idle buckets should be swept once refilled.
+	l.allow("c", now.Add(2*sweepInterval))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestLimiter_Streams(t *testing.T) {
+	l := newLimiter(RateLimit{MaxStreams: 2})
+
+	assert.True(t, l.acquireStream("a"))
+	assert.True(t, l.acquireStream("a"))
+	assert.False(t, l.acquireStream("a"))
+	assert.True(t, l.acquireStream("b"))
+
+	l.releaseStream("a")
+	assert.True(t, l.acquireStream("a"))
+
+	l.releaseStream("a")
+	l.releaseStream("a")
+	l.releaseStream("b")
+	assert.Empty(t, l.streams)
+}
+
+func TestRateLimit_Unary(t *testing.T) {
+	addr, cleanup := setup(t, WithRateLimit(RateLimit{Rate: 0.1, Burst: 2}))
+	defer cleanup()
+
+	b, err := proto.Marshal(&echo.EchoRequest{Message: "hello", Repetitions: 1})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		httpResp, err := http.Post(
+			fmt.Sprintf("http://%s/api/echo.v1.Echo/Echo", addr),
+			"application/proto",
+			bytes.NewBuffer(b),
+		)
+		require.NoError(t, err)
+
+		if i < 2 {
+			assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+			assert.Equal(t, "10", httpResp.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestRateLimit_Streams(t *testing.T) {
+	addr, cleanup := setup(
+		t,
+		WithMethodRateLimit("/echo.v1.Echo/EchoStream", RateLimit{MaxStreams: 1}),
+	)
+	defer cleanup()
+
+	b, err := proto.Marshal(&echo.EchoStreamRequest{
+		Message:     "hello",
+		Repetitions: 1,
+		Responses:   3,
+		Interval:    ptypes.DurationProto(50 * time.Millisecond),
+	})
+	require.NoError(t, err)
+
+	url := fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr)
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.NoError(t, first.WriteMessage(websocket.BinaryMessage, b))
+	_, _, err = first.ReadMessage()
+	require.NoError(t, err)
+
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	_, _, err = second.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.ResourceExhausted)))
+
+	// Once the first stream completes, new streams are permitted.
+	for {
+		if _, _, err = first.ReadMessage(); err != nil {
+			break
+		}
+	}
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+
+	var third *websocket.Conn
+	require.Eventually(t, func() bool {
+		third, _, err = websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		require.NoError(t, third.WriteMessage(websocket.BinaryMessage, b))
+
+		_, _, err = third.ReadMessage()
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, third.Close())
+}
+
+func TestRateLimit_SharedAcrossTransports(t *testing.T) {
+	addr, cleanup := setup(
+		t,
+		WithConnect(),
+		WithMethodRateLimit("echo.v1.Echo/EchoStream", RateLimit{Rate: 0.1, Burst: 1}),
+	)
+	defer cleanup()
+
+	// The websocket stream spends the method's only token...
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr), nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"a","responses":1,"interval":"0s"}`)))
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+	conn.Close()
+
+	// ...so a Connect stream of the same method is limited.
+	body := envelope(0, []byte(`{"message":"a","responses":1,"interval":"0s"}`))
+	_, b := connectRequest(t, fmt.Sprintf("http://%s/api/echo.v1.Echo/EchoStream", addr), "application/connect+json", body, nil)
+	_, end := readConnectStream(t, bytes.NewReader(b))
+	require.NotNil(t, end.Error)
+	assert.Equal(t, "resource_exhausted", end.Error.Code)
+}
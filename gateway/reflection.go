@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+var (
+	// The v1 and v1alpha messages are identical on the wire, so older servers
+	// can be supported by only changing the method.
+	reflectionMethods = []string{
+		"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+		"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+	}
+
+	reflectionDesc = &grpc.StreamDesc{
+		StreamName:    "ServerReflectionInfo",
+		ServerStreams: true,
+		ClientStreams: true,
+	}
+)
+
+// reflectionClient is a minimal server reflection client that works over
+// the gateway's connection, which uses the BinaryCodec.
+type reflectionClient struct {
+	cs     grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func newReflectionClient(ctx context.Context, cc grpc.ClientConnInterface) (*reflectionClient, error) {
+	var err error
+	for _, method := range reflectionMethods {
+		streamCtx, cancel := context.WithCancel(ctx)
+
+		var cs grpc.ClientStream
+		cs, err = cc.NewStream(streamCtx, reflectionDesc, method)
+		if err == nil {
+			r := &reflectionClient{cs: cs, cancel: cancel}
+
+			// Streams are lazily established, so we have to make a request
+			// to determine whether or not the method is supported.
+			if _, err = r.listServices(); err == nil {
+				return r, nil
+			}
+		}
+
+		cancel()
+		if status.Code(err) != codes.Unimplemented {
+			break
+		}
+	}
+
+	return nil, errors.Wrap(err, "failed to initialize reflection stream")
+}
+
+func (r *reflectionClient) close() {
+	_ = r.cs.CloseSend()
+	r.cancel()
+}
+
+func (r *reflectionClient) listServices() ([]string, error) {
+	resp, err := r.send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var services []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		services = append(services, s.Name)
+	}
+
+	return services, nil
+}
+
+func (r *reflectionClient) fileContainingSymbol(symbol string) ([]*descriptorpb.FileDescriptorProto, error) {
+	return r.files(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{
+			FileContainingSymbol: symbol,
+		},
+	})
+}
+
+func (r *reflectionClient) fileByFilename(name string) ([]*descriptorpb.FileDescriptorProto, error) {
+	return r.files(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileByFilename{
+			FileByFilename: name,
+		},
+	})
+}
+
+func (r *reflectionClient) files(req *reflectionpb.ServerReflectionRequest) ([]*descriptorpb.FileDescriptorProto, error) {
+	resp, err := r.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*descriptorpb.FileDescriptorProto
+	for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		fd := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(b, fd); err != nil {
+			return nil, errors.Wrap(err, "invalid file descriptor")
+		}
+		files = append(files, fd)
+	}
+
+	return files, nil
+}
+
+func (r *reflectionClient) send(req *reflectionpb.ServerReflectionRequest) (*reflectionpb.ServerReflectionResponse, error) {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.cs.SendMsg(b); err != nil {
+		return nil, err
+	}
+
+	respBytes := new([]byte)
+	if err := r.cs.RecvMsg(respBytes); err != nil {
+		return nil, err
+	}
+
+	resp := &reflectionpb.ServerReflectionResponse{}
+	if err := proto.Unmarshal(*respBytes, resp); err != nil {
+		return nil, err
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, status.Error(codes.Code(e.ErrorCode), e.ErrorMessage)
+	}
+
+	return resp, nil
+}
+
+// resolve adds the file containing the symbol, and all of its dependencies,
+// to protos.
+func (r *reflectionClient) resolve(symbol string, protos map[string]*descriptorpb.FileDescriptorProto) error {
+	files, err := r.fileContainingSymbol(symbol)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %s", symbol)
+	}
+	for _, fd := range files {
+		protos[fd.GetName()] = fd
+	}
+
+	// Servers may omit dependencies they've already sent on the stream,
+	// so we fetch anything that's missing. If the server doesn't provide any
+	// new files, it can't provide the missing ones either.
+	for missing := missingDependencies(protos); len(missing) > 0; missing = missingDependencies(protos) {
+		resolved := len(protos)
+		for _, name := range missing {
+			files, err := r.fileByFilename(name)
+			if err != nil {
+				return errors.Wrapf(err, "failed to resolve %s", name)
+			}
+			for _, fd := range files {
+				protos[fd.GetName()] = fd
+			}
+		}
+
+		if len(protos) == resolved {
+			return errors.Errorf("failed to resolve %s: server didn't provide %v", symbol, missing)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,433 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// resumableParam is the query parameter used to open a resumable stream.
+	resumableParam = "resumable"
+
+	// resumeParam and resumeSeqParam are the query parameters used to resume
+	// a stream, with the token, and the sequence number of the last message
+	// that was received.
+	resumeParam    = "resume"
+	resumeSeqParam = "seq"
+
+	defaultResumeBufferSize  = 64
+	defaultResumeGracePeriod = 30 * time.Second
+
+	// The type of the frame containing a resume token (see frameMessage).
+	frameResumeToken = 2
+)
+
+var (
+	errResumeNotFound   = status.Error(codes.NotFound, "unknown or expired resume token")
+	errResumeTooOld     = status.Error(codes.OutOfRange, "missed messages are no longer buffered")
+	errResumedElsewhere = status.Error(codes.Aborted, "stream resumed by another connection")
+)
+
+// ResumeConfig configures resumable streams.
+type ResumeConfig struct {
+	// BufferSize is the number of messages from the server that are buffered
+	// per stream, to be replayed to resuming clients. If zero, a default of 64
+	// is used.
+	//
+	// While the buffer is full of messages that haven't been sent to the client
+	// (i.e. while it's disconnected), the stream isn't read from, propagating
+	// the backpressure to the server.
+	BufferSize int
+
+	// GracePeriod is how long a stream is kept after its client disconnects,
+	// before it's cancelled. If zero, a default of 30 seconds is used.
+	GracePeriod time.Duration
+}
+
+// WithResumableStreams allows clients to resume streams after their connection
+// drops, without losing messages, or the underlying gRPC stream.
+//
+// Clients opt in by opening the stream with the `resumable` query parameter (i.e.
+// `?resumable=true`). The messages sent to the client are then framed, prefixed
+// with a frame type:
+//
+//	0x02 <token>                      the resume token, which is sent first
+//	0x00 <seq: uint64> <message>      a message, with its (big endian) sequence number
+//
+// Messages sent by the client are unchanged. If the connection drops, the client
+// can reconnect within the grace period, using the token and the sequence number of
+// the last message it received (i.e. `?resume=<token>&seq=<seq>`), and any missed
+// messages are replayed. Resuming with an unknown or expired token closes the
+// connection with NotFound (close code 4005), and resuming too far behind closes
+// it with OutOfRange (close code 4011).
+//
+// The resume token is the only credential required to resume a stream, so it
+// should be treated as a secret. Flow control (see WithFlowControl) doesn't apply
+// to resumable streams, which are bounded by their buffer instead.
+func WithResumableStreams(config ResumeConfig) MuxOption {
+	return func(m *Mux) {
+		if config.BufferSize <= 0 {
+			config.BufferSize = defaultResumeBufferSize
+		}
+		if config.GracePeriod <= 0 {
+			config.GracePeriod = defaultResumeGracePeriod
+		}
+
+		m.resume = &config
+		m.resumable = make(map[string]*resumableStream)
+	}
+}
+
+// serveResumable serves a stream request that opens or resumes a resumable
+// stream, returning false if the request doesn't do either.
+func (m *Mux) serveResumable(ws *websocket.Conn, req *http.Request, header http.Header, cc grpc.ClientConnInterface, fullMethod string, log *logrus.Entry) bool {
+	if m.resume == nil {
+		return false
+	}
+
+	query := req.URL.Query()
+	if token := query.Get(resumeParam); token != "" {
+		after, err := strconv.ParseUint(query.Get(resumeSeqParam), 10, 64)
+		if err != nil {
+			writeCloseStatus(ws, log, status.Error(codes.InvalidArgument, "invalid sequence number"))
+			return true
+		}
+
+		m.resumableMu.Lock()
+		s, ok := m.resumable[token]
+		m.resumableMu.Unlock()
+		if !ok || s.fullMethod != fullMethod {
+			writeCloseStatus(ws, log, errResumeNotFound)
+			return true
+		}
+
+		s.serve(ws, after, log)
+		return true
+	}
+	if query.Get(resumableParam) == "" {
+		return false
+	}
+
+	// The stream outlives the request, so it isn't bound to its context.
+	ctx, cancel := context.WithCancel(m.detachedContext(req, header))
+
+	cs, err := cc.NewStream(ctx, streamDesc, "/"+fullMethod)
+	if err != nil {
+		cancel()
+		log.WithError(err).Warn("Failed to initialize grpc stream")
+		writeCloseStatus(ws, log, err)
+		return true
+	}
+
+	token, err := newToken()
+	if err != nil {
+		cancel()
+		log.WithError(err).Warn("Failed to generate resume token")
+		writeCloseStatus(ws, log, status.Error(codes.Internal, "failed to initialize stream"))
+		return true
+	}
+
+	s := &resumableStream{
+		m:          m,
+		token:      token,
+		fullMethod: fullMethod,
+		config:     *m.resume,
+		cs:         cs,
+		ctx:        ctx,
+		cancel:     cancel,
+		first:      1,
+		changed:    make(chan struct{}),
+	}
+	m.resumableMu.Lock()
+	m.resumable[token] = s
+	m.resumableMu.Unlock()
+
+	go s.recv()
+
+	if err := m.wsCompression.writeMessage(ws, websocket.BinaryMessage, []byte{frameResumeToken}, []byte(token)); err != nil {
+		log.WithError(err).Info("Failed to send resume token")
+		m.removeResumable(s)
+		return true
+	}
+
+	s.serve(ws, 0, log)
+	return true
+}
+
+// newToken returns a random, unguessable token.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// resumableStream is a gRPC stream that can be served by successive connections.
+type resumableStream struct {
+	m          *Mux
+	token      string
+	fullMethod string
+	config     ResumeConfig
+
+	cs     grpc.ClientStream
+	ctx    context.Context
+	cancel context.CancelFunc
+	sendMu sync.Mutex
+
+	mu sync.Mutex
+
+	// buf contains the most recent messages, starting with the message with
+	// sequence number first. sent is the sequence number of the last message
+	// written to a connection.
+	buf   [][]byte
+	first uint64
+	sent  uint64
+
+	// done is set once the stream has finished, with err.
+	done bool
+	err  error
+
+	// attached is the cancellation of the attached connection, if any.
+	// detaches counts the times a connection was detached, so that the
+	// expiry of an earlier detach can be ignored.
+	attached *streamCancel
+	detaches uint64
+	expiry   *time.Timer
+
+	// changed is closed (and replaced) whenever the state changes.
+	changed chan struct{}
+}
+
+// notify wakes up anything waiting for the state to change. s.mu must be held.
+func (s *resumableStream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// recv buffers the messages from the server until the stream finishes.
+func (s *resumableStream) recv() {
+	for {
+		var msg []byte
+		err := s.cs.RecvMsg(&msg)
+
+		s.mu.Lock()
+		if err != nil {
+			s.done, s.err = true, err
+			s.notify()
+			s.mu.Unlock()
+			return
+		}
+
+		// Wait while the buffer is full of messages that haven't been sent.
+		for len(s.buf) >= s.config.BufferSize && s.sent < s.first {
+			changed := s.changed
+			s.mu.Unlock()
+
+			select {
+			case <-changed:
+			case <-s.ctx.Done():
+				return
+			}
+			s.mu.Lock()
+		}
+
+		if len(s.buf) >= s.config.BufferSize {
+			s.buf[0] = nil
+			s.buf = s.buf[1:]
+			s.first++
+		}
+		s.buf = append(s.buf, msg)
+		s.notify()
+		s.mu.Unlock()
+	}
+}
+
+// serve serves the stream to the connection, starting with the message after
+// the specified sequence number, until either the stream finishes, or the
+// connection is lost.
+func (s *resumableStream) serve(ws *websocket.Conn, after uint64, log *logrus.Entry) {
+	ctx, cancelFunc := context.WithCancel(s.ctx)
+	defer cancelFunc()
+	cancel := &streamCancel{cancel: cancelFunc}
+
+	if err := s.attach(cancel, after); err != nil {
+		writeCloseStatus(ws, log, err)
+		return
+	}
+	defer s.detach(cancel)
+
+	keepalive := s.m.startKeepalive(ws, cancel)
+	defer keepalive.stop()
+
+	go func() {
+		for {
+			_, data, err := readMessage(ws)
+			if err != nil {
+				// The connection is lost, so the stream is detached until the
+				// client resumes it.
+				keepalive.readFailed(err)
+				cancel.cancel()
+				return
+			}
+			keepalive.received()
+
+			s.sendMu.Lock()
+			err = s.cs.SendMsg(data)
+			s.sendMu.Unlock()
+			if err == io.EOF {
+				// The stream has finished, and its status is written once
+				// it's received.
+				return
+			} else if err != nil {
+				cancel.cancelWith(err)
+				return
+			}
+		}
+	}()
+
+	err := s.write(ctx, ws, after+1, keepalive)
+
+	keepalive.stop()
+	if reason := cancel.reason(); reason != nil {
+		err = reason
+	}
+	keepalive.sending()
+	writeCloseStatus(ws, log, err)
+}
+
+// write writes the messages, starting with the specified sequence number, until
+// the stream finishes (returning its final status), or the context is cancelled.
+func (s *resumableStream) write(ctx context.Context, ws *websocket.Conn, next uint64, keepalive *keepalive) error {
+	for {
+		s.mu.Lock()
+		if next < s.first {
+			s.mu.Unlock()
+			return errResumeTooOld
+		}
+		if next < s.first+uint64(len(s.buf)) {
+			msg := s.buf[next-s.first]
+			s.mu.Unlock()
+
+			var header [9]byte
+			binary.BigEndian.PutUint64(header[1:], next)
+
+			keepalive.sending()
+			if err := s.m.wsCompression.writeMessage(ws, websocket.BinaryMessage, header[:], msg); err != nil {
+				return err
+			}
+
+			s.mu.Lock()
+			if next > s.sent {
+				s.sent = next
+				s.notify()
+			}
+			s.mu.Unlock()
+
+			next++
+			continue
+		}
+		if s.done {
+			s.mu.Unlock()
+
+			// Every message has been sent, so the stream is complete.
+			s.m.removeResumable(s)
+			return s.err
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// attach attaches a connection to the stream, replacing any existing connection.
+// It fails if the messages after the specified sequence number are no longer
+// buffered.
+func (s *resumableStream) attach(cancel *streamCancel, after uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if after+1 < s.first {
+		return errResumeTooOld
+	}
+	if after >= s.first+uint64(len(s.buf)) {
+		return status.Error(codes.InvalidArgument, "sequence number hasn't been sent")
+	}
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.attached != nil {
+		s.attached.cancelWith(errResumedElsewhere)
+	}
+	s.attached = cancel
+
+	// Messages that were sent to the previous connection, but never received,
+	// have to be sent again.
+	if after < s.sent {
+		s.sent = after
+	}
+
+	return nil
+}
+
+// detach detaches the connection, cancelling the stream unless it's resumed
+// within the grace period.
+func (s *resumableStream) detach(cancel *streamCancel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attached != cancel {
+		return
+	}
+
+	s.attached = nil
+	s.detaches++
+
+	detach := s.detaches
+	s.expiry = time.AfterFunc(s.config.GracePeriod, func() {
+		s.expire(detach)
+	})
+}
+
+// expire cancels the stream if it's still detached by the specified detach,
+// since a timer that already fired can't be stopped by a later attach, and
+// the stream may have been detached again since.
+func (s *resumableStream) expire(detach uint64) {
+	s.mu.Lock()
+	expired := s.attached == nil && s.detaches == detach
+	s.mu.Unlock()
+
+	if expired {
+		s.m.removeResumable(s)
+	}
+}
+
+func (m *Mux) removeResumable(s *resumableStream) {
+	m.resumableMu.Lock()
+	delete(m.resumable, s.token)
+	m.resumableMu.Unlock()
+
+	s.cancel()
+}
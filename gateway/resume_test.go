@@ -0,0 +1,228 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResume(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			for i := 0; i < 2; i++ {
+				req := <-reqs
+				send(req)
+				send(append(req, '!'))
+			}
+			return nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithResumableStreams(ResumeConfig{})))
+	defer cleanup()
+
+	conn := dialResumable(t, addr, "resumable=true")
+	token := readResumeToken(t, conn)
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("a")))
+	seq, msg := readSequenced(t, conn)
+	assert.Equal(t, uint64(1), seq)
+	assert.Equal(t, "a", msg)
+
+	// The connection drops before the second message is received.
+	conn.Close()
+
+	conn = dialResumable(t, addr, "resume="+token+"&seq=1")
+	defer conn.Close()
+
+	seq, msg = readSequenced(t, conn)
+	assert.Equal(t, uint64(2), seq)
+	assert.Equal(t, "a!", msg)
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("b")))
+	for i, expected := range []string{"b", "b!"} {
+		seq, msg = readSequenced(t, conn)
+		assert.Equal(t, uint64(3+i), seq)
+		assert.Equal(t, expected, msg)
+	}
+
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+
+	// Completed streams can't be resumed.
+	conn = dialResumable(t, addr, "resume="+token+"&seq=4")
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.NotFound)), err)
+
+	calls := cc.recorded()
+	require.Len(t, calls, 1)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, calls[0].reqs)
+}
+
+func TestResume_Buffer(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			for i := 1; i <= 5; i++ {
+				send([]byte(fmt.Sprint(i)))
+			}
+			<-reqs
+			return nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithResumableStreams(ResumeConfig{BufferSize: 2})))
+	defer cleanup()
+
+	first := dialResumable(t, addr, "resumable=true")
+	defer first.Close()
+	token := readResumeToken(t, first)
+	for i := 1; i <= 5; i++ {
+		_, msg := readSequenced(t, first)
+		assert.Equal(t, fmt.Sprint(i), msg)
+	}
+
+	// Only the last two messages are buffered.
+	conn := dialResumable(t, addr, "resume="+token+"&seq=2")
+	defer conn.Close()
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.OutOfRange)), err)
+
+	conn = dialResumable(t, addr, "resume="+token+"&seq=6")
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.InvalidArgument)), err)
+
+	// Resuming replaces the existing connection.
+	conn = dialResumable(t, addr, "resume="+token+"&seq=3")
+	defer conn.Close()
+	for i := 4; i <= 5; i++ {
+		seq, msg := readSequenced(t, conn)
+		assert.Equal(t, uint64(i), seq)
+		assert.Equal(t, fmt.Sprint(i), msg)
+	}
+
+	_, _, err = first.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.Aborted)), err)
+}
+
+func TestResume_Expired(t *testing.T) {
+	cc := &streamCtxConn{ctxs: make(chan context.Context, 1)}
+	addr, cleanup := serveMux(t, New(fakeServices, cc, WithResumableStreams(ResumeConfig{
+		GracePeriod: 50 * time.Millisecond,
+	})))
+	defer cleanup()
+
+	conn := dialResumable(t, addr, "resumable=true")
+	token := readResumeToken(t, conn)
+	conn.Close()
+
+	// The stream is cancelled once the grace period expires.
+	assertCancelled(t, <-cc.ctxs)
+
+	conn = dialResumable(t, addr, "resume="+token+"&seq=0")
+	defer conn.Close()
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.NotFound)), err)
+}
+
+func dialResumable(t *testing.T, addr, query string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi?%s", addr, query), nil)
+	require.NoError(t, err)
+	return conn
+}
+
+func readResumeToken(t *testing.T, conn *websocket.Conn) string {
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.True(t, len(data) > 1)
+	require.Equal(t, byte(frameResumeToken), data[0])
+	return string(data[1:])
+}
+
+func readSequenced(t *testing.T, conn *websocket.Conn) (uint64, string) {
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.True(t, len(data) >= 9)
+	require.Equal(t, byte(frameMessage), data[0])
+	return binary.BigEndian.Uint64(data[1:9]), string(data[9:])
+}
+
+func TestResume_SendFailed(t *testing.T) {
+	addr, cleanup := serveMux(t, New(fakeServices, sendFailingConn{}, WithResumableStreams(ResumeConfig{})))
+	defer cleanup()
+
+	conn := dialResumable(t, addr, "resumable=true")
+	defer conn.Close()
+	readResumeToken(t, conn)
+
+	// The connection is closed with the error, rather than ignoring the
+	// client's messages.
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.Internal)), err)
+}
+
+func TestResume_StaleExpiry(t *testing.T) {
+	m := New(fakeServices, echoConn{}, WithResumableStreams(ResumeConfig{GracePeriod: time.Hour}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &resumableStream{
+		m:       m,
+		token:   "token",
+		config:  *m.resume,
+		ctx:     ctx,
+		cancel:  cancel,
+		first:   1,
+		changed: make(chan struct{}),
+	}
+	m.resumable[s.token] = s
+
+	first := &streamCancel{cancel: func() {}}
+	require.NoError(t, s.attach(first, 0))
+	s.detach(first)
+
+	second := &streamCancel{cancel: func() {}}
+	require.NoError(t, s.attach(second, 0))
+	s.detach(second)
+
+	// The timer of the first detach may have fired before the second attach
+	// stopped it, but it doesn't expire the second detach.
+	s.expire(1)
+	assert.NoError(t, ctx.Err())
+
+	s.expiry.Stop()
+	s.expire(2)
+	assert.Error(t, ctx.Err())
+}
+
+// sendFailingConn is an echoConn whose streams fail to send messages.
+type sendFailingConn struct {
+	echoConn
+}
+
+func (c sendFailingConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := c.echoConn.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sendFailingStream{cs}, nil
+}
+
+type sendFailingStream struct {
+	grpc.ClientStream
+}
+
+func (sendFailingStream) SendMsg(interface{}) error {
+	return status.Error(codes.Internal, "induced")
+}
@@ -0,0 +1,420 @@
+package gateway
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const (
+	// AttemptsHeader is the response header containing the number of attempts
+	// made for a unary request with a retry policy.
+	AttemptsHeader = "X-Gateway-Attempts"
+
+	defaultRetryMaxAttempts       = 3
+	defaultRetryInitialBackoff    = 50 * time.Millisecond
+	defaultRetryMaxBackoff        = time.Second
+	defaultRetryBackoffMultiplier = 2
+	defaultRetryBudgetRatio       = 0.1
+	defaultRetryBudgetBurst       = 10
+)
+
+// RetryPolicy configures how failed unary calls are retried (see WithRetryPolicy).
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the original
+	// one. If zero, a default of 3 is used.
+	MaxAttempts int
+
+	// Retries are delayed by a random duration (full jitter) of up to
+	// InitialBackoff*BackoffMultiplier^(n-1), bounded by MaxBackoff. If zero,
+	// defaults of 50ms, 1s, and 2 are used.
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+
+	// RetryableCodes are the codes that are retried. If empty, only
+	// Unavailable is retried.
+	RetryableCodes []codes.Code
+
+	// HedgingDelay, if set, hedges calls rather than retrying them: if a call
+	// hasn't completed within HedgingDelay, another attempt is sent while the
+	// previous ones continue, up to MaxAttempts. The first successful response
+	// is used, and the other attempts are cancelled. Attempts that fail with a
+	// retryable code immediately send the next attempt, without backoff.
+	HedgingDelay time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if p.BackoffMultiplier <= 0 {
+		p.BackoffMultiplier = defaultRetryBackoffMultiplier
+	}
+	if len(p.RetryableCodes) == 0 {
+		p.RetryableCodes = []codes.Code{codes.Unavailable}
+	}
+
+	return p
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	// Calls rejected by an open circuit breaker would just be rejected again.
+	if err == errCircuitOpen {
+		return false
+	}
+
+	code := status.Code(err)
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns the delay before the specified retry (starting at 1).
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	max := float64(p.InitialBackoff) * math.Pow(p.BackoffMultiplier, float64(retry-1))
+	if max > float64(p.MaxBackoff) {
+		max = float64(p.MaxBackoff)
+	}
+
+	return time.Duration(rand.Float64() * max)
+}
+
+// RetryBudget bounds the retries (and hedged attempts) made by the gateway,
+// relative to the number of calls, so that retries can't overload a backend
+// that's already failing.
+type RetryBudget struct {
+	// Ratio is the number of retries allowed per call (i.e. 0.1 allows one
+	// retry for every 10 calls). If zero, a default of 0.1 is used.
+	Ratio float64
+
+	// Burst is the maximum number of retries that can be saved up, which
+	// are also available initially. If zero, a default of 10 is used.
+	Burst int
+}
+
+// RetryStats are the metrics of retried calls.
+type RetryStats struct {
+	// Retries and Hedges are the additional attempts made.
+	Retries uint64 `json:"retries"`
+	Hedges  uint64 `json:"hedges"`
+
+	// Recovered are calls that succeeded after their first attempt
+	// failed (or was slower than a hedged attempt).
+	Recovered uint64 `json:"recovered"`
+
+	// BudgetExhausted are attempts that weren't made since the retry budget
+	// was exhausted.
+	BudgetExhausted uint64 `json:"budget_exhausted"`
+}
+
+// WithRetryPolicy retries failed calls of the specified unary method (i.e.
+// `echo.v1.Echo/Echo`), or hedges them (see RetryPolicy.HedgingDelay).
+//
+// Retrying a call may execute it multiple times, so the policy only applies if
+// the method is declared idempotent (or free of side effects), which requires
+// its descriptors (see WithDescriptors). Otherwise, calls aren't retried, and
+// a warning is logged.
+func WithRetryPolicy(fullMethod string, policy RetryPolicy) MuxOption {
+	return func(m *Mux) {
+		if m.retryPolicies == nil {
+			m.retryPolicies = make(map[string]RetryPolicy)
+		}
+		m.retryPolicies[strings.TrimPrefix(fullMethod, "/")] = policy.withDefaults()
+	}
+}
+
+// WithIdempotentRetries retries failed calls of all unary methods that are
+// declared idempotent (or free of side effects), using the specified policy:
+//
+//	rpc UpdateThing(UpdateThingRequest) returns (Thing) {
+//	    option idempotency_level = IDEMPOTENT;
+//	}
+//
+// Policies set by WithRetryPolicy take precedence.
+func WithIdempotentRetries(policy RetryPolicy) MuxOption {
+	return func(m *Mux) {
+		policy = policy.withDefaults()
+		m.idempotentRetryPolicy = &policy
+	}
+}
+
+// WithRetryBudget configures the budget shared by all retry policies. If not
+// set, the defaults of RetryBudget are used.
+func WithRetryBudget(budget RetryBudget) MuxOption {
+	return func(m *Mux) {
+		m.retryBudgetConfig = budget
+	}
+}
+
+// RetryStats returns the metrics of retried calls.
+func (m *Mux) RetryStats() RetryStats {
+	return RetryStats{
+		Retries:         atomic.LoadUint64(&m.retryStats.Retries),
+		Hedges:          atomic.LoadUint64(&m.retryStats.Hedges),
+		Recovered:       atomic.LoadUint64(&m.retryStats.Recovered),
+		BudgetExhausted: atomic.LoadUint64(&m.retryStats.BudgetExhausted),
+	}
+}
+
+func (m *Mux) retriesEnabled() bool {
+	return len(m.retryPolicies) > 0 || m.idempotentRetryPolicy != nil
+}
+
+// retryPolicy returns the retry policy of the method, or nil if it isn't
+// retried. Only methods declared idempotent (or free of side effects) are
+// retried, since retrying a call may execute it multiple times.
+func (m *Mux) retryPolicy(ctx context.Context, fullMethod string) *RetryPolicy {
+	policy, explicit := m.retryPolicies[fullMethod]
+	if !explicit {
+		if m.idempotentRetryPolicy == nil {
+			return nil
+		}
+		policy = *m.idempotentRetryPolicy
+	}
+
+	level, err := m.idempotencyLevel(ctx, fullMethod)
+	if err != nil {
+		m.log.WithError(err).WithField("method", fullMethod).Debug("Failed to resolve method options")
+	}
+	if level == descriptorpb.MethodOptions_IDEMPOTENCY_UNKNOWN {
+		if explicit {
+			m.warnNotRetried(fullMethod, err)
+		}
+		return nil
+	}
+
+	return &policy
+}
+
+// warnNotRetried logs (once per method) that a method with a retry policy
+// isn't retried, since it isn't declared idempotent.
+func (m *Mux) warnNotRetried(fullMethod string, err error) {
+	m.retryWarnMu.Lock()
+	defer m.retryWarnMu.Unlock()
+
+	if m.retryWarned[fullMethod] {
+		return
+	}
+	if m.retryWarned == nil {
+		m.retryWarned = make(map[string]bool)
+	}
+	m.retryWarned[fullMethod] = true
+
+	log := m.log.WithField("method", fullMethod)
+	if err != nil {
+		log = log.WithError(err)
+	}
+	log.Warn("Method isn't declared idempotent, so it isn't retried")
+}
+
+// invokeWithRetries invokes the unary method, retrying it according to its retry policy.
+func (m *Mux) invokeWithRetries(ctx context.Context, cc grpc.ClientConnInterface, fullMethod string, req []byte) ([]byte, error) {
+	policy := m.retryPolicy(ctx, fullMethod)
+	if policy == nil {
+		return invokeOnce(ctx, cc, fullMethod, req)
+	}
+
+	m.retryBudget.deposit()
+	if policy.HedgingDelay > 0 {
+		return m.hedge(ctx, cc, fullMethod, req, policy)
+	}
+
+	for attempt := 1; ; attempt++ {
+		countAttempt(ctx)
+		resp, err := invokeOnce(ctx, cc, fullMethod, req)
+		if err == nil {
+			if attempt > 1 {
+				atomic.AddUint64(&m.retryStats.Recovered, 1)
+			}
+			return resp, nil
+		}
+
+		if attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			return nil, err
+		}
+		if !m.retryBudget.withdraw() {
+			atomic.AddUint64(&m.retryStats.BudgetExhausted, 1)
+			return nil, err
+		}
+
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		atomic.AddUint64(&m.retryStats.Retries, 1)
+	}
+}
+
+// hedge sends hedged attempts of the call, returning the first successful
+// response, or the last error.
+func (m *Mux) hedge(ctx context.Context, cc grpc.ClientConnInterface, fullMethod string, req []byte, policy *RetryPolicy) ([]byte, error) {
+	type result struct {
+		attempt int
+		resp    []byte
+		err     error
+	}
+
+	// The request may be reused once the call returns, so outstanding
+	// attempts are cancelled, and waited for.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, policy.MaxAttempts)
+	sent, pending := 0, 0
+	send := func() {
+		sent++
+		pending++
+		countAttempt(ctx)
+
+		wg.Add(1)
+		go func(attempt int) {
+			defer wg.Done()
+			resp, err := invokeOnce(ctx, cc, fullMethod, req)
+			results <- result{attempt: attempt, resp: resp, err: err}
+		}(sent)
+	}
+
+	// hedge sends another attempt if allowed, returning whether it did.
+	hedge := func() bool {
+		if sent >= policy.MaxAttempts {
+			return false
+		}
+		if !m.retryBudget.withdraw() {
+			atomic.AddUint64(&m.retryStats.BudgetExhausted, 1)
+			return false
+		}
+
+		atomic.AddUint64(&m.retryStats.Hedges, 1)
+		send()
+		return true
+	}
+
+	send()
+	timer := time.NewTimer(policy.HedgingDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if r.attempt > 1 {
+					atomic.AddUint64(&m.retryStats.Recovered, 1)
+				}
+				return r.resp, nil
+			}
+			if !policy.retryable(r.err) {
+				return nil, r.err
+			}
+			if !hedge() && pending == 0 {
+				return nil, r.err
+			}
+		case <-timer.C:
+			if hedge() {
+				timer.Reset(policy.HedgingDelay)
+			}
+		}
+	}
+}
+
+func invokeOnce(ctx context.Context, cc grpc.ClientConnInterface, fullMethod string, req []byte) ([]byte, error) {
+	resp := new([]byte)
+	if err := cc.Invoke(ctx, "/"+fullMethod, req, resp); err != nil {
+		return nil, err
+	}
+
+	return *resp, nil
+}
+
+// retryBudget is a token bucket, where each call deposits a fraction of a
+// token, and each retry withdraws a token.
+type retryBudget struct {
+	ratio float64
+	max   float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func newRetryBudget(config RetryBudget) *retryBudget {
+	if config.Ratio <= 0 {
+		config.Ratio = defaultRetryBudgetRatio
+	}
+	if config.Burst <= 0 {
+		config.Burst = defaultRetryBudgetBurst
+	}
+
+	return &retryBudget{
+		ratio:  config.Ratio,
+		max:    float64(config.Burst),
+		tokens: float64(config.Burst),
+	}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(b.max, b.tokens+b.ratio)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+type attemptsKey struct{}
+
+// withAttempts returns a context that counts the attempts made by calls using
+// it, and the counter.
+func withAttempts(ctx context.Context) (context.Context, *int32) {
+	attempts := new(int32)
+	return context.WithValue(ctx, attemptsKey{}, attempts), attempts
+}
+
+func countAttempt(ctx context.Context) {
+	if attempts, ok := ctx.Value(attemptsKey{}).(*int32); ok {
+		atomic.AddInt32(attempts, 1)
+	}
+}
+
+// setAttemptsHeader sets the AttemptsHeader, if the call had a retry policy.
+func setAttemptsHeader(h http.Header, attempts *int32) {
+	if n := atomic.LoadInt32(attempts); n > 0 {
+		h.Set(AttemptsHeader, strconv.Itoa(int(n)))
+	}
+}
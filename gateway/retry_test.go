@@ -0,0 +1,283 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// fastRetries is a retry policy with negligible backoff.
+var fastRetries = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+// failingConn returns a fakeConn whose unary calls fail with the specified
+// code the first n times.
+func failingConn(code codes.Code, n int32) *fakeConn {
+	var calls int32
+	return &fakeConn{
+		unary: func(method string, req []byte) ([]byte, error) {
+			if atomic.AddInt32(&calls, 1) <= n {
+				return nil, status.Error(code, "induced")
+			}
+			return req, nil
+		},
+	}
+}
+
+func TestRetry(t *testing.T) {
+	cc := failingConn(codes.Unavailable, 2)
+	m := New(fakeServices, cc, WithDescriptors(testDescriptors()), WithRetryPolicy("test.v1.Test/Unary", fastRetries), WithAdminRoutes("admin"))
+	addr, cleanup := serveMux(t, m)
+	defer cleanup()
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/api/test.v1.Test/Unary", addr), "application/proto", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "3", resp.Header.Get(AttemptsHeader))
+	assert.Len(t, cc.calls, 3)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/admin/retries", addr))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var stats RetryStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, RetryStats{Retries: 2, Recovered: 1}, stats)
+}
+
+func TestRetry_Failures(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		code     codes.Code
+		policy   RetryPolicy
+		status   int
+		attempts string
+	}{
+		{
+			name:     "not retryable",
+			code:     codes.InvalidArgument,
+			policy:   fastRetries,
+			status:   http.StatusBadRequest,
+			attempts: "1",
+		},
+		{
+			name:     "max attempts",
+			code:     codes.Unavailable,
+			policy:   RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+			status:   http.StatusServiceUnavailable,
+			attempts: "2",
+		},
+		{
+			name:     "retryable codes",
+			code:     codes.Aborted,
+			policy:   RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, RetryableCodes: []codes.Code{codes.Aborted}},
+			status:   http.StatusConflict,
+			attempts: "4",
+		},
+	} {
+		cc := failingConn(tc.code, 10)
+		m := New(fakeServices, cc, WithDescriptors(testDescriptors()), WithRetryPolicy("/test.v1.Test/Unary", tc.policy))
+
+		w := postUnary(m, "test.v1.Test/Unary")
+		assert.Equal(t, tc.status, w.Code, tc.name)
+		assert.Equal(t, tc.attempts, w.Header().Get(AttemptsHeader), tc.name)
+		assert.Zero(t, m.RetryStats().Recovered, tc.name)
+	}
+
+	// Methods without a policy aren't retried.
+	cc := failingConn(codes.Unavailable, 1)
+	m := New(fakeServices, cc, WithDescriptors(testDescriptors()), WithRetryPolicy("test.v1.Test/Other", fastRetries))
+
+	w := postUnary(m, "test.v1.Test/Unary")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get(AttemptsHeader))
+	assert.Len(t, cc.calls, 1)
+}
+
+func TestRetry_Idempotent(t *testing.T) {
+	cc := failingConn(codes.Unavailable, 1)
+	m := New(Services{
+		"things.v1.Things": grpc.ServiceInfo{
+			Methods: []grpc.MethodInfo{{Name: "Get"}, {Name: "Put"}},
+		},
+	}, cc, WithDescriptors(thingsDescriptors()), WithIdempotentRetries(fastRetries))
+
+	// Put isn't declared idempotent.
+	w := postUnary(m, "things.v1.Things/Put")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get(AttemptsHeader))
+
+	cc.unary = failingConn(codes.Unavailable, 1).unary
+	w = postUnary(m, "things.v1.Things/Get")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get(AttemptsHeader))
+	assert.Len(t, cc.calls, 3)
+}
+
+func TestRetry_Budget(t *testing.T) {
+	cc := failingConn(codes.Unavailable, 100)
+	m := New(fakeServices, cc,
+		WithDescriptors(testDescriptors()),
+		WithRetryPolicy("test.v1.Test/Unary", fastRetries),
+		WithRetryBudget(RetryBudget{Ratio: 0.5, Burst: 1}),
+	)
+
+	// The initial burst allows a single retry, after which each call earns
+	// half a retry.
+	for i, attempts := range []string{"2", "1", "2", "1"} {
+		w := postUnary(m, "test.v1.Test/Unary")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, attempts, w.Header().Get(AttemptsHeader), i)
+	}
+
+	assert.Equal(t, RetryStats{Retries: 2, BudgetExhausted: 4}, m.RetryStats())
+}
+
+func TestRetry_Hedging(t *testing.T) {
+	cc := &hedgingConn{}
+	m := New(thingsServices, cc, WithDescriptors(thingsDescriptors()), WithRetryPolicy("things.v1.Things/Get", RetryPolicy{
+		MaxAttempts:  3,
+		HedgingDelay: 20 * time.Millisecond,
+	}))
+
+	w := postUnary(m, "things.v1.Things/Get")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Equal(t, "2", w.Header().Get(AttemptsHeader))
+	assert.Equal(t, RetryStats{Hedges: 1, Recovered: 1}, m.RetryStats())
+
+	// The slow attempt is cancelled once the hedged attempt succeeds.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cc.cancelled))
+}
+
+func TestRetry_NotIdempotent(t *testing.T) {
+	// Put isn't declared idempotent, and Unary has no descriptors, so neither
+	// is retried, despite their policies.
+	for method, services := range map[string]Services{
+		"things.v1.Things/Put": thingsServices,
+		"test.v1.Test/Unary":   fakeServices,
+	} {
+		cc := failingConn(codes.Unavailable, 1)
+		m := New(services, cc,
+			WithDescriptors(thingsDescriptors()),
+			WithRetryPolicy(method, fastRetries),
+		)
+
+		w := postUnary(m, method)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, method)
+		assert.Empty(t, w.Header().Get(AttemptsHeader), method)
+		assert.Len(t, cc.recorded(), 1, method)
+		assert.Equal(t, RetryStats{}, m.RetryStats(), method)
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}.withDefaults()
+	assert.Equal(t, 3, p.MaxAttempts)
+	assert.Equal(t, []codes.Code{codes.Unavailable}, p.RetryableCodes)
+
+	for retry, max := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		4: 50 * time.Millisecond,
+		9: 50 * time.Millisecond,
+	} {
+		for i := 0; i < 100; i++ {
+			backoff := p.backoff(retry)
+			assert.True(t, backoff >= 0 && backoff <= max, "retry %d: %v", retry, backoff)
+		}
+	}
+}
+
+// hedgingConn responds to every attempt except the first, which blocks until
+// it's cancelled.
+type hedgingConn struct {
+	grpc.ClientConnInterface
+
+	attempts  int32
+	cancelled int32
+}
+
+func (c *hedgingConn) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, _ ...grpc.CallOption) error {
+	if atomic.AddInt32(&c.attempts, 1) == 1 {
+		<-ctx.Done()
+		atomic.AddInt32(&c.cancelled, 1)
+		return status.FromContextError(ctx.Err()).Err()
+	}
+
+	*reply.(*[]byte) = append([]byte(nil), args.([]byte)...)
+	return nil
+}
+
+func postUnary(m *Mux, fullMethod string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/"+fullMethod, bytes.NewBufferString("hello"))
+	req.Header.Set("Content-Type", "application/proto")
+	w := httptest.NewRecorder()
+	m.router.ServeHTTP(w, req)
+	return w
+}
+
+// testDescriptors returns the descriptors of fakeServices, with the unary
+// method declared idempotent.
+func testDescriptors() *descriptorpb.FileDescriptorSet {
+	return &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			{
+				Name:    proto.String("test/test.proto"),
+				Package: proto.String("test.v1"),
+				Syntax:  proto.String("proto3"),
+				MessageType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("Message"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							{
+								Name:     proto.String("data"),
+								JsonName: proto.String("data"),
+								Number:   proto.Int32(1),
+								Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+								Type:     descriptorpb.FieldDescriptorProto_TYPE_BYTES.Enum(),
+							},
+						},
+					},
+				},
+				Service: []*descriptorpb.ServiceDescriptorProto{
+					{
+						Name: proto.String("Test"),
+						Method: []*descriptorpb.MethodDescriptorProto{
+							{
+								Name:       proto.String("Unary"),
+								InputType:  proto.String(".test.v1.Message"),
+								OutputType: proto.String(".test.v1.Message"),
+								Options: &descriptorpb.MethodOptions{
+									IdempotencyLevel: descriptorpb.MethodOptions_IDEMPOTENT.Enum(),
+								},
+							},
+							{
+								Name:            proto.String("Bidi"),
+								InputType:       proto.String(".test.v1.Message"),
+								OutputType:      proto.String(".test.v1.Message"),
+								ClientStreaming: proto.Bool(true),
+								ServerStreaming: proto.Bool(true),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
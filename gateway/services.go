@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// ServiceInfoProvider provides the services to be exposed by the gateway.
+// It is implemented by *grpc.Server.
+type ServiceInfoProvider interface {
+	GetServiceInfo() map[string]grpc.ServiceInfo
+}
+
+// Services is a static ServiceInfoProvider, used to expose services that
+// aren't registered with a *grpc.Server in the same process.
+type Services map[string]grpc.ServiceInfo
+
+// GetServiceInfo implements ServiceInfoProvider.
+func (s Services) GetServiceInfo() map[string]grpc.ServiceInfo {
+	return s
+}
+
+// ServicesFromDescriptors returns the services defined in the descriptor set.
+func ServicesFromDescriptors(set *descriptorpb.FileDescriptorSet) (Services, error) {
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid descriptor set")
+	}
+
+	services := make(Services)
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			sd := fd.Services().Get(i)
+
+			info := grpc.ServiceInfo{Metadata: fd.Path()}
+			for j := 0; j < sd.Methods().Len(); j++ {
+				md := sd.Methods().Get(j)
+				info.Methods = append(info.Methods, grpc.MethodInfo{
+					Name:           string(md.Name()),
+					IsClientStream: md.IsStreamingClient(),
+					IsServerStream: md.IsStreamingServer(),
+				})
+			}
+
+			services[string(sd.FullName())] = info
+		}
+		return true
+	})
+
+	return services, nil
+}
+
+// ReflectDescriptors returns the descriptors of all services served by the
+// server at the other end of cc, using its reflection service. The connection
+// must use the BinaryCodec.
+func ReflectDescriptors(ctx context.Context, cc grpc.ClientConnInterface) (*descriptorpb.FileDescriptorSet, error) {
+	r, err := newReflectionClient(ctx, cc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+
+	services, err := r.listServices()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list services")
+	}
+	sort.Strings(services)
+
+	protos := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, service := range services {
+		if err := r.resolve(service, protos); err != nil {
+			return nil, err
+		}
+	}
+
+	return &descriptorpb.FileDescriptorSet{File: sortFiles(protos)}, nil
+}
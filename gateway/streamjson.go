@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// JSONSubprotocol is the websocket subprotocol that clients offer to receive
+// every message as JSON.
+//
+// Regardless of the subprotocol, clients can send text messages containing
+// (protojson encoded) JSON, rather than binary messages. Without the subprotocol,
+// messages are sent to the client using the same type (and encoding) as the last
+// message the client sent, defaulting to binary. JSON messages are only supported
+// for methods with descriptors (see WithDescriptors), and aren't supported by
+// resumable streams.
+const JSONSubprotocol = "grpc-over-http.json.v1"
+
+// streamMessages converts between the messages of a stream, and websocket
+// messages, which are either binary, or (protojson encoded) text messages.
+type streamMessages struct {
+	codec *jsonCodec
+
+	// json is set if every message is sent as JSON, otherwise the type of
+	// the last message from the client (lastType) is used.
+	json     bool
+	lastType int32
+}
+
+func (m *Mux) newStreamMessages(ctx context.Context, ws *websocket.Conn, fullMethod string) *streamMessages {
+	return &streamMessages{
+		codec:    m.newJSONCodec(ctx, fullMethod),
+		json:     ws.Subprotocol() == JSONSubprotocol,
+		lastType: websocket.BinaryMessage,
+	}
+}
+
+// decode decodes a message from the client.
+func (s *streamMessages) decode(messageType int, data []byte) ([]byte, error) {
+	atomic.StoreInt32(&s.lastType, int32(messageType))
+	if messageType != websocket.TextMessage {
+		return data, nil
+	}
+
+	return s.codec.unmarshalRequest(data)
+}
+
+// encode encodes a message from the server, returning the websocket message type.
+func (s *streamMessages) encode(data []byte) (int, []byte, error) {
+	if !s.json && atomic.LoadInt32(&s.lastType) != websocket.TextMessage {
+		return websocket.BinaryMessage, data, nil
+	}
+
+	b, err := s.codec.marshalResponse(data)
+	return websocket.TextMessage, b, err
+}
+
+// jsonCodec converts the requests and responses of a method between their
+// binary and (protojson encoded) JSON encodings, using the method's descriptors.
+type jsonCodec struct {
+	m          *Mux
+	ctx        context.Context
+	fullMethod string
+
+	once   sync.Once
+	method protoreflect.MethodDescriptor
+	err    error
+}
+
+func (m *Mux) newJSONCodec(ctx context.Context, fullMethod string) *jsonCodec {
+	return &jsonCodec{m: m, ctx: ctx, fullMethod: fullMethod}
+}
+
+func (c *jsonCodec) descriptor() (protoreflect.MethodDescriptor, error) {
+	c.once.Do(func() {
+		c.method, c.err = c.m.method(c.ctx, c.fullMethod)
+		if c.err != nil {
+			c.err = errors.Wrap(c.err, "JSON messages are not supported")
+		}
+	})
+
+	return c.method, c.err
+}
+
+// unmarshalRequest converts a JSON request to its binary encoding.
+func (c *jsonCodec) unmarshalRequest(data []byte) ([]byte, error) {
+	md, err := c.descriptor()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dynamicpb.NewMessage(md.Input())
+	if err := protojson.Unmarshal(data, msg); err != nil {
+		return nil, errors.Wrap(err, "invalid JSON message")
+	}
+
+	return protov2.Marshal(msg)
+}
+
+// marshalResponse converts a binary response to its JSON encoding.
+func (c *jsonCodec) marshalResponse(data []byte) ([]byte, error) {
+	md, err := c.descriptor()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dynamicpb.NewMessage(md.Output())
+	if err := protov2.Unmarshal(data, msg); err != nil {
+		return nil, errors.Wrap(err, "invalid response")
+	}
+
+	return protojson.Marshal(msg)
+}
@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestStreamJSON_TextFrames(t *testing.T) {
+	addr, cleanup := setup(t)
+	defer cleanup()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Responses mirror the type of message the client sent.
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"message":"a","repetitions":2,"responses":2,"interval":"0s"}`)))
+	for _, expected := range []string{`{"message":"aa"}`, `{"message":"aa","index":"1"}`} {
+		messageType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, websocket.TextMessage, messageType)
+		assert.JSONEq(t, expected, string(data))
+	}
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+}
+
+func TestStreamJSON_Binary(t *testing.T) {
+	addr, cleanup := setup(t)
+	defer cleanup()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := proto.Marshal(&echo.EchoStreamRequest{Message: "a", Repetitions: 2, Responses: 1})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, b))
+
+	messageType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+
+	resp := &echo.EchoStreamResponse{}
+	require.NoError(t, proto.Unmarshal(data, resp))
+	assert.Equal(t, "aa", resp.Message)
+}
+
+func TestStreamJSON_Subprotocol(t *testing.T) {
+	addr, cleanup := setup(t)
+	defer cleanup()
+
+	conn, resp, err := (&websocket.Dialer{Subprotocols: []string{JSONSubprotocol}}).Dial(
+		fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr), nil,
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, JSONSubprotocol, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// Binary requests still receive JSON responses.
+	b, err := proto.Marshal(&echo.EchoStreamRequest{Message: "a", Repetitions: 3, Responses: 1})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, b))
+
+	messageType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.JSONEq(t, `{"message":"aaa"}`, string(data))
+}
+
+func TestStreamJSON_Invalid(t *testing.T) {
+	addr, cleanup := setup(t)
+	defer cleanup()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/echo.v1.Echo/EchoStream", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"unknown":1}`)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.InvalidArgument)), err)
+	assert.Contains(t, err.Error(), "invalid JSON message")
+}
+
+func TestStreamJSON_NoDescriptors(t *testing.T) {
+	cc := &fakeConn{
+		stream: func(method string, reqs <-chan []byte, send func([]byte)) error {
+			<-reqs
+			return nil
+		},
+	}
+	addr, cleanup := serveMux(t, New(fakeServices, cc))
+	defer cleanup()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/test.v1.Test/Bidi", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{}`)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4000+int(codes.InvalidArgument)), err)
+	assert.Contains(t, err.Error(), "JSON messages are not supported")
+}
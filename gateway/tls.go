@@ -0,0 +1,239 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// Metadata keys used to forward the identity of a verified client certificate.
+	ClientSubjectKey     = "x-client-cert-subject"
+	ClientDNSNamesKey    = "x-client-cert-dns-names"
+	ClientURIsKey        = "x-client-cert-uris"
+	ClientEmailsKey      = "x-client-cert-emails"
+	ClientFingerprintKey = "x-client-cert-fingerprint"
+)
+
+var (
+	identityKeys = []string{
+		ClientSubjectKey,
+		ClientDNSNamesKey,
+		ClientURIsKey,
+		ClientEmailsKey,
+		ClientFingerprintKey,
+	}
+)
+
+// TLSConfig configures TLS termination for the gateway.
+//
+// The certificate, key, and client CA files are reloaded from disk whenever
+// their modification time changes, so certificates can be rotated without
+// restarting the server.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded server certificate and key.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is a PEM encoded bundle of CAs used to verify client
+	// certificates. If empty, client certificates are not requested.
+	ClientCAFile string
+
+	// RequireClientCert rejects connections without a verified client
+	// certificate. If false, client certificates are verified if provided.
+	RequireClientCert bool
+
+	// MinVersion is the minimum TLS version. Defaults to TLS 1.2.
+	MinVersion uint16
+}
+
+// ServeTLS serves HTTPS on the provided listener, forwarding requests
+// to the gRPC server.
+//
+// If the client presented a verified certificate, its identity is forwarded
+// to the gRPC server as metadata (see ClientSubjectKey, etc).
+func (m *Mux) ServeTLS(l net.Listener, config TLSConfig) error {
+	tlsConfig, err := config.build()
+	if err != nil {
+		return err
+	}
+
+	srv, err := m.tlsServer(tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(tls.NewListener(l, tlsConfig))
+}
+
+// ListenAndServeTLS listens on the specified address, and forwards
+// requests to the gRPC server over HTTPS.
+func (m *Mux) ListenAndServeTLS(listenAddr string, config TLSConfig) error {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	return m.ServeTLS(l, config)
+}
+
+func (c TLSConfig) build() (*tls.Config, error) {
+	r := &tlsReloader{config: c}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+
+	minVersion := c.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	return &tls.Config{
+		MinVersion: minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			loaded, err := r.load()
+			if err != nil {
+				return nil, err
+			}
+
+			conf := &tls.Config{
+				MinVersion:   minVersion,
+				Certificates: []tls.Certificate{*loaded.cert},
+				NextProtos:   []string{"http/1.1"},
+			}
+			if loaded.clientCAs != nil {
+				conf.ClientCAs = loaded.clientCAs
+				conf.ClientAuth = tls.VerifyClientCertIfGiven
+				if c.RequireClientCert {
+					conf.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+
+			return conf, nil
+		},
+	}, nil
+}
+
+type loadedTLS struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// tlsReloader reloads the certificate files whenever their modification
+// time changes. If a reload fails, the previously loaded files continue
+// to be used.
+type tlsReloader struct {
+	config TLSConfig
+
+	sync.Mutex
+	modTimes []time.Time
+	loaded   *loadedTLS
+}
+
+func (r *tlsReloader) load() (*loadedTLS, error) {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+
+	modTimes := make([]time.Time, len(files))
+	for i, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return r.fallback(errors.Wrapf(err, "failed to stat %s", f))
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.loaded != nil && equalTimes(r.modTimes, modTimes) {
+		return r.loaded, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return r.fallbackLocked(errors.Wrap(err, "failed to load key pair"))
+	}
+
+	loaded := &loadedTLS{cert: &cert}
+	if r.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return r.fallbackLocked(errors.Wrap(err, "failed to read client CAs"))
+		}
+
+		loaded.clientCAs = x509.NewCertPool()
+		if !loaded.clientCAs.AppendCertsFromPEM(pem) {
+			return r.fallbackLocked(errors.New("no client CAs found"))
+		}
+	}
+
+	r.modTimes = modTimes
+	r.loaded = loaded
+	return loaded, nil
+}
+
+func (r *tlsReloader) fallback(err error) (*loadedTLS, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.fallbackLocked(err)
+}
+
+func (r *tlsReloader) fallbackLocked(err error) (*loadedTLS, error) {
+	if r.loaded != nil {
+		return r.loaded, nil
+	}
+
+	return nil, err
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// clientIdentity returns the identity of the verified client certificate
+// as metadata, if present.
+func clientIdentity(state *tls.ConnectionState) metadata.MD {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	md := metadata.Pairs(
+		ClientSubjectKey, cert.Subject.String(),
+		ClientFingerprintKey, hex.EncodeToString(fingerprint[:]),
+	)
+	if len(cert.DNSNames) > 0 {
+		md.Set(ClientDNSNamesKey, cert.DNSNames...)
+	}
+	if len(cert.EmailAddresses) > 0 {
+		md.Set(ClientEmailsKey, cert.EmailAddresses...)
+	}
+	for _, u := range cert.URIs {
+		md.Append(ClientURIsKey, u.String())
+	}
+
+	return md
+}
@@ -0,0 +1,250 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"mfycheng.dev/grpc-over-http/examples/echo"
+)
+
+func TestTLS_ClientIdentity(t *testing.T) {
+	ca := newTestCert(t, nil, "ca")
+	server := newTestCert(t, ca, "server")
+	client := newTestCert(t, ca, "client")
+
+	addr, cleanup := setupTLS(t, ca, server, false, WithForwardedHeaders("Authorization", "X-Client-Cert-Subject"))
+	defer cleanup()
+
+	fingerprint := sha256.Sum256(client.cert.Raw)
+	for key, expected := range map[string]string{
+		ClientSubjectKey:     "CN=client",
+		ClientDNSNamesKey:    "client.example.com",
+		ClientFingerprintKey: hex.EncodeToString(fingerprint[:]),
+	} {
+		actual, err := tlsEcho(addr, ca, client, nil, key)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual, key)
+	}
+
+	// Clients without a certificate should not be able to spoof one.
+	actual, err := tlsEcho(addr, ca, nil, http.Header{"X-Client-Cert-Subject": []string{"CN=client"}}, ClientSubjectKey)
+	require.NoError(t, err)
+	assert.Empty(t, actual)
+}
+
+func TestTLS_RequireClientCert(t *testing.T) {
+	ca := newTestCert(t, nil, "ca")
+	server := newTestCert(t, ca, "server")
+	client := newTestCert(t, ca, "client")
+	other := newTestCert(t, newTestCert(t, nil, "other-ca"), "client")
+
+	addr, cleanup := setupTLS(t, ca, server, true)
+	defer cleanup()
+
+	_, err := tlsEcho(addr, ca, client, nil, ClientSubjectKey)
+	assert.NoError(t, err)
+
+	_, err = tlsEcho(addr, ca, nil, nil, ClientSubjectKey)
+	assert.Error(t, err)
+
+	_, err = tlsEcho(addr, ca, other, nil, ClientSubjectKey)
+	assert.Error(t, err)
+}
+
+func TestTLS_Reload(t *testing.T) {
+	ca := newTestCert(t, nil, "ca")
+	server := newTestCert(t, ca, "server")
+
+	dir, err := ioutil.TempDir("", "gateway-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := TLSConfig{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+	server.write(t, config.CertFile, config.KeyFile)
+
+	tlsConfig, err := config.build()
+	require.NoError(t, err)
+
+	served := func() *big.Int {
+		conf, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+
+		cert, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+		require.NoError(t, err)
+		return cert.SerialNumber
+	}
+	assert.Equal(t, server.cert.SerialNumber, served())
+
+	rotated := newTestCert(t, ca, "server")
+	rotated.write(t, config.CertFile, config.KeyFile)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(config.CertFile, future, future))
+	assert.Equal(t, rotated.cert.SerialNumber, served())
+
+	// Failed reloads should continue to serve the previous certificate.
+	require.NoError(t, ioutil.WriteFile(config.KeyFile, []byte("garbage"), 0600))
+	require.NoError(t, os.Chtimes(config.KeyFile, future, future))
+	assert.Equal(t, rotated.cert.SerialNumber, served())
+}
+
+func setupTLS(t *testing.T, ca, server *testCert, requireClientCert bool, opts ...MuxOption) (addr string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "gateway-tls")
+	require.NoError(t, err)
+
+	config := TLSConfig{
+		CertFile:          filepath.Join(dir, "cert.pem"),
+		KeyFile:           filepath.Join(dir, "key.pem"),
+		ClientCAFile:      filepath.Join(dir, "ca.pem"),
+		RequireClientCert: requireClientCert,
+	}
+	server.write(t, config.CertFile, config.KeyFile)
+	ca.write(t, config.ClientCAFile, filepath.Join(dir, "ca.key"))
+
+	m, cleanupMux := setupMux(t, func(s *grpc.Server) {
+		echo.RegisterEchoServer(s, &mdServ{})
+	}, opts...)
+
+	hl, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = m.ServeTLS(hl, config)
+	}()
+
+	return hl.Addr().String(), func() {
+		hl.Close()
+		cleanupMux()
+		os.RemoveAll(dir)
+	}
+}
+
+func tlsEcho(addr string, ca, client *testCert, header http.Header, key string) (string, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tlsConfig := &tls.Config{RootCAs: roots}
+	if client != nil {
+		tlsConfig.Certificates = []tls.Certificate{client.tlsCert()}
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	b, err := proto.Marshal(&echo.EchoRequest{Message: key})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/api/echo.v1.Echo/Echo", addr), bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-type", "application/proto")
+
+	httpResp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer httpResp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return "", err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %d", httpResp.StatusCode)
+	}
+
+	resp := &echo.EchoResponse{}
+	if err := proto.Unmarshal(respBytes, resp); err != nil {
+		return "", err
+	}
+
+	return resp.Message, nil
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by the parent, or a self-signed
+// CA if the parent is nil.
+func newTestCert(t *testing.T, parent *testCert, name string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name + ".example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.cert.Raw},
+		PrivateKey:  c.key,
+	}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	keyBytes, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+}